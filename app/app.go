@@ -1,7 +1,13 @@
 package app
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -13,19 +19,30 @@ import (
 
 // App represents the main application structure
 type App struct {
+	config     Config
 	router     *mux.Router
 	upgrader   *websocket.Upgrader
 	userRepo   repositories.UserRepository
 	chatRepo   repositories.ChatRepository
 	messageSvc *services.MessageService
+	authSvc    *services.AuthService
 	hub        *sockets.ConnectionHub
+	db         *sql.DB
+	stop       chan struct{} // closed by Close to end background work
+	stopOnce   sync.Once
 }
 
+// purgeInterval is how often expired uploads and change log entries are looked for at most
+const purgeInterval = time.Hour
+
 // NewApp creates and initializes a new App instance
-func NewApp() *App {
+func NewApp(cfg Config) (*App, error) {
 	app := &App{
+		config: cfg,
 		router: mux.NewRouter(),
+		stop:   make(chan struct{}),
 		upgrader: &websocket.Upgrader{
+			Subprotocols: sockets.SupportedSubprotocols,
 			CheckOrigin: func(r *http.Request) bool {
 				// In production, validate specific origins
 				return true
@@ -34,10 +51,22 @@ func NewApp() *App {
 	}
 
 	// Initialize repositories and services
-	app.userRepo = repositories.NewMemoryUserRepository()
-	app.chatRepo = repositories.NewMemoryChatRepository()
-	app.messageSvc = services.NewMessageService(app.chatRepo)
-	app.hub = sockets.NewConnectionHub(app.messageSvc)
+	if err := app.setupRepositories(cfg); err != nil {
+		return nil, err
+	}
+	blobs := repositories.NewFileBlobStore(cfg.BlobPath)
+	app.messageSvc = services.NewMessageService(app.userRepo, app.chatRepo, blobs, cfg.EditWindow, cfg.DeleteWindow, cfg.MaxAttachmentSize)
+
+	secret := []byte(cfg.AuthSecret)
+	if len(secret) == 0 {
+		// Tokens will not survive a restart; set AUTH_SECRET in production
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generate auth secret: %w", err)
+		}
+	}
+	app.authSvc = services.NewAuthService(app.userRepo, secret, cfg.TokenTTL)
+	app.hub = sockets.NewConnectionHub(app.messageSvc, cfg.OfflineQueueLimit)
 
 	// Setup routes
 	app.setupRoutes()
@@ -45,7 +74,82 @@ func NewApp() *App {
 	// Start WebSocket hub
 	go app.hub.Run()
 
-	return app
+	if cfg.AttachmentTTL > 0 || cfg.ChangeRetention > 0 {
+		go app.purge(cfg.AttachmentTTL, cfg.ChangeRetention)
+	}
+
+	return app, nil
+}
+
+// purge periodically deletes uploads that were not sent within attachmentTTL and change log
+// entries older than changeRetention, a zero duration keeping them, until the application is closed
+func (a *App) purge(attachmentTTL, changeRetention time.Duration) {
+	interval := purgeInterval
+	for _, d := range []time.Duration{attachmentTTL, changeRetention} {
+		if d > 0 {
+			interval = min(interval, d)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case now := <-ticker.C:
+			if attachmentTTL > 0 {
+				purged, err := a.messageSvc.PurgeUnclaimedAttachments(now.Add(-attachmentTTL))
+				if err != nil {
+					log.Printf("Error purging unsent attachments: %v", err)
+				} else if purged > 0 {
+					log.Printf("Purged %d unsent attachments", purged)
+				}
+			}
+			if changeRetention > 0 {
+				purged, err := a.messageSvc.PurgeChanges(now.Add(-changeRetention))
+				if err != nil {
+					log.Printf("Error purging change log entries: %v", err)
+				} else if purged > 0 {
+					log.Printf("Purged %d change log entries", purged)
+				}
+			}
+		}
+	}
+}
+
+// setupRepositories initializes the storage backend selected in the configuration
+func (a *App) setupRepositories(cfg Config) error {
+	switch cfg.StorageDriver {
+	case "", StorageMemory:
+		a.userRepo = repositories.NewMemoryUserRepository()
+		a.chatRepo = repositories.NewMemoryChatRepository()
+	case StorageSQLite:
+		db, err := repositories.OpenSQLite(cfg.SQLitePath)
+		if err != nil {
+			return fmt.Errorf("open sqlite database: %w", err)
+		}
+		a.db = db
+		a.userRepo = repositories.NewSQLiteUserRepository(db)
+		a.chatRepo = repositories.NewSQLiteChatRepository(db)
+	default:
+		return fmt.Errorf("unknown storage driver %q", cfg.StorageDriver)
+	}
+
+	return nil
+}
+
+// Close stops the background work and the WebSocket hub, disconnecting every client, and releases
+// resources held by the application
+func (a *App) Close() error {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+		a.hub.Stop()
+	})
+	if a.db != nil {
+		return a.db.Close()
+	}
+	return nil
 }
 
 // Handler returns the HTTP handler
@@ -58,19 +162,49 @@ func (a *App) setupRoutes() {
 	// API routes
 	api := a.router.PathPrefix("/api/v1").Subrouter()
 
-	// User management
+	// Public endpoints: registration and login
 	api.HandleFunc("/users", a.createUser).Methods("POST")
-	api.HandleFunc("/users/{id}", a.getUser).Methods("GET")
+	api.HandleFunc("/auth/login", a.login).Methods("POST")
+
+	// Everything else requires a bearer token
+	protected := api.NewRoute().Subrouter()
+	protected.Use(a.authMiddleware)
+
+	// User management
+	protected.HandleFunc("/users/{id}", a.getUser).Methods("GET")
+	protected.HandleFunc("/users/{id}/devices", a.listUserDevices).Methods("GET")
 
 	// Chat management
-	api.HandleFunc("/chats", a.listUserChats).Methods("GET")
-	api.HandleFunc("/chats/{chatId}/messages", a.listChatMessages).Methods("GET")
+	protected.HandleFunc("/chats", a.listUserChats).Methods("GET")
+	protected.HandleFunc("/chats", a.createGroupChat).Methods("POST")
+	protected.HandleFunc("/chats/{chatId}", a.getChat).Methods("GET")
+	protected.HandleFunc("/chats/{chatId}", a.updateChat).Methods("PATCH")
+	protected.HandleFunc("/chats/{chatId}/members", a.addChatMember).Methods("POST")
+	protected.HandleFunc("/chats/{chatId}/members/{userId}", a.updateChatMember).Methods("PATCH")
+	protected.HandleFunc("/chats/{chatId}/members/{userId}", a.removeChatMember).Methods("DELETE")
+	protected.HandleFunc("/chats/{chatId}/leave", a.leaveChat).Methods("POST")
+	protected.HandleFunc("/chats/{chatId}/messages", a.listChatMessages).Methods("GET")
+	protected.HandleFunc("/chats/{chatId}/read", a.markChatRead).Methods("POST")
 
 	// Message handling
-	api.HandleFunc("/messages", a.sendMessage).Methods("POST")
+	protected.HandleFunc("/messages", a.sendMessage).Methods("POST")
+	protected.HandleFunc("/messages/undelivered", a.listUndeliveredMessages).Methods("GET")
+	protected.HandleFunc("/messages/{id}", a.editMessage).Methods("PATCH")
+	protected.HandleFunc("/messages/{id}", a.deleteMessage).Methods("DELETE")
+	protected.HandleFunc("/messages/{id}/revisions", a.listMessageRevisions).Methods("GET")
+	protected.HandleFunc("/messages/{id}/reactions", a.addReaction).Methods("POST")
+	protected.HandleFunc("/messages/{id}/reactions", a.removeReaction).Methods("DELETE")
+
+	// Attachments
+	protected.HandleFunc("/attachments", a.uploadAttachment).Methods("POST")
+	protected.HandleFunc("/attachments/{id}", a.downloadAttachment).Methods("GET")
+	protected.HandleFunc("/attachments/{id}/thumbnail", a.downloadThumbnail).Methods("GET")
+
+	// Catching up after a reconnect
+	protected.HandleFunc("/sync", a.sync).Methods("GET")
 
 	// WebSocket endpoint for real-time communication
-	a.router.HandleFunc("/ws", a.handleWebSocket)
+	a.router.Handle("/ws", a.authMiddleware(http.HandlerFunc(a.handleWebSocket)))
 
 	// Health check
 	a.router.HandleFunc("/health", a.healthCheck).Methods("GET")
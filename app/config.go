@@ -0,0 +1,123 @@
+package app
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Storage drivers supported by the application
+const (
+	StorageMemory = "memory"
+	StorageSQLite = "sqlite"
+)
+
+// Config holds the runtime configuration of the application
+type Config struct {
+	StorageDriver string // "memory" (default) or "sqlite"
+	SQLitePath    string // database file used when StorageDriver is "sqlite"
+
+	AuthSecret string        // HMAC key used to sign access tokens; random per process when empty
+	TokenTTL   time.Duration // lifetime of issued access tokens
+
+	OfflineQueueLimit int // undelivered messages pushed to a user on connect; the rest via REST
+
+	EditWindow   time.Duration // how long senders may edit a message after sending it; 0 disables edits
+	DeleteWindow time.Duration // how long senders may delete a message for everyone; 0 disables it
+
+	BlobPath          string        // directory the content of attachments is stored in
+	MaxAttachmentSize int64         // bytes an uploaded attachment may have
+	AttachmentTTL     time.Duration // how long uploads may wait to be sent before they are deleted; 0 keeps them
+
+	ChangeRetention time.Duration // how long change log entries are kept for sync; 0 keeps them forever
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() Config {
+	return Config{
+		StorageDriver: StorageMemory,
+		SQLitePath:    "messaging.db",
+		TokenTTL:      24 * time.Hour,
+
+		OfflineQueueLimit: 100,
+
+		EditWindow:   15 * time.Minute,
+		DeleteWindow: time.Hour,
+
+		BlobPath:          "blobs",
+		MaxAttachmentSize: 10 << 20,
+		AttachmentTTL:     24 * time.Hour,
+
+		ChangeRetention: 30 * 24 * time.Hour,
+	}
+}
+
+// LoadConfig builds the configuration from environment variables, falling back to defaults
+func LoadConfig() Config {
+	cfg := DefaultConfig()
+
+	if driver := os.Getenv("STORAGE_DRIVER"); driver != "" {
+		cfg.StorageDriver = driver
+	}
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		cfg.SQLitePath = path
+	}
+	if secret := os.Getenv("AUTH_SECRET"); secret != "" {
+		cfg.AuthSecret = secret
+	}
+	if ttl := os.Getenv("AUTH_TOKEN_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err == nil && d > 0 {
+			cfg.TokenTTL = d
+		} else {
+			log.Printf("Ignoring invalid AUTH_TOKEN_TTL %q", ttl)
+		}
+	}
+	if limit := os.Getenv("OFFLINE_QUEUE_LIMIT"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil && n >= 0 {
+			cfg.OfflineQueueLimit = n
+		} else {
+			log.Printf("Ignoring invalid OFFLINE_QUEUE_LIMIT %q", limit)
+		}
+	}
+	if window := os.Getenv("MESSAGE_EDIT_WINDOW"); window != "" {
+		if d, err := time.ParseDuration(window); err == nil && d >= 0 {
+			cfg.EditWindow = d
+		} else {
+			log.Printf("Ignoring invalid MESSAGE_EDIT_WINDOW %q", window)
+		}
+	}
+	if window := os.Getenv("MESSAGE_DELETE_WINDOW"); window != "" {
+		if d, err := time.ParseDuration(window); err == nil && d >= 0 {
+			cfg.DeleteWindow = d
+		} else {
+			log.Printf("Ignoring invalid MESSAGE_DELETE_WINDOW %q", window)
+		}
+	}
+	if path := os.Getenv("BLOB_PATH"); path != "" {
+		cfg.BlobPath = path
+	}
+	if size := os.Getenv("MAX_ATTACHMENT_SIZE"); size != "" {
+		if n, err := strconv.ParseInt(size, 10, 64); err == nil && n > 0 {
+			cfg.MaxAttachmentSize = n
+		} else {
+			log.Printf("Ignoring invalid MAX_ATTACHMENT_SIZE %q", size)
+		}
+	}
+	if ttl := os.Getenv("ATTACHMENT_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err == nil && d >= 0 {
+			cfg.AttachmentTTL = d
+		} else {
+			log.Printf("Ignoring invalid ATTACHMENT_TTL %q", ttl)
+		}
+	}
+	if retention := os.Getenv("CHANGE_RETENTION"); retention != "" {
+		if d, err := time.ParseDuration(retention); err == nil && d >= 0 {
+			cfg.ChangeRetention = d
+		} else {
+			log.Printf("Ignoring invalid CHANGE_RETENTION %q", retention)
+		}
+	}
+
+	return cfg
+}
@@ -2,19 +2,39 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"time"
 
 	"messaging-app/domain"
 	"messaging-app/sockets"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxDeviceIDLength bounds client-chosen WebSocket device identifiers
+	maxDeviceIDLength = 64
+
+	// sendBufferSize is the per-connection outbound buffer, on top of room for the offline queue flush
+	sendBufferSize = 256
+
+	// multipartOverhead is the room left for the multipart framing of attachment uploads
+	multipartOverhead = 64 << 10
 )
 
 // HTTP handler methods for the App
 func (a *App) createUser(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Username string `json:"username"`
+		Password string `json:"password"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -27,14 +47,14 @@ func (a *App) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := &domain.User{
-		Username: req.Username,
-	}
-
-	if err := a.userRepo.Create(user); err != nil {
-		if err == domain.ErrUsernameExists {
+	user, err := a.authSvc.Register(req.Username, req.Password)
+	if err != nil {
+		switch err {
+		case domain.ErrUsernameExists:
 			writeError(w, http.StatusConflict, "Username already exists")
-		} else {
+		case domain.ErrInvalidUsername, domain.ErrReservedUsername, domain.ErrInvalidPassword:
+			writeError(w, http.StatusBadRequest, err.Error())
+		default:
 			writeError(w, http.StatusInternalServerError, "Failed to create user")
 		}
 		return
@@ -43,6 +63,30 @@ func (a *App) createUser(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusCreated, user)
 }
 
+func (a *App) login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	token, err := a.authSvc.Login(req.Username, req.Password)
+	if err != nil {
+		if err == domain.ErrInvalidCredentials {
+			writeError(w, http.StatusUnauthorized, err.Error())
+		} else {
+			writeError(w, http.StatusInternalServerError, "Failed to log in")
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, token)
+}
+
 func (a *App) getUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["id"]
@@ -60,12 +104,40 @@ func (a *App) getUser(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, user)
 }
 
+func (a *App) listUserDevices(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+
+	if err := a.messageSvc.AuthorizePresence(currentUser(r).ID, userID); err != nil {
+		switch err {
+		case domain.ErrUserNotFound:
+			writeError(w, http.StatusNotFound, "User not found")
+		case domain.ErrNoSharedChat:
+			writeError(w, http.StatusForbidden, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, "Failed to get user")
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user_id": userID,
+		"online":  a.hub.OnlineDevices(userID),
+	})
+}
+
 func (a *App) sendMessage(w http.ResponseWriter, r *http.Request) {
+	// The sender is always the authenticated user, never a client-supplied ID
+	sender := currentUser(r)
+
+	// A message goes either to a recipient, in their 1:1 chat, or to an existing chat
 	var req struct {
-		SenderID       string `json:"sender_id"`
-		RecipientID    string `json:"recipient_id"`
-		Content        string `json:"content"`
-		IdempotencyKey string `json:"idempotency_key,omitempty"`
+		RecipientID    string   `json:"recipient_id,omitempty"`
+		ChatID         string   `json:"chat_id,omitempty"`
+		Content        string   `json:"content"`
+		IdempotencyKey string   `json:"idempotency_key,omitempty"`
+		ReplyToID      string   `json:"reply_to_id,omitempty"`
+		AttachmentIDs  []string `json:"attachment_ids,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -73,32 +145,317 @@ func (a *App) sendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	message, err := a.messageSvc.SendMessage(req.SenderID, req.RecipientID, req.Content, req.IdempotencyKey)
+	var message *domain.Message
+	var created bool
+	var err error
+	switch {
+	case req.ChatID != "" && req.RecipientID != "":
+		err = domain.ErrRecipientAndChat
+	case req.ChatID != "":
+		message, created, err = a.messageSvc.SendToChat(sender.ID, req.ChatID, req.Content, req.IdempotencyKey, req.ReplyToID, req.AttachmentIDs)
+	default:
+		message, created, err = a.messageSvc.SendMessage(sender.ID, req.RecipientID, req.Content, req.IdempotencyKey, req.ReplyToID, req.AttachmentIDs)
+	}
 	if err != nil {
 		switch err {
-		case domain.ErrInvalidUser, domain.ErrCannotMessageSelf, domain.ErrEmptyMessage:
+		case domain.ErrInvalidUser, domain.ErrCannotMessageSelf, domain.ErrEmptyMessage, domain.ErrInvalidReplyTo, domain.ErrRecipientAndChat,
+			domain.ErrAttachmentUnavailable, domain.ErrTooManyAttachments:
 			writeError(w, http.StatusBadRequest, err.Error())
 		case domain.ErrUserNotFound:
 			writeError(w, http.StatusNotFound, "User not found")
+		case domain.ErrChatNotFound:
+			writeError(w, http.StatusNotFound, "Chat not found")
+		case domain.ErrNotParticipant:
+			writeError(w, http.StatusForbidden, err.Error())
+		case domain.ErrIdempotencyKeyReused:
+			writeError(w, http.StatusConflict, err.Error())
 		default:
 			writeError(w, http.StatusInternalServerError, "Failed to send message")
 		}
 		return
 	}
 
-	// Broadcast to recipient
-	a.hub.BroadcastMessage(message, req.RecipientID)
+	// A retry was already broadcast by the request that created the message
+	if !created {
+		writeJSON(w, http.StatusOK, message)
+		return
+	}
+
+	// Broadcast to the other participants and to all of the sender's devices
+	a.hub.BroadcastMessage(message, "")
 
 	writeJSON(w, http.StatusCreated, message)
 }
 
-func (a *App) listUserChats(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
-	if userID == "" {
-		writeError(w, http.StatusBadRequest, "user_id parameter is required")
+func (a *App) listUndeliveredMessages(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	messages, remaining, err := a.messageSvc.FetchUndeliveredMessages(currentUser(r).ID, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to get undelivered messages")
+		return
+	}
+
+	for _, message := range messages {
+		a.hub.SendReceipt(message)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data":      messages,
+		"remaining": remaining,
+	})
+}
+
+func (a *App) editMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+
+	var req struct {
+		Content string `json:"content"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	message, err := a.messageSvc.EditMessage(currentUser(r).ID, messageID, req.Content)
+	if err != nil {
+		switch err {
+		case domain.ErrMessageNotFound, domain.ErrChatNotFound:
+			writeError(w, http.StatusNotFound, "Message not found")
+		case domain.ErrEmptyMessage:
+			writeError(w, http.StatusBadRequest, err.Error())
+		case domain.ErrNotParticipant, domain.ErrNotSender, domain.ErrEditWindowExpired:
+			writeError(w, http.StatusForbidden, err.Error())
+		case domain.ErrMessageDeleted:
+			writeError(w, http.StatusConflict, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, "Failed to edit message")
+		}
 		return
 	}
 
+	a.hub.SendMessageEdited(message, "")
+
+	writeJSON(w, http.StatusOK, message)
+}
+
+func (a *App) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+
+	scope := domain.DeletionScope(r.URL.Query().Get("scope"))
+	if scope == "" {
+		scope = domain.DeleteForMe
+	}
+
+	message, err := a.messageSvc.DeleteMessage(currentUser(r).ID, messageID, scope)
+	if err != nil {
+		switch err {
+		case domain.ErrMessageNotFound, domain.ErrChatNotFound:
+			writeError(w, http.StatusNotFound, "Message not found")
+		case domain.ErrInvalidDeletionScope:
+			writeError(w, http.StatusBadRequest, err.Error())
+		case domain.ErrNotParticipant, domain.ErrNotSender, domain.ErrDeleteWindowExpired:
+			writeError(w, http.StatusForbidden, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, "Failed to delete message")
+		}
+		return
+	}
+
+	a.hub.SendMessageDeleted(message, scope, currentUser(r).ID, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *App) listMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+
+	revisions, err := a.messageSvc.GetMessageRevisions(currentUser(r).ID, messageID)
+	if err != nil {
+		switch err {
+		case domain.ErrMessageNotFound, domain.ErrChatNotFound:
+			writeError(w, http.StatusNotFound, "Message not found")
+		case domain.ErrNotParticipant:
+			writeError(w, http.StatusForbidden, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, "Failed to get message revisions")
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": revisions,
+	})
+}
+
+func (a *App) addReaction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+
+	var req struct {
+		Emoji string `json:"emoji"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user := currentUser(r)
+	message, added, err := a.messageSvc.AddReaction(user.ID, messageID, req.Emoji)
+	if err != nil {
+		writeReactionError(w, err, "Failed to add reaction")
+		return
+	}
+
+	if added {
+		a.hub.SendReaction(sockets.EventReactionAdded, message, user.ID, req.Emoji, "")
+	}
+
+	writeJSON(w, http.StatusOK, message)
+}
+
+func (a *App) removeReaction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+	emoji := r.URL.Query().Get("emoji")
+
+	user := currentUser(r)
+	message, removed, err := a.messageSvc.RemoveReaction(user.ID, messageID, emoji)
+	if err != nil {
+		writeReactionError(w, err, "Failed to remove reaction")
+		return
+	}
+
+	if removed {
+		a.hub.SendReaction(sockets.EventReactionRemoved, message, user.ID, emoji, "")
+	}
+
+	writeJSON(w, http.StatusOK, message)
+}
+
+// writeReactionError maps the errors of adding or removing a reaction to a response
+func writeReactionError(w http.ResponseWriter, err error, fallback string) {
+	switch err {
+	case domain.ErrMessageNotFound, domain.ErrChatNotFound:
+		writeError(w, http.StatusNotFound, "Message not found")
+	case domain.ErrInvalidReaction:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case domain.ErrNotParticipant:
+		writeError(w, http.StatusForbidden, err.Error())
+	case domain.ErrMessageDeleted:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, fallback)
+	}
+}
+
+func (a *App) uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	// The multipart framing around the file takes a little more than the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, a.config.MaxAttachmentSize+multipartOverhead)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Expected a multipart/form-data body")
+		return
+	}
+
+	// Stream the file part instead of buffering the whole form
+	var part *multipart.Part
+	for {
+		part, err = reader.NextPart()
+		if err == io.EOF {
+			writeError(w, http.StatusBadRequest, "The file field is required")
+			return
+		}
+		if err != nil {
+			writeUploadError(w, err, http.StatusBadRequest, "Invalid multipart body")
+			return
+		}
+		if part.FormName() == "file" {
+			break
+		}
+	}
+
+	attachment, err := a.messageSvc.UploadAttachment(currentUser(r).ID, part.FileName(), part)
+	if err != nil {
+		writeUploadError(w, err, http.StatusInternalServerError, "Failed to upload attachment")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, attachment)
+}
+
+// writeUploadError maps the errors of uploading an attachment to a response, falling back to the
+// given status and message for errors that are not about the upload itself
+func writeUploadError(w http.ResponseWriter, err error, status int, message string) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == domain.ErrAttachmentTooLarge, errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, domain.ErrAttachmentTooLarge.Error())
+	case err == domain.ErrUnsupportedAttachment:
+		writeError(w, http.StatusUnsupportedMediaType, err.Error())
+	case err == domain.ErrEmptyAttachment:
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, status, message)
+	}
+}
+
+func (a *App) downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	a.serveAttachment(w, r, false)
+}
+
+func (a *App) downloadThumbnail(w http.ResponseWriter, r *http.Request) {
+	a.serveAttachment(w, r, true)
+}
+
+// serveAttachment writes the content of an attachment, or of its thumbnail, to participants of its
+// chat. Images are shown inline, anything else is offered as a download under its file name.
+func (a *App) serveAttachment(w http.ResponseWriter, r *http.Request, thumbnail bool) {
+	vars := mux.Vars(r)
+	attachmentID := vars["id"]
+
+	attachment, content, err := a.messageSvc.OpenAttachment(currentUser(r).ID, attachmentID, thumbnail)
+	if err != nil {
+		switch err {
+		case domain.ErrAttachmentNotFound, domain.ErrNoThumbnail, domain.ErrBlobNotFound, domain.ErrMessageNotFound, domain.ErrChatNotFound:
+			writeError(w, http.StatusNotFound, err.Error())
+		case domain.ErrNotParticipant:
+			writeError(w, http.StatusForbidden, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, "Failed to get attachment")
+		}
+		return
+	}
+	defer content.Close()
+
+	disposition, contentType := "attachment", attachment.ContentType
+	switch {
+	case thumbnail:
+		disposition, contentType = "inline", "image/jpeg"
+	case attachment.Kind == domain.AttachmentImage:
+		disposition = "inline"
+	}
+
+	// Attachments are user content: browsers must not guess another type or cache them publicly
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, content); err != nil {
+		log.Printf("Error writing attachment %s: %v", attachment.ID, err)
+	}
+}
+
+func (a *App) listUserChats(w http.ResponseWriter, r *http.Request) {
+	userID := currentUser(r).ID
+
 	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
 	pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
 
@@ -111,18 +468,190 @@ func (a *App) listUserChats(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, response)
 }
 
-func (a *App) listChatMessages(w http.ResponseWriter, r *http.Request) {
+func (a *App) createGroupChat(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Title     string   `json:"title"`
+		MemberIDs []string `json:"member_ids"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	chat, err := a.messageSvc.CreateGroupChat(currentUser(r).ID, req.Title, req.MemberIDs)
+	if err != nil {
+		writeGroupError(w, err, "Failed to create chat")
+		return
+	}
+
+	a.hub.SendChatUpdated(chat)
+
+	writeJSON(w, http.StatusCreated, chat)
+}
+
+func (a *App) getChat(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	chatID := vars["chatId"]
 
-	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-	pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	chat, err := a.messageSvc.GetChatForUser(currentUser(r).ID, chatID)
+	if err != nil {
+		writeGroupError(w, err, "Failed to get chat")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, chat)
+}
+
+func (a *App) updateChat(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID := vars["chatId"]
+
+	var req struct {
+		Title string `json:"title"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	chat, err := a.messageSvc.UpdateChatTitle(currentUser(r).ID, chatID, req.Title)
+	if err != nil {
+		writeGroupError(w, err, "Failed to update chat")
+		return
+	}
+
+	a.hub.SendChatUpdated(chat)
+
+	writeJSON(w, http.StatusOK, chat)
+}
+
+func (a *App) addChatMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID := vars["chatId"]
+
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	chat, err := a.messageSvc.AddChatMember(currentUser(r).ID, chatID, req.UserID)
+	if err != nil {
+		writeGroupError(w, err, "Failed to add member")
+		return
+	}
+
+	a.hub.SendChatUpdated(chat)
+
+	writeJSON(w, http.StatusOK, chat)
+}
+
+func (a *App) updateChatMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, memberID := vars["chatId"], vars["userId"]
+
+	var req struct {
+		Role domain.ChatRole `json:"role"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	chat, err := a.messageSvc.SetChatMemberRole(currentUser(r).ID, chatID, memberID, req.Role)
+	if err != nil {
+		writeGroupError(w, err, "Failed to update member")
+		return
+	}
+
+	a.hub.SendChatUpdated(chat)
+
+	writeJSON(w, http.StatusOK, chat)
+}
+
+func (a *App) removeChatMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, memberID := vars["chatId"], vars["userId"]
+
+	chat, err := a.messageSvc.RemoveChatMember(currentUser(r).ID, chatID, memberID)
+	if err != nil {
+		writeGroupError(w, err, "Failed to remove member")
+		return
+	}
+
+	a.hub.SendChatUpdated(chat, memberID)
+
+	writeJSON(w, http.StatusOK, chat)
+}
+
+func (a *App) leaveChat(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID := vars["chatId"]
+
+	user := currentUser(r)
+	chat, err := a.messageSvc.LeaveChat(user.ID, chatID)
+	if err != nil {
+		writeGroupError(w, err, "Failed to leave chat")
+		return
+	}
+
+	a.hub.SendChatUpdated(chat, user.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeGroupError maps the errors of reading a chat or managing a group chat to a response
+func writeGroupError(w http.ResponseWriter, err error, fallback string) {
+	switch err {
+	case domain.ErrChatNotFound:
+		writeError(w, http.StatusNotFound, "Chat not found")
+	case domain.ErrUserNotFound:
+		writeError(w, http.StatusNotFound, "User not found")
+	case domain.ErrNotMember:
+		writeError(w, http.StatusNotFound, err.Error())
+	case domain.ErrNotGroupChat, domain.ErrInvalidTitle, domain.ErrInvalidRole:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case domain.ErrNotParticipant, domain.ErrNotGroupAdmin, domain.ErrNotGroupOwner, domain.ErrOwnerProtected:
+		writeError(w, http.StatusForbidden, err.Error())
+	case domain.ErrAlreadyMember, domain.ErrGroupFull:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, fallback)
+	}
+}
+
+func (a *App) listChatMessages(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID := vars["chatId"]
 
-	response, err := a.messageSvc.GetChatMessages(chatID, page, pageSize)
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	pageSize, _ := strconv.Atoi(query.Get("page_size"))
+
+	// Cursor pagination is used as soon as a cursor or direction is given, page/offset otherwise
+	var response *domain.PaginatedResponse
+	var err error
+	before, after, direction := query.Get("before"), query.Get("after"), query.Get("direction")
+	if before != "" || after != "" || direction != "" {
+		response, err = a.messageSvc.GetChatMessagesPage(currentUser(r).ID, chatID, before, after, direction, pageSize)
+	} else {
+		response, err = a.messageSvc.GetChatMessages(currentUser(r).ID, chatID, page, pageSize)
+	}
 	if err != nil {
-		if err == domain.ErrChatNotFound {
+		switch err {
+		case domain.ErrChatNotFound:
 			writeError(w, http.StatusNotFound, "Chat not found")
-		} else {
+		case domain.ErrNotParticipant:
+			writeError(w, http.StatusForbidden, err.Error())
+		case domain.ErrInvalidCursor, domain.ErrInvalidDirection:
+			writeError(w, http.StatusBadRequest, err.Error())
+		default:
 			writeError(w, http.StatusInternalServerError, "Failed to get messages")
 		}
 		return
@@ -131,10 +660,73 @@ func (a *App) listChatMessages(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, response)
 }
 
+func (a *App) markChatRead(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID := vars["chatId"]
+
+	var req struct {
+		MessageID string `json:"message_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	mark, read, err := a.messageSvc.MarkChatRead(currentUser(r).ID, chatID, req.MessageID)
+	if err != nil {
+		switch err {
+		case domain.ErrChatNotFound:
+			writeError(w, http.StatusNotFound, "Chat not found")
+		case domain.ErrMessageNotFound:
+			writeError(w, http.StatusNotFound, "Message not found")
+		case domain.ErrNotParticipant:
+			writeError(w, http.StatusForbidden, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, "Failed to mark chat as read")
+		}
+		return
+	}
+
+	a.hub.SendChatRead(mark, read, "")
+
+	writeJSON(w, http.StatusOK, mark)
+}
+
+func (a *App) sync(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	result, err := a.messageSvc.Sync(currentUser(r).ID, query.Get("since"), limit)
+	if err != nil {
+		if err == domain.ErrInvalidSyncToken {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to sync")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
 func (a *App) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
-	if userID == "" {
-		writeError(w, http.StatusBadRequest, "user_id parameter is required")
+	userID := currentUser(r).ID
+
+	// Each device of a user keeps its own connection; reconnecting with the same
+	// device_id replaces the previous connection of that device
+	deviceID := r.URL.Query().Get("device_id")
+	if len(deviceID) > maxDeviceIDLength {
+		writeError(w, http.StatusBadRequest, "device_id is too long")
+		return
+	}
+	if deviceID == "" {
+		deviceID = uuid.New().String()
+	}
+
+	// Clients pinning a protocol version must ask for one the server speaks
+	if !supportsRequestedSubprotocol(r) {
+		writeError(w, http.StatusBadRequest, "Unsupported WebSocket subprotocol")
 		return
 	}
 
@@ -145,9 +737,11 @@ func (a *App) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &sockets.Client{
-		UserID: userID,
-		Conn:   conn,
-		Send:   make(chan []byte, 256),
+		UserID:      userID,
+		DeviceID:    deviceID,
+		ConnectedAt: time.Now(),
+		Conn:        conn,
+		Send:        make(chan []byte, sendBufferSize+a.config.OfflineQueueLimit),
 	}
 
 	a.hub.RegisterClient(client)
@@ -157,6 +751,24 @@ func (a *App) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	go client.StartReader(a.hub)
 }
 
+// supportsRequestedSubprotocol reports whether the client requested no subprotocol or at least one supported one
+func supportsRequestedSubprotocol(r *http.Request) bool {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return true
+	}
+
+	for _, protocol := range requested {
+		for _, supported := range sockets.SupportedSubprotocols {
+			if protocol == supported {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (a *App) healthCheck(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]string{"status": "healthy"})
 }
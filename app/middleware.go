@@ -0,0 +1,58 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"messaging-app/domain"
+)
+
+// contextKey is the type of keys stored in the request context by this package
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// authMiddleware authenticates the bearer token of the request and stores the user in its context.
+// WebSocket clients that cannot set headers may pass the token as the access_token query parameter.
+func (a *App) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			writeError(w, http.StatusUnauthorized, domain.ErrUnauthorized.Error())
+			return
+		}
+
+		user, err := a.authSvc.Authenticate(token)
+		if err != nil {
+			if err == domain.ErrUnauthorized {
+				writeError(w, http.StatusUnauthorized, err.Error())
+			} else {
+				writeError(w, http.StatusInternalServerError, "Failed to authenticate")
+			}
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// bearerToken extracts the access token from the Authorization header or the access_token query parameter
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+
+	return r.URL.Query().Get("access_token")
+}
+
+// currentUser returns the authenticated user stored in the request context by authMiddleware
+func currentUser(r *http.Request) *domain.User {
+	user, _ := r.Context().Value(userContextKey).(*domain.User)
+	return user
+}
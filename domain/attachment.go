@@ -0,0 +1,102 @@
+package domain
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MaxMessageAttachments caps the attachments of a single message
+const MaxMessageAttachments = 10
+
+// MaxFileNameLength caps the characters kept of an uploaded file's name
+const MaxFileNameLength = 255
+
+// AttachmentPath is the API path attachments are downloaded from, followed by their ID
+const AttachmentPath = "/api/v1/attachments/"
+
+// AttachmentKind tells clients how to render an attachment
+type AttachmentKind string
+
+const (
+	AttachmentImage AttachmentKind = "image"
+	AttachmentVideo AttachmentKind = "video"
+	AttachmentAudio AttachmentKind = "audio"
+	AttachmentFile  AttachmentKind = "file"
+)
+
+// attachmentTypes lists the MIME types accepted for attachments with the kind of attachment they make
+var attachmentTypes = map[string]AttachmentKind{
+	"image/jpeg":      AttachmentImage,
+	"image/png":       AttachmentImage,
+	"image/gif":       AttachmentImage,
+	"image/webp":      AttachmentImage,
+	"video/mp4":       AttachmentVideo,
+	"video/webm":      AttachmentVideo,
+	"audio/mpeg":      AttachmentAudio,
+	"audio/ogg":       AttachmentAudio,
+	"audio/wave":      AttachmentAudio,
+	"application/pdf": AttachmentFile,
+	"application/zip": AttachmentFile,
+	"text/plain":      AttachmentFile,
+}
+
+// AttachmentKindOf returns the kind of attachment a MIME type makes and whether attachments of the
+// type are accepted at all
+func AttachmentKindOf(contentType string) (AttachmentKind, bool) {
+	kind, ok := attachmentTypes[contentType]
+	return kind, ok
+}
+
+// Attachment is a file uploaded by a user and, once sent, part of one of their messages. Its
+// content lives in a blob store; clients download it from URL, and images also from ThumbnailURL.
+type Attachment struct {
+	ID           string         `json:"id"`
+	MessageID    string         `json:"message_id,omitempty"` // empty until the attachment is sent
+	UploaderID   string         `json:"uploader_id"`
+	FileName     string         `json:"file_name"`
+	ContentType  string         `json:"content_type"`
+	Kind         AttachmentKind `json:"kind"`
+	Size         int64          `json:"size"`             // bytes
+	Width        int            `json:"width,omitempty"`  // pixels, for images the server can decode
+	Height       int            `json:"height,omitempty"` //
+	HasThumbnail bool           `json:"-"`
+	URL          string         `json:"url"`
+	ThumbnailURL string         `json:"thumbnail_url,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+// MarshalJSON fills in the download URLs, which are derived from the attachment's ID
+func (a Attachment) MarshalJSON() ([]byte, error) {
+	type plain Attachment
+	out := plain(a)
+	out.URL = AttachmentPath + a.ID
+	out.ThumbnailURL = ""
+	if a.HasThumbnail {
+		out.ThumbnailURL = out.URL + "/thumbnail"
+	}
+	return json.Marshal(out)
+}
+
+// CleanFileName reduces an uploaded file's name to its base name without control characters,
+// capped at MaxFileNameLength characters; names that end up empty become "attachment"
+func CleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	if runes := []rune(name); len(runes) > MaxFileNameLength {
+		name = string(runes[:MaxFileNameLength])
+	}
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
@@ -2,13 +2,53 @@ package domain
 
 // Application errors
 var (
-	ErrUserNotFound      = &AppError{"user not found", 404}
-	ErrChatNotFound      = &AppError{"chat not found", 404}
-	ErrMessageNotFound   = &AppError{"message not found", 404}
-	ErrUsernameExists    = &AppError{"username already exists", 409}
-	ErrInvalidUser       = &AppError{"invalid user", 400}
-	ErrCannotMessageSelf = &AppError{"cannot message yourself", 400}
-	ErrEmptyMessage      = &AppError{"message content cannot be empty", 400}
+	ErrUserNotFound            = &AppError{"user not found", 404}
+	ErrChatNotFound            = &AppError{"chat not found", 404}
+	ErrChatExists              = &AppError{"chat already exists", 409}
+	ErrMessageNotFound         = &AppError{"message not found", 404}
+	ErrUsernameExists          = &AppError{"username already exists", 409}
+	ErrInvalidUsername         = &AppError{"username must be 3-32 letters, digits, '.', '_' or '-' and start with a letter or digit", 400}
+	ErrReservedUsername        = &AppError{"username is reserved", 400}
+	ErrInvalidPassword         = &AppError{"password must be at least 8 characters", 400}
+	ErrInvalidCredentials      = &AppError{"invalid username or password", 401}
+	ErrUnauthorized            = &AppError{"missing or invalid access token", 401}
+	ErrNotParticipant          = &AppError{"not a participant of this chat", 403}
+	ErrNoSharedChat            = &AppError{"you do not share a chat with this user", 403}
+	ErrNotRecipient            = &AppError{"only the recipient can update the message status", 403}
+	ErrNotSender               = &AppError{"only the sender can change the message", 403}
+	ErrEditWindowExpired       = &AppError{"the message can no longer be edited", 403}
+	ErrDeleteWindowExpired     = &AppError{"the message can no longer be deleted for everyone", 403}
+	ErrMessageDeleted          = &AppError{"the message was deleted", 409}
+	ErrInvalidDeletionScope    = &AppError{"scope must be me or everyone", 400}
+	ErrInvalidReaction         = &AppError{"reaction must be a single emoji", 400}
+	ErrAttachmentNotFound      = &AppError{"attachment not found", 404}
+	ErrAttachmentUnavailable   = &AppError{"attachment_ids must be your own uploads that were not sent yet", 400}
+	ErrTooManyAttachments      = &AppError{"a message can have at most 10 attachments", 400}
+	ErrEmptyAttachment         = &AppError{"attachment is empty", 400}
+	ErrAttachmentTooLarge      = &AppError{"attachment is too large", 413}
+	ErrUnsupportedAttachment   = &AppError{"attachment type is not allowed", 415}
+	ErrNoThumbnail             = &AppError{"attachment has no thumbnail", 404}
+	ErrBlobNotFound            = &AppError{"blob not found", 404}
+	ErrRecipientAndChat        = &AppError{"set either recipient_id or chat_id", 400}
+	ErrNotGroupChat            = &AppError{"only group chats have a title and members", 400}
+	ErrInvalidTitle            = &AppError{"title must be 1-100 characters", 400}
+	ErrInvalidRole             = &AppError{"role must be admin or member", 400}
+	ErrNoGroupStatus           = &AppError{"group messages have no delivery status, mark the chat read instead", 400}
+	ErrNotGroupAdmin           = &AppError{"only the owner or an admin can manage the group", 403}
+	ErrNotGroupOwner           = &AppError{"only the owner can change roles or remove admins", 403}
+	ErrOwnerProtected          = &AppError{"the owner cannot be removed or demoted", 403}
+	ErrNotMember               = &AppError{"user is not a member of this chat", 404}
+	ErrAlreadyMember           = &AppError{"user is already a member of this chat", 409}
+	ErrGroupFull               = &AppError{"group chat is full", 409}
+	ErrInvalidUser             = &AppError{"invalid user", 400}
+	ErrCannotMessageSelf       = &AppError{"cannot message yourself", 400}
+	ErrInvalidReplyTo          = &AppError{"reply_to_id must refer to a message of the same chat", 400}
+	ErrEmptyMessage            = &AppError{"message content cannot be empty", 400}
+	ErrIdempotencyKeyReused    = &AppError{"idempotency key already used for a different message", 409}
+	ErrInvalidStatusTransition = &AppError{"message status cannot move backwards or repeat", 409}
+	ErrInvalidCursor           = &AppError{"invalid pagination cursor", 400}
+	ErrInvalidDirection        = &AppError{"direction must be forward or backward", 400}
+	ErrInvalidSyncToken        = &AppError{"invalid sync token", 400}
 )
 
 // AppError represents an application error with HTTP status code
@@ -0,0 +1,127 @@
+package domain
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxChatTitleLength caps the characters of a group chat title
+const MaxChatTitleLength = 100
+
+// MaxGroupMembers caps the members of a group chat, owner included
+const MaxGroupMembers = 256
+
+// ChatRole is what a member may do in a group chat
+type ChatRole string
+
+const (
+	RoleOwner  ChatRole = "owner"  // created the group or inherited it; manages members, roles and the title
+	RoleAdmin  ChatRole = "admin"  // manages members and the title
+	RoleMember ChatRole = "member" // sends and reads messages
+)
+
+// CanManage reports whether the role may add and remove members and change the title
+func (r ChatRole) CanManage() bool {
+	return r == RoleOwner || r == RoleAdmin
+}
+
+// ChatMember is a user taking part in a group chat
+type ChatMember struct {
+	UserID   string    `json:"user_id"`
+	Role     ChatRole  `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// CleanChatTitle validates a group chat title and returns it without surrounding whitespace
+func CleanChatTitle(title string) (string, error) {
+	cleaned := strings.TrimSpace(title)
+
+	length := utf8.RuneCountInString(cleaned)
+	if length == 0 || length > MaxChatTitleLength {
+		return "", ErrInvalidTitle
+	}
+
+	return cleaned, nil
+}
+
+// Member returns the membership of the user in a group chat, or nil if they are not a member
+func (c *Chat) Member(userID string) *ChatMember {
+	for i := range c.Members {
+		if c.Members[i].UserID == userID {
+			return &c.Members[i]
+		}
+	}
+	return nil
+}
+
+// AddMember adds a user to a group chat
+func (c *Chat) AddMember(member ChatMember) error {
+	if !c.IsGroup() {
+		return ErrNotGroupChat
+	}
+	if c.Member(member.UserID) != nil {
+		return ErrAlreadyMember
+	}
+	if len(c.Members) >= MaxGroupMembers {
+		return ErrGroupFull
+	}
+
+	c.Members = append(c.Members, member)
+	return nil
+}
+
+// RemoveMember removes a user from a group chat. When the owner leaves, the longest-standing admin,
+// or failing that the longest-standing member, becomes the owner.
+func (c *Chat) RemoveMember(userID string) error {
+	if !c.IsGroup() {
+		return ErrNotGroupChat
+	}
+
+	member := c.Member(userID)
+	if member == nil {
+		return ErrNotMember
+	}
+	wasOwner := member.Role == RoleOwner
+
+	for i := range c.Members {
+		if c.Members[i].UserID == userID {
+			c.Members = append(c.Members[:i], c.Members[i+1:]...)
+			break
+		}
+	}
+
+	if wasOwner && len(c.Members) > 0 {
+		successor := &c.Members[0]
+		for i := range c.Members {
+			if c.Members[i].Role == RoleAdmin {
+				successor = &c.Members[i]
+				break
+			}
+		}
+		successor.Role = RoleOwner
+	}
+
+	return nil
+}
+
+// SetMemberRole makes a member of a group chat an admin or a plain member; the owner's role is fixed
+func (c *Chat) SetMemberRole(userID string, role ChatRole) error {
+	if !c.IsGroup() {
+		return ErrNotGroupChat
+	}
+	if role != RoleAdmin && role != RoleMember {
+		return ErrInvalidRole
+	}
+
+	member := c.Member(userID)
+	if member == nil {
+		return ErrNotMember
+	}
+	if member.Role == RoleOwner {
+		return ErrOwnerProtected
+	}
+
+	member.Role = role
+	return nil
+}
@@ -1,34 +1,319 @@
 package domain
 
 import (
+	"encoding/base64"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // User represents an application user
 type User struct {
-	ID        string    `json:"id"` //UUID
-	Username  string    `json:"username"`
-	CreatedAt time.Time `json:"created_at"`
+	ID           string    `json:"id"` //UUID
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"` // never exposed through the API
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AuthToken represents a signed bearer token issued on login
+type AuthToken struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      *User     `json:"user"`
 }
 
-// Chat represents a 1:1 conversation between two users
+// ChatType tells 1:1 chats from group chats
+type ChatType string
+
+const (
+	ChatDirect ChatType = "direct" // a 1:1 chat between Participant1 and Participant2
+	ChatGroup  ChatType = "group"  // a titled chat between Members
+)
+
+// Chat represents a 1:1 conversation between two users or a group conversation between its members
 type Chat struct {
-	ID           string    `json:"id"`           //UUID
-	Participant1 string    `json:"participant1"` // UUID User ID
-	Participant2 string    `json:"participant2"` // UUID User ID
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           string       `json:"id"` //UUID
+	Type         ChatType     `json:"type"`
+	Title        string       `json:"title,omitempty"`        // group chats only
+	Participant1 string       `json:"participant1,omitempty"` // UUID User ID, 1:1 chats only
+	Participant2 string       `json:"participant2,omitempty"` // UUID User ID, 1:1 chats only
+	Members      []ChatMember `json:"members,omitempty"`      // group chats only, in the order they joined
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+	LastSeq      int64        `json:"last_seq"` // sequence number of the latest message, 0 for an empty chat
+}
+
+// ChatSummary is a chat as listed in a user's inbox, from the point of view of that user
+type ChatSummary struct {
+	Chat
+	Peer        *User           `json:"peer,omitempty"`         // the other participant
+	LastMessage *MessagePreview `json:"last_message,omitempty"` // omitted for chats without messages
+	UnreadCount int             `json:"unread_count"`           // messages the user has not read yet
+}
+
+// MessagePreviewLength is the number of characters of content kept in a MessagePreview
+const MessagePreviewLength = 100
+
+// MessagePreview is a short view of a message shown in chat lists
+type MessagePreview struct {
+	ID        string        `json:"id"`
+	Seq       int64         `json:"seq"`
+	SenderID  string        `json:"sender_id"`
+	Preview   string        `json:"preview"` // content truncated to MessagePreviewLength characters
+	Status    MessageStatus `json:"status"`
+	Timestamp time.Time     `json:"timestamp"`
+
+	AttachmentCount int `json:"attachment_count,omitempty"`
+}
+
+// NewMessagePreview builds the preview of a message, truncating its content
+func NewMessagePreview(message *Message) *MessagePreview {
+	return &MessagePreview{
+		ID:        message.ID,
+		Seq:       message.Seq,
+		SenderID:  message.SenderID,
+		Preview:   TruncatePreview(message.Content),
+		Status:    message.Status,
+		Timestamp: message.Timestamp,
+
+		AttachmentCount: len(message.Attachments),
+	}
+}
+
+// TruncatePreview shortens content to MessagePreviewLength characters, marking the cut with an ellipsis
+func TruncatePreview(content string) string {
+	runes := []rune(content)
+	if len(runes) <= MessagePreviewLength {
+		return content
+	}
+	return string(runes[:MessagePreviewLength]) + "…"
+}
+
+// ReadMark is a participant's read watermark in a chat: every message up to and including
+// MessageID has been read by UserID
+type ReadMark struct {
+	ChatID    string    `json:"chat_id"`
+	UserID    string    `json:"user_id"`
+	MessageID string    `json:"message_id"`
+	ReadAt    time.Time `json:"read_at"`
+}
+
+// ChangeType identifies what a change log entry records
+type ChangeType string
+
+const (
+	ChangeChatCreated     ChangeType = "chat_created"     // the user takes part in a new chat
+	ChangeMessageCreated  ChangeType = "message_created"  // a message was added to one of the user's chats
+	ChangeMessageStatus   ChangeType = "message_status"   // a message of one of the user's chats changed status
+	ChangeChatRead        ChangeType = "chat_read"        // UserID read every message they received up to MessageID
+	ChangeMessageEdited   ChangeType = "message_edited"   // the sender changed the content of a message
+	ChangeMessageDeleted  ChangeType = "message_deleted"  // the sender deleted a message for everyone
+	ChangeMessageHidden   ChangeType = "message_hidden"   // the user deleted a message for themselves
+	ChangeReactionAdded   ChangeType = "reaction_added"   // UserID reacted to a message
+	ChangeReactionRemoved ChangeType = "reaction_removed" // UserID took back a reaction to a message
+	ChangeChatUpdated     ChangeType = "chat_updated"     // the title or a member's role of a group chat changed
+	ChangeMemberAdded     ChangeType = "member_added"     // UserID joined a group chat
+	ChangeMemberRemoved   ChangeType = "member_removed"   // UserID left or was removed from a group chat
+)
+
+// Change is an entry of a user's change log, which records everything that happened in the
+// user's chats in order so that reconnecting clients can catch up
+type Change struct {
+	Seq       int64      `json:"seq"` // position in the user's change log, starting at 1
+	Type      ChangeType `json:"type"`
+	ChatID    string     `json:"chat_id"`
+	MessageID string     `json:"message_id,omitempty"`
+	UserID    string     `json:"user_id,omitempty"` // who read, hid, reacted, joined or left, for the changes that name them
+	Timestamp time.Time  `json:"timestamp"`
+}
+
+// SyncResult is a batch of a user's changes together with the current state of every message and
+// chat they refer to
+type SyncResult struct {
+	Changes   []*Change  `json:"changes"`
+	Messages  []*Message `json:"messages"`
+	Chats     []*Chat    `json:"chats"`
+	NextToken string     `json:"next_token"` // pass as since to continue after this batch
+	HasMore   bool       `json:"has_more"`   // more changes are waiting beyond this batch
+}
+
+// EncodeSyncToken returns the opaque sync token of a position in the user's change log
+func EncodeSyncToken(userID string, seq int64) string {
+	raw := userID + ":" + strconv.FormatInt(seq, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeSyncToken returns the change log position of a token issued to the user; an empty token
+// starts from the beginning of the log
+func DecodeSyncToken(userID, token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, ErrInvalidSyncToken
+	}
+
+	owner, position, found := strings.Cut(string(raw), ":")
+	if !found || owner != userID {
+		return 0, ErrInvalidSyncToken
+	}
+
+	seq, err := strconv.ParseInt(position, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, ErrInvalidSyncToken
+	}
+
+	return seq, nil
+}
+
+// ParticipantPairKey returns the canonical key of a 1:1 chat, independent of participant order
+func ParticipantPairKey(user1ID, user2ID string) string {
+	if user2ID < user1ID {
+		user1ID, user2ID = user2ID, user1ID
+	}
+	return user1ID + ":" + user2ID
+}
+
+// PairKey returns the canonical participant pair key of the chat
+func (c *Chat) PairKey() string {
+	return ParticipantPairKey(c.Participant1, c.Participant2)
+}
+
+// IsGroup reports whether the chat is a group chat
+func (c *Chat) IsGroup() bool {
+	return c.Type == ChatGroup
+}
+
+// HasParticipant reports whether the user takes part in the chat
+func (c *Chat) HasParticipant(userID string) bool {
+	if c.IsGroup() {
+		return c.Member(userID) != nil
+	}
+	return userID != "" && (c.Participant1 == userID || c.Participant2 == userID)
+}
+
+// ParticipantIDs returns the users taking part in the chat: both participants of a 1:1 chat or the
+// members of a group chat
+func (c *Chat) ParticipantIDs() []string {
+	if !c.IsGroup() {
+		return []string{c.Participant1, c.Participant2}
+	}
+
+	userIDs := make([]string, len(c.Members))
+	for i, member := range c.Members {
+		userIDs[i] = member.UserID
+	}
+	return userIDs
+}
+
+// OtherParticipant returns the participant of a 1:1 chat that is not the given user
+func (c *Chat) OtherParticipant(userID string) string {
+	if c.Participant1 == userID {
+		return c.Participant2
+	}
+	return c.Participant1
 }
 
 // Message represents a single message in a chat
 type Message struct {
-	ID             string        `json:"id"` //UUID
-	ChatID         string        `json:"chat_id"`
-	SenderID       string        `json:"sender_id"`
-	Content        string        `json:"content"`
-	Status         MessageStatus `json:"status"`
-	Timestamp      time.Time     `json:"timestamp"`
-	IdempotencyKey string        `json:"idempotency_key,omitempty"` //
+	ID             string            `json:"id"` //UUID
+	ChatID         string            `json:"chat_id"`
+	Seq            int64             `json:"seq"` // position in the chat, starting at 1 without gaps
+	SenderID       string            `json:"sender_id"`
+	Content        string            `json:"content"`
+	Status         MessageStatus     `json:"status"`
+	Timestamp      time.Time         `json:"timestamp"`
+	DeliveredAt    *time.Time        `json:"delivered_at,omitempty"`
+	ReadAt         *time.Time        `json:"read_at,omitempty"`
+	EditedAt       *time.Time        `json:"edited_at,omitempty"`       // last time the sender changed Content
+	DeletedAt      *time.Time        `json:"deleted_at,omitempty"`      // set on tombstones, whose Content is wiped
+	IdempotencyKey string            `json:"idempotency_key,omitempty"` //
+	ReplyToID      string            `json:"reply_to_id,omitempty"`     // earlier message of the chat this one replies to
+	Quoted         *QuotedMessage    `json:"quoted,omitempty"`          // snippet of the ReplyToID message
+	Reactions      []ReactionSummary `json:"reactions,omitempty"`       // participants' reactions, per emoji
+	Attachments    []Attachment      `json:"attachments,omitempty"`     // files sent with the message, in order
+}
+
+// Reaction is an emoji a participant put on a message; a participant may react with several emoji
+type Reaction struct {
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id"`
+	Emoji     string    `json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionSummary counts the reactions with one emoji on a message
+type ReactionSummary struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	UserIDs []string `json:"user_ids"` // who reacted, in the order they did
+}
+
+// QuotedMessage is the snippet of the message a reply refers to. It is stored with the reply and
+// kept current when the quoted message is edited or deleted, so replies render without a lookup.
+type QuotedMessage struct {
+	SenderID string `json:"sender_id"`
+	Snippet  string `json:"snippet"`           // content truncated to MessagePreviewLength characters, empty once deleted
+	Deleted  bool   `json:"deleted,omitempty"` // the quoted message was deleted for everyone
+}
+
+// NewQuotedMessage builds the quote of a message as shown in its replies
+func NewQuotedMessage(message *Message) *QuotedMessage {
+	return &QuotedMessage{
+		SenderID: message.SenderID,
+		Snippet:  TruncatePreview(message.Content),
+		Deleted:  message.DeletedAt != nil,
+	}
+}
+
+// MessageRevision is an earlier content of an edited message
+type MessageRevision struct {
+	MessageID string    `json:"message_id"`
+	Revision  int       `json:"revision"` // 1 is the content the message was sent with
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"` // when this content was written
+}
+
+// TransitionTo moves the message to a later status and records when each status was reached.
+// Statuses only move forward (sent -> delivered -> read); reading an undelivered message
+// delivers it at the same time.
+func (m *Message) TransitionTo(status MessageStatus, at time.Time) error {
+	if !m.Status.CanTransitionTo(status) {
+		return ErrInvalidStatusTransition
+	}
+
+	if m.DeliveredAt == nil {
+		m.DeliveredAt = &at
+	}
+	if status == StatusRead {
+		m.ReadAt = &at
+	}
+
+	m.Status = status
+	return nil
+}
+
+// StatusChangedAt returns when the message reached its current status
+func (m *Message) StatusChangedAt() time.Time {
+	switch {
+	case m.Status == StatusRead && m.ReadAt != nil:
+		return *m.ReadAt
+	case m.Status == StatusDelivered && m.DeliveredAt != nil:
+		return *m.DeliveredAt
+	default:
+		return m.Timestamp
+	}
+}
+
+// Tombstone marks the message deleted for everyone and wipes its content, reactions and attachments
+func (m *Message) Tombstone(at time.Time) {
+	m.Content = ""
+	m.Reactions = nil
+	m.Attachments = nil
+	m.DeletedAt = &at
 }
 
 // MessageStatus represents the delivery status of a message
@@ -40,17 +325,121 @@ const (
 	StatusRead      MessageStatus = "read"
 )
 
+// statusRank orders the statuses of the delivery state machine
+var statusRank = map[MessageStatus]int{
+	StatusSent:      1,
+	StatusDelivered: 2,
+	StatusRead:      3,
+}
+
+// IsValid reports whether the status is a known message status
+func (s MessageStatus) IsValid() bool {
+	_, ok := statusRank[s]
+	return ok
+}
+
+// CanTransitionTo reports whether a message may move from this status to next; statuses
+// never move backwards or repeat
+func (s MessageStatus) CanTransitionTo(next MessageStatus) bool {
+	return next.IsValid() && statusRank[next] > statusRank[s]
+}
+
 // PaginationParams represents pagination parameters
 type PaginationParams struct {
 	Page     int `json:"page"`
 	PageSize int `json:"page_size"`
 }
 
-// PaginatedResponse represents a paginated response
+// PaginatedResponse represents a paginated response; cursor pages set NextCursor/PrevCursor and
+// leave Page at 0
 type PaginatedResponse struct {
 	Data       interface{} `json:"data"`
 	Page       int         `json:"page"`
 	PageSize   int         `json:"page_size"`
 	TotalCount int         `json:"total_count"`
 	TotalPages int         `json:"total_pages"`
+	NextCursor string      `json:"next_cursor,omitempty"` // continues in the requested direction
+	PrevCursor string      `json:"prev_cursor,omitempty"` // goes back the opposite way
+}
+
+// DeletionScope tells who a message is deleted for
+type DeletionScope string
+
+const (
+	DeleteForMe       DeletionScope = "me"       // hidden from the requesting participant only
+	DeleteForEveryone DeletionScope = "everyone" // replaced with a tombstone for both participants
+)
+
+// IsValid reports whether the scope is one of the known deletion scopes
+func (s DeletionScope) IsValid() bool {
+	return s == DeleteForMe || s == DeleteForEveryone
+}
+
+// CursorDirection is the order in which a cursor page walks through a chat
+type CursorDirection string
+
+const (
+	DirectionForward  CursorDirection = "forward"  // oldest first
+	DirectionBackward CursorDirection = "backward" // newest first
+)
+
+// MessageCursor identifies a position in a chat's message history
+type MessageCursor struct {
+	ChatID string
+	Seq    int64
+}
+
+// CursorFor returns the cursor positioned at the message
+func CursorFor(message *Message) *MessageCursor {
+	return &MessageCursor{
+		ChatID: message.ChatID,
+		Seq:    message.Seq,
+	}
+}
+
+// Encode returns the opaque string form of the cursor handed to clients
+func (c *MessageCursor) Encode() string {
+	raw := c.ChatID + ":" + strconv.FormatInt(c.Seq, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeMessageCursor parses a cursor produced by Encode
+func DecodeMessageCursor(encoded string) (*MessageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	chatID, seq, found := strings.Cut(string(raw), ":")
+	if !found || chatID == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	position, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil || position < 1 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &MessageCursor{
+		ChatID: chatID,
+		Seq:    position,
+	}, nil
+}
+
+// CursorParams selects a page of messages relative to cursors. Before and After are exclusive
+// bounds and may be combined; without them a forward page starts at the oldest message and a
+// backward page at the newest.
+type CursorParams struct {
+	Before    *MessageCursor
+	After     *MessageCursor
+	Direction CursorDirection
+	Limit     int
+}
+
+// MessagePage is a page of messages selected by CursorParams, in the requested direction
+type MessagePage struct {
+	Messages    []*Message
+	HasNext     bool // more messages follow the last one in the requested direction
+	HasPrevious bool // messages the viewer sees precede the first one in the requested direction
+	TotalCount  int  // messages in the whole chat
 }
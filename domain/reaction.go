@@ -0,0 +1,63 @@
+package domain
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxReactionLength caps the characters of a reaction; emoji sequences joined with zero-width
+// joiners, such as families, take several characters
+const MaxReactionLength = 16
+
+// Characters that only occur inside emoji sequences
+const (
+	zeroWidthJoiner = '‍'
+	keycap          = '⃣'
+)
+
+// ValidateReaction checks that a reaction is a single emoji: symbols, optionally combined with skin
+// tones, variation selectors, zero-width joiners and tags, or a keycap such as "1️⃣"
+func ValidateReaction(emoji string) error {
+	length := utf8.RuneCountInString(emoji)
+	if length == 0 || length > MaxReactionLength {
+		return ErrInvalidReaction
+	}
+
+	symbol := false
+	for _, r := range emoji {
+		switch {
+		case unicode.Is(unicode.So, r), r == keycap:
+			symbol = true
+		case r >= 0x1F3FB && r <= 0x1F3FF: // skin tone modifiers
+		case r == 0xFE0E || r == 0xFE0F: // text and emoji variation selectors
+		case r >= 0xE0020 && r <= 0xE007F: // tags of subdivision flags
+		case r == zeroWidthJoiner, r == '#', r == '*', r >= '0' && r <= '9':
+		default:
+			return ErrInvalidReaction
+		}
+	}
+	if !symbol {
+		return ErrInvalidReaction
+	}
+
+	return nil
+}
+
+// AggregateReactions groups reactions by emoji, in the order each emoji was first used; the
+// reactions must be ordered oldest first. It returns nil when there are no reactions.
+func AggregateReactions(reactions []*Reaction) []ReactionSummary {
+	var summaries []ReactionSummary
+	positions := make(map[string]int) // emoji -> index in summaries
+	for _, reaction := range reactions {
+		i, exists := positions[reaction.Emoji]
+		if !exists {
+			i = len(summaries)
+			positions[reaction.Emoji] = i
+			summaries = append(summaries, ReactionSummary{Emoji: reaction.Emoji, UserIDs: []string{}})
+		}
+		summaries[i].Count++
+		summaries[i].UserIDs = append(summaries[i].UserIDs, reaction.UserID)
+	}
+
+	return summaries
+}
@@ -0,0 +1,60 @@
+package domain
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Username length limits, counted in characters of the NFKC form
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 32
+)
+
+// reservedUsernames cannot be registered; they are compared by their normalized form
+var reservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"me":            true,
+	"root":          true,
+	"support":       true,
+	"system":        true,
+}
+
+// NormalizeUsername returns the canonical form usernames are compared by: compatibility
+// characters are folded (NFKC) and case is folded, so "Alice", "ALICE" and "Ａｌｉｃｅ" are one name
+func NormalizeUsername(username string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(username)))
+}
+
+// CleanUsername validates a username and returns the NFKC form it is stored with. Usernames
+// are MinUsernameLength to MaxUsernameLength letters, digits, '.', '_' or '-' and start with a
+// letter or digit; reserved names are rejected.
+func CleanUsername(username string) (string, error) {
+	cleaned := norm.NFKC.String(username)
+
+	length := utf8.RuneCountInString(cleaned)
+	if length < MinUsernameLength || length > MaxUsernameLength {
+		return "", ErrInvalidUsername
+	}
+
+	for i, r := range cleaned {
+		alphanumeric := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if i == 0 && !alphanumeric {
+			return "", ErrInvalidUsername
+		}
+		if !alphanumeric && r != '.' && r != '_' && r != '-' {
+			return "", ErrInvalidUsername
+		}
+	}
+
+	if reservedUsernames[NormalizeUsername(cleaned)] {
+		return "", ErrReservedUsername
+	}
+
+	return cleaned, nil
+}
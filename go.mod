@@ -7,3 +7,7 @@ require github.com/google/uuid v1.6.0
 require github.com/gorilla/websocket v1.5.3
 
 require github.com/gorilla/mux v1.8.1
+
+require github.com/mattn/go-sqlite3 v1.14.33
+
+require golang.org/x/text v0.33.0
@@ -10,7 +10,10 @@ import (
 
 func main() {
 	// Initialize application
-	application := app.NewApp()
+	application, err := app.NewApp(app.LoadConfig())
+	if err != nil {
+		log.Fatal("Failed to initialize application:", err)
+	}
 
 	// Start HTTP server
 	port := os.Getenv("PORT")
@@ -20,6 +23,9 @@ func main() {
 
 	log.Printf("Server starting on port %s", port)
 	if err := http.ListenAndServe(":"+port, application.Handler()); err != nil {
-		log.Fatal("Server failed to start:", err)
+		// log.Fatal would skip closing the application
+		log.Printf("Server failed: %v", err)
+		application.Close()
+		os.Exit(1)
 	}
 }
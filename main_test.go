@@ -4,19 +4,32 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"messaging-app/app"
 	"messaging-app/domain"
+	"messaging-app/repositories"
+
+	"github.com/gorilla/websocket"
 )
 
 // TestE2E_MessagingFlow tests the complete messaging flow from user creation to real-time messaging
 func TestE2E_MessagingFlow(t *testing.T) {
 	// Setup
-	application := app.NewApp()
+	application := newTestApp(t, app.DefaultConfig())
 	server := httptest.NewServer(application.Handler())
 	defer server.Close()
 
@@ -36,35 +49,47 @@ func TestE2E_MessagingFlow(t *testing.T) {
 	t.Log("Step 2: Sending messages...")
 
 	// Alice sends message to Bob
-	msg1 := sendMessage(t, client, server.URL, alice.ID, bob.ID, "Hello Bob!", "msg1")
+	msg1 := sendMessage(t, client, server.URL, alice, bob.ID, "Hello Bob!", "msg1")
 	t.Logf("Alice -> Bob: %s (id: %s)", msg1.Content, msg1.ID)
 
 	// Bob replies to Alice
-	msg2 := sendMessage(t, client, server.URL, bob.ID, alice.ID, "Hi Alice! How are you?", "msg2")
+	msg2 := sendMessage(t, client, server.URL, bob, alice.ID, "Hi Alice! How are you?", "msg2")
 	t.Logf("Bob -> Alice: %s (id: %s)", msg2.Content, msg2.ID)
 
 	// Alice sends another message to Bob
-	msg3 := sendMessage(t, client, server.URL, alice.ID, bob.ID, "I'm good! Working on a Go project.", "msg3")
+	msg3 := sendMessage(t, client, server.URL, alice, bob.ID, "I'm good! Working on a Go project.", "msg3")
 	t.Logf("Alice -> Bob: %s (id: %s)", msg3.Content, msg3.ID)
 
 	// Charlie sends message to Alice
-	msg4 := sendMessage(t, client, server.URL, charlie.ID, alice.ID, "Hey Alice, let's catch up!", "msg4")
+	msg4 := sendMessage(t, client, server.URL, charlie, alice.ID, "Hey Alice, let's catch up!", "msg4")
 	t.Logf("Charlie -> Alice: %s (id: %s)", msg4.Content, msg4.ID)
 
 	// Step 3: Test Idempotency
 	t.Log("Step 3: Testing idempotency...")
-	duplicateMsg := sendMessage(t, client, server.URL, alice.ID, bob.ID, "This should be ignored", "msg1")
+	duplicateMsg := sendMessage(t, client, server.URL, alice, bob.ID, "Hello Bob!", "msg1")
 	if duplicateMsg.ID != msg1.ID {
 		t.Errorf("Idempotency failed: expected message ID %s, got %s", msg1.ID, duplicateMsg.ID)
 	} else {
 		t.Log("[OK] Idempotency test passed - duplicate message was not created")
 	}
 
+	// Reusing a key with a different payload is a conflict, not a silent replay
+	testIdempotencyKeyConflict(t, client, server.URL, alice, bob.ID, "This should be rejected", "msg1")
+	testIdempotencyKeyConflict(t, client, server.URL, alice, charlie.ID, "Hello Bob!", "msg1")
+
+	// Keys are scoped per sender, so Bob may use "msg1" as well
+	bobMsg := sendMessage(t, client, server.URL, bob, alice.ID, "Bob's own msg1", "msg1")
+	if bobMsg.ID == msg1.ID {
+		t.Error("Idempotency keys should be scoped per sender")
+	} else {
+		t.Log("[OK] Idempotency keys are scoped per sender")
+	}
+
 	// Step 4: List User Chats
 	t.Log("Step 4: Testing chat listings...")
 
 	// Alice should have 2 chats (with Bob and Charlie)
-	aliceChats := listUserChats(t, client, server.URL, alice.ID, 1, 10)
+	aliceChats := listUserChats(t, client, server.URL, alice, 1, 10)
 	if len(aliceChats.Data.([]interface{})) != 2 {
 		t.Errorf("Alice should have 2 chats, got %d", len(aliceChats.Data.([]interface{})))
 	} else {
@@ -72,7 +97,7 @@ func TestE2E_MessagingFlow(t *testing.T) {
 	}
 
 	// Bob should have 1 chat (with Alice)
-	bobChats := listUserChats(t, client, server.URL, bob.ID, 1, 10)
+	bobChats := listUserChats(t, client, server.URL, bob, 1, 10)
 	if len(bobChats.Data.([]interface{})) != 1 {
 		t.Errorf("Bob should have 1 chat, got %d", len(bobChats.Data.([]interface{})))
 	} else {
@@ -86,18 +111,18 @@ func TestE2E_MessagingFlow(t *testing.T) {
 	aliceBobChatID := getChatID(t, aliceChats, bob.ID)
 
 	// List messages in Alice-Bob chat
-	chatMessages := listChatMessages(t, client, server.URL, aliceBobChatID, 1, 10)
-	if chatMessages.TotalCount != 3 {
-		t.Errorf("Alice-Bob chat should have 3 messages, got %d", chatMessages.TotalCount)
+	chatMessages := listChatMessages(t, client, server.URL, alice, aliceBobChatID, 1, 10)
+	if chatMessages.TotalCount != 4 {
+		t.Errorf("Alice-Bob chat should have 4 messages, got %d", chatMessages.TotalCount)
 	} else {
-		t.Log("[OK] Alice-Bob chat has 3 messages")
+		t.Log("[OK] Alice-Bob chat has 4 messages")
 	}
 
 	// Step 6: Test Pagination
 	t.Log("Step 6: Testing pagination...")
 
 	// Test messages pagination
-	pagedMessages := listChatMessages(t, client, server.URL, aliceBobChatID, 1, 2)
+	pagedMessages := listChatMessages(t, client, server.URL, alice, aliceBobChatID, 1, 2)
 	if len(pagedMessages.Data.([]interface{})) != 2 {
 		t.Errorf("Page 1 with size 2 should return 2 messages, got %d", len(pagedMessages.Data.([]interface{})))
 	} else {
@@ -108,16 +133,16 @@ func TestE2E_MessagingFlow(t *testing.T) {
 	t.Log("Step 7: Testing edge cases...")
 
 	// Test empty message
-	testEmptyMessage(t, client, server.URL, alice.ID, bob.ID)
+	testEmptyMessage(t, client, server.URL, alice, bob.ID)
 
 	// Test self-message
-	testSelfMessage(t, client, server.URL, alice.ID)
+	testSelfMessage(t, client, server.URL, alice)
 
-	// Test non-existent user (current behavior allows this)
-	testNonExistentUserCreatesChat(t, client, server.URL, alice.ID)
+	// Test non-existent user
+	testNonExistentUser(t, client, server.URL, alice)
 
 	// Test invalid user IDs
-	testInvalidUsers(t, client, server.URL)
+	testInvalidUsers(t, client, server.URL, alice)
 
 	t.Log("=== E2E Messaging Flow Test Completed ===")
 }
@@ -125,7 +150,7 @@ func TestE2E_MessagingFlow(t *testing.T) {
 // TestE2E_MessageStatusFlow tests the message status flow (sent -> delivered -> read)
 func TestE2E_MessageStatusFlow(t *testing.T) {
 	// Setup
-	application := app.NewApp()
+	application := newTestApp(t, app.DefaultConfig())
 	server := httptest.NewServer(application.Handler())
 	defer server.Close()
 
@@ -138,7 +163,7 @@ func TestE2E_MessageStatusFlow(t *testing.T) {
 	bob := createUser(t, client, server.URL, "bob_status")
 
 	// Send a message
-	message := sendMessage(t, client, server.URL, alice.ID, bob.ID, "Status test message", "status_test")
+	message := sendMessage(t, client, server.URL, alice, bob.ID, "Status test message", "status_test")
 
 	// Initially should be "sent"
 	if message.Status != domain.StatusSent {
@@ -152,9 +177,9 @@ func TestE2E_MessageStatusFlow(t *testing.T) {
 	// the message was created correctly.
 
 	// Verify message exists in chat
-	chats := listUserChats(t, client, server.URL, alice.ID, 1, 10)
+	chats := listUserChats(t, client, server.URL, alice, 1, 10)
 	chatID := getChatID(t, chats, bob.ID)
-	messages := listChatMessages(t, client, server.URL, chatID, 1, 10)
+	messages := listChatMessages(t, client, server.URL, alice, chatID, 1, 10)
 
 	if messages.TotalCount != 1 {
 		t.Errorf("Should have 1 message in chat, got %d", messages.TotalCount)
@@ -168,7 +193,7 @@ func TestE2E_MessageStatusFlow(t *testing.T) {
 // TestE2E_ConcurrentMessaging tests concurrent message sending
 func TestE2E_ConcurrentMessaging(t *testing.T) {
 	// Setup
-	application := app.NewApp()
+	application := newTestApp(t, app.DefaultConfig())
 	server := httptest.NewServer(application.Handler())
 	defer server.Close()
 
@@ -187,7 +212,7 @@ func TestE2E_ConcurrentMessaging(t *testing.T) {
 	for i := 0; i < numMessages; i++ {
 		go func(index int) {
 			content := fmt.Sprintf("Concurrent message %d", index)
-			msg, err := sendMessageWithError(client, server.URL, alice.ID, bob.ID, content, fmt.Sprintf("concurrent_%d", index))
+			msg, err := sendMessageWithError(client, server.URL, alice, bob.ID, content, fmt.Sprintf("concurrent_%d", index))
 			if err != nil {
 				errors <- err
 			} else {
@@ -216,9 +241,9 @@ func TestE2E_ConcurrentMessaging(t *testing.T) {
 	}
 
 	// Verify all messages were received
-	chats := listUserChats(t, client, server.URL, alice.ID, 1, 10)
+	chats := listUserChats(t, client, server.URL, alice, 1, 10)
 	chatID := getChatID(t, chats, bob.ID)
-	messages := listChatMessages(t, client, server.URL, chatID, 1, 20)
+	messages := listChatMessages(t, client, server.URL, alice, chatID, 1, 20)
 
 	if messages.TotalCount != numMessages {
 		t.Errorf("Expected %d messages in chat, got %d", numMessages, messages.TotalCount)
@@ -229,268 +254,3636 @@ func TestE2E_ConcurrentMessaging(t *testing.T) {
 	t.Log("=== E2E Concurrent Messaging Test Completed ===")
 }
 
-// TestE2E_ErrorScenarios tests various error scenarios
-func TestE2E_ErrorScenarios(t *testing.T) {
+// TestE2E_ConcurrentChatCreation tests that two users messaging each other for the first time
+// at the same moment end up sharing a single chat
+func TestE2E_ConcurrentChatCreation(t *testing.T) {
 	// Setup
-	application := app.NewApp()
+	application := newTestApp(t, app.DefaultConfig())
 	server := httptest.NewServer(application.Handler())
 	defer server.Close()
 
+	t.Log("=== Starting E2E Concurrent Chat Creation Test ===")
+
 	client := &http.Client{Timeout: 10 * time.Second}
+	alice := createUser(t, client, server.URL, "alice_first_contact")
+	bob := createUser(t, client, server.URL, "bob_first_contact")
 
-	t.Log("=== Starting E2E Error Scenarios Test ===")
+	// Both users fire their first messages simultaneously
+	const numMessages = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, numMessages)
 
-	// Create a user for testing
-	alice := createUser(t, client, server.URL, "alice_errors")
+	for i := 0; i < numMessages; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			sender, recipientID := alice, bob.ID
+			if index%2 == 1 {
+				sender, recipientID = bob, alice.ID
+			}
+			content := fmt.Sprintf("First contact %d", index)
+			if _, err := sendMessageWithError(client, server.URL, sender, recipientID, content, fmt.Sprintf("first_%d", index)); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
 
-	// Test scenarios
-	testEmptyMessage(t, client, server.URL, alice.ID, "some_user")
-	testSelfMessage(t, client, server.URL, alice.ID)
+	for err := range errs {
+		t.Errorf("Concurrent first message failed: %v", err)
+	}
 
-	// Note: Current implementation allows messaging non-existent users
-	// This creates "ghost" chats with non-existent users
-	testNonExistentUserCreatesChat(t, client, server.URL, alice.ID)
+	aliceChats := listUserChats(t, client, server.URL, alice, 1, 10)
+	bobChats := listUserChats(t, client, server.URL, bob, 1, 10)
+	if aliceChats.TotalCount != 1 || bobChats.TotalCount != 1 {
+		t.Errorf("Expected exactly 1 chat per user, got alice=%d bob=%d", aliceChats.TotalCount, bobChats.TotalCount)
+	} else {
+		t.Log("[OK] Concurrent first messages share a single chat")
+	}
 
-	testInvalidUsers(t, client, server.URL)
-	testDuplicateUsername(t, client, server.URL, "alice_errors")
-	testInvalidJSON(t, client, server.URL)
+	chatID := getChatID(t, aliceChats, bob.ID)
+	messages := listChatMessages(t, client, server.URL, alice, chatID, 1, 50)
+	if messages.TotalCount != numMessages {
+		t.Errorf("Expected %d messages in chat, got %d", numMessages, messages.TotalCount)
+	}
 
-	t.Log("=== E2E Error Scenarios Test Completed ===")
+	t.Log("=== E2E Concurrent Chat Creation Test Completed ===")
 }
 
-// Helper functions
-
-func createUser(t *testing.T, client *http.Client, baseURL, username string) *domain.User {
-	t.Helper()
-
-	userData := map[string]string{"username": username}
-	body, _ := json.Marshal(userData)
+// TestE2E_ConcurrentIdempotentRetries tests that concurrent retries with the same idempotency key
+// store a single message
+func TestE2E_ConcurrentIdempotentRetries(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.BlobPath = t.TempDir()
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_retry")
+			bob := createUser(t, client, server.URL, "bob_retry")
+
+			const numRetries = 10
+			var wg sync.WaitGroup
+			ids := make(chan string, numRetries)
+
+			for i := 0; i < numRetries; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					msg, err := sendMessageWithError(client, server.URL, alice, bob.ID, "Retry me", "retry_key")
+					if err != nil {
+						t.Errorf("Retry failed: %v", err)
+						return
+					}
+					ids <- msg.ID
+				}()
+			}
+			wg.Wait()
+			close(ids)
+
+			var firstID string
+			for id := range ids {
+				if firstID == "" {
+					firstID = id
+				} else if id != firstID {
+					t.Errorf("Retries returned different message IDs: %s and %s", firstID, id)
+				}
+			}
 
-	resp, err := client.Post(baseURL+"/api/v1/users", "application/json", bytes.NewReader(body))
-	if err != nil {
-		t.Fatalf("Failed to create user %s: %v", username, err)
-	}
-	defer resp.Body.Close()
+			chats := listUserChats(t, client, server.URL, alice, 1, 10)
+			chatID := getChatID(t, chats, bob.ID)
+			messages := listChatMessages(t, client, server.URL, alice, chatID, 1, 50)
+			if messages.TotalCount != 1 {
+				t.Errorf("Expected a single stored message, got %d", messages.TotalCount)
+			} else {
+				t.Log("[OK] Concurrent retries stored a single message")
+			}
 
-	if resp.StatusCode != http.StatusCreated {
-		t.Fatalf("Expected status 201 for user creation, got %d", resp.StatusCode)
+			// Retries find the attachments claimed by whichever attempt stored the message
+			attachment := uploadAttachment(t, client, server.URL, alice, "retry.txt", []byte("Retry me too"), http.StatusCreated)
+			statuses := make(chan int, numRetries)
+			ids = make(chan string, numRetries)
+			for i := 0; i < numRetries; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := doRequest(client, "POST", server.URL+"/api/v1/messages", alice.Token, map[string]interface{}{
+						"recipient_id":    bob.ID,
+						"idempotency_key": "retry_files_key",
+						"attachment_ids":  []string{attachment.ID},
+					})
+					if err != nil {
+						t.Errorf("Retry failed: %v", err)
+						return
+					}
+					defer resp.Body.Close()
+
+					var msg domain.Message
+					json.NewDecoder(resp.Body).Decode(&msg)
+					statuses <- resp.StatusCode
+					ids <- msg.ID
+				}()
+			}
+			wg.Wait()
+			close(statuses)
+			close(ids)
+
+			created := 0
+			for status := range statuses {
+				switch status {
+				case http.StatusCreated:
+					created++
+				case http.StatusOK:
+				default:
+					t.Errorf("Expected every retry with attachments to succeed, got status %d", status)
+				}
+			}
+			if created != 1 {
+				t.Errorf("Expected exactly one retry to create the message, got %d", created)
+			}
+			firstID = ""
+			for id := range ids {
+				if firstID == "" {
+					firstID = id
+				} else if id != firstID {
+					t.Errorf("Retries with attachments returned different message IDs: %s and %s", firstID, id)
+				}
+			}
+			t.Log("[OK] Concurrent retries with attachments return the same message")
+		})
 	}
+}
 
-	var user domain.User
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		t.Fatalf("Failed to decode user response: %v", err)
-	}
+// TestE2E_RetriesAreNotRebroadcast tests that a REST retry with a used idempotency key answers 200
+// with the stored message without pushing it to the participants again
+func TestE2E_RetriesAreNotRebroadcast(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_replay")
+			bob := createUser(t, client, server.URL, "bob_replay")
+
+			aliceConn := connectWebSocket(t, server.URL, alice)
+			defer aliceConn.Close()
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			waitForDevices(t, client, server.URL, alice, alice.ID, 1)
+			waitForDevices(t, client, server.URL, bob, bob.ID, 1)
+
+			send := func(expectedStatus int) *domain.Message {
+				t.Helper()
+				resp, err := doRequest(client, "POST", server.URL+"/api/v1/messages", alice.Token, map[string]string{
+					"recipient_id":    bob.ID,
+					"content":         "Helo",
+					"idempotency_key": "replay_key",
+				})
+				if err != nil {
+					t.Fatalf("Failed to send message: %v", err)
+				}
+				defer resp.Body.Close()
+
+				if resp.StatusCode != expectedStatus {
+					t.Fatalf("Expected status %d for sending, got %d", expectedStatus, resp.StatusCode)
+				}
+				var message domain.Message
+				if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+					t.Fatalf("Failed to decode message: %v", err)
+				}
+				return &message
+			}
 
-	return &user
-}
+			original := send(http.StatusCreated)
+			if frame := readWebSocketJSON(t, bobConn); frame["type"] != "message" || payloadOf(frame)["id"] != original.ID {
+				t.Errorf("Expected Bob to get the message, got %v", frame)
+			}
+			if frame := readWebSocketJSON(t, aliceConn); frame["type"] != "message" || payloadOf(frame)["id"] != original.ID {
+				t.Errorf("Expected Alice's device to get the message, got %v", frame)
+			}
+			expectReceipt(t, aliceConn, original.ID, domain.StatusDelivered)
+			t.Log("[OK] The first attempt is created and pushed once")
 
-func sendMessage(t *testing.T, client *http.Client, baseURL, senderID, recipientID, content, idempotencyKey string) *domain.Message {
-	t.Helper()
+			// An edit since the first attempt must not reach Bob again as a new message
+			editMessage(t, client, server.URL, alice, original.ID, "Hello", http.StatusOK)
+			readWebSocketJSON(t, bobConn)
+			readWebSocketJSON(t, aliceConn)
 
-	msg, err := sendMessageWithError(client, baseURL, senderID, recipientID, content, idempotencyKey)
-	if err != nil {
-		t.Fatalf("Failed to send message: %v", err)
+			retry := send(http.StatusOK)
+			if retry.ID != original.ID || retry.Content != "Hello" {
+				t.Errorf("Expected the retry to return the stored message, got %+v", retry)
+			}
+			expectNoFrame(t, bobConn)
+			expectNoFrame(t, aliceConn)
+			t.Log("[OK] A retry answers 200 with the stored message and pushes nothing")
+		})
 	}
-	return msg
 }
 
-func sendMessageWithError(client *http.Client, baseURL, senderID, recipientID, content, idempotencyKey string) (*domain.Message, error) {
-	messageData := map[string]string{
-		"sender_id":       senderID,
-		"recipient_id":    recipientID,
-		"content":         content,
-		"idempotency_key": idempotencyKey,
-	}
-	body, _ := json.Marshal(messageData)
+// TestE2E_ChatAuthorization tests that only participants can read a chat and only the
+// recipient can change a message's status
+func TestE2E_ChatAuthorization(t *testing.T) {
+	// Setup
+	application := newTestApp(t, app.DefaultConfig())
+	server := httptest.NewServer(application.Handler())
+	defer server.Close()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	t.Log("=== Starting E2E Chat Authorization Test ===")
+
+	alice := createUser(t, client, server.URL, "alice_authz")
+	bob := createUser(t, client, server.URL, "bob_authz")
+	charlie := createUser(t, client, server.URL, "charlie_authz")
+
+	message := sendMessage(t, client, server.URL, alice, bob.ID, "Private message", "authz_1")
+	chatID := message.ChatID
 
-	resp, err := client.Post(baseURL+"/api/v1/messages", "application/json", bytes.NewReader(body))
+	// A third party cannot read the chat history
+	resp, err := doRequest(client, "GET", server.URL+"/api/v1/chats/"+chatID+"/messages", charlie.Token, nil)
 	if err != nil {
-		return nil, err
+		t.Fatalf("Failed to list chat messages: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for non-participant, got %d", resp.StatusCode)
+	} else {
+		t.Log("[OK] Non-participant cannot read chat messages")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("expected status 201, got %d", resp.StatusCode)
+	// Neither the sender nor a third party may mark the message as read
+	aliceConn := connectWebSocket(t, server.URL, alice)
+	defer aliceConn.Close()
+	charlieConn := connectWebSocket(t, server.URL, charlie)
+	defer charlieConn.Close()
+
+	markRead := map[string]string{"message_id": message.ID}
+	writeEnvelope(t, aliceConn, "mark_read", "read-1", markRead)
+	writeEnvelope(t, charlieConn, "mark_read", "read-1", markRead)
+
+	for _, conn := range []*websocket.Conn{aliceConn, charlieConn} {
+		if errFrame := readWebSocketJSON(t, conn); errFrame["type"] != "error" || payloadOf(errFrame)["code"] != "forbidden" {
+			t.Errorf("Expected forbidden error frame, got %v", errFrame)
+		}
 	}
 
-	var message domain.Message
-	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
-		return nil, err
+	time.Sleep(200 * time.Millisecond)
+	if status := messageStatus(t, client, server.URL, bob, chatID, message.ID); status == domain.StatusRead {
+		t.Error("Sender or third party should not be able to mark a message as read")
+	} else {
+		t.Log("[OK] Sender and third party cannot mark the message as read")
 	}
 
-	return &message, nil
+	// The recipient can
+	bobConn := connectWebSocket(t, server.URL, bob)
+	defer bobConn.Close()
+	writeEnvelope(t, bobConn, "mark_read", "read-2", markRead)
+
+	waitForStatus(t, client, server.URL, bob, chatID, message.ID, domain.StatusRead)
+	t.Log("[OK] Recipient marked the message as read")
+
+	t.Log("=== E2E Chat Authorization Test Completed ===")
 }
 
-func listUserChats(t *testing.T, client *http.Client, baseURL, userID string, page, pageSize int) *domain.PaginatedResponse {
-	t.Helper()
+// TestE2E_WebSocketSendMessage tests sending messages through the WebSocket instead of REST
+func TestE2E_WebSocketSendMessage(t *testing.T) {
+	// Setup
+	application := newTestApp(t, app.DefaultConfig())
+	server := httptest.NewServer(application.Handler())
+	defer server.Close()
 
-	url := fmt.Sprintf("%s/api/v1/chats?user_id=%s&page=%d&page_size=%d", baseURL, userID, page, pageSize)
-	resp, err := client.Get(url)
-	if err != nil {
-		t.Fatalf("Failed to list user chats: %v", err)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	t.Log("=== Starting E2E WebSocket Send Message Test ===")
+
+	alice := createUser(t, client, server.URL, "alice_ws_send")
+	bob := createUser(t, client, server.URL, "bob_ws_send")
+
+	bobConn := connectWebSocket(t, server.URL, bob)
+	defer bobConn.Close()
+	aliceConn := connectWebSocket(t, server.URL, alice)
+	defer aliceConn.Close()
+
+	sendPayload := map[string]string{
+		"recipient_id":    bob.ID,
+		"content":         "Hello over the socket",
+		"idempotency_key": "ws_1",
 	}
-	defer resp.Body.Close()
+	writeEnvelope(t, aliceConn, "send_message", "req-1", sendPayload)
 
-	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("Expected status 200 for chat listing, got %d", resp.StatusCode)
+	// The sender gets an acknowledgement with the server-assigned ID and timestamp
+	ack := readWebSocketJSON(t, aliceConn)
+	ackPayload := payloadOf(ack)
+	if ack["type"] != "message_ack" || ack["id"] != "req-1" || ackPayload["message_id"] == "" || ackPayload["timestamp"] == nil {
+		t.Fatalf("Expected message_ack frame for req-1, got %v", ack)
 	}
+	t.Logf("[OK] Sender received message_ack for %v", ackPayload["message_id"])
 
-	var response domain.PaginatedResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		t.Fatalf("Failed to decode chats response: %v", err)
+	// The recipient gets the message just like with the REST endpoint
+	frame := readWebSocketJSON(t, bobConn)
+	received := payloadOf(frame)
+	if frame["type"] != "message" || received["id"] != ackPayload["message_id"] || received["content"] != "Hello over the socket" {
+		t.Errorf("Recipient received unexpected frame: %v", frame)
+	} else {
+		t.Log("[OK] Recipient received the message")
+	}
+	expectReceipt(t, aliceConn, ackPayload["message_id"], domain.StatusDelivered)
+
+	// Retrying with the same idempotency key is acknowledged with the same ID and pushed to
+	// neither the recipient nor the sender's other devices again
+	aliceTablet := connectDevice(t, server.URL, alice, "tablet")
+	defer aliceTablet.Close()
+	waitForDevices(t, client, server.URL, alice, alice.ID, 2)
+
+	writeEnvelope(t, aliceConn, "send_message", "req-2", sendPayload)
+	retryAck := payloadOf(readWebSocketJSON(t, aliceConn))
+	if retryAck["message_id"] != ackPayload["message_id"] {
+		t.Errorf("Expected retry to return message %v, got %v", ackPayload["message_id"], retryAck["message_id"])
+	} else {
+		t.Log("[OK] Retry over WebSocket is idempotent")
+	}
+	expectNoFrame(t, bobConn)
+	expectNoFrame(t, aliceTablet)
+	t.Log("[OK] Retry over WebSocket is only acknowledged")
+	// The message was already delivered, so the retry produces no second receipt: the next
+	// frame Alice gets is the reply to her next request
+
+	// Invalid requests produce an error frame
+	writeEnvelope(t, aliceConn, "send_message", "req-3", map[string]string{"recipient_id": bob.ID, "content": ""})
+	errFrame := readWebSocketJSON(t, aliceConn)
+	if errFrame["type"] != "error" || errFrame["id"] != "req-3" || payloadOf(errFrame)["code"] != "validation_failed" {
+		t.Errorf("Expected validation error frame for req-3, got %v", errFrame)
+	} else {
+		t.Log("[OK] Empty message rejected with an error frame")
 	}
 
-	return &response
+	messages := listChatMessages(t, client, server.URL, alice, received["chat_id"].(string), 1, 10)
+	if messages.TotalCount != 1 {
+		t.Errorf("Expected 1 stored message, got %d", messages.TotalCount)
+	}
+
+	t.Log("=== E2E WebSocket Send Message Test Completed ===")
 }
 
-func listChatMessages(t *testing.T, client *http.Client, baseURL, chatID string, page, pageSize int) *domain.PaginatedResponse {
-	t.Helper()
+// TestE2E_WebSocketProtocol tests envelope validation, error frames and subprotocol negotiation
+func TestE2E_WebSocketProtocol(t *testing.T) {
+	// Setup
+	application := newTestApp(t, app.DefaultConfig())
+	server := httptest.NewServer(application.Handler())
+	defer server.Close()
 
-	url := fmt.Sprintf("%s/api/v1/chats/%s/messages?page=%d&page_size=%d", baseURL, chatID, page, pageSize)
-	resp, err := client.Get(url)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	t.Log("=== Starting E2E WebSocket Protocol Test ===")
+
+	alice := createUser(t, client, server.URL, "alice_protocol")
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	header := http.Header{"Authorization": []string{"Bearer " + alice.Token}}
+
+	// Clients can pin the protocol version through the subprotocol
+	dialer := websocket.Dialer{Subprotocols: []string{"messaging.v1"}}
+	conn, _, err := dialer.Dial(wsURL, header)
 	if err != nil {
-		t.Fatalf("Failed to list chat messages: %v", err)
+		t.Fatalf("Failed to connect with subprotocol: %v", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("Expected status 200 for message listing, got %d", resp.StatusCode)
+	defer conn.Close()
+	if conn.Subprotocol() != "messaging.v1" {
+		t.Errorf("Expected negotiated subprotocol messaging.v1, got %q", conn.Subprotocol())
+	} else {
+		t.Log("[OK] Subprotocol messaging.v1 negotiated")
 	}
 
-	var response domain.PaginatedResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		t.Fatalf("Failed to decode messages response: %v", err)
+	// Unsupported versions are refused during the handshake
+	dialer = websocket.Dialer{Subprotocols: []string{"messaging.v99"}}
+	if _, resp, err := dialer.Dial(wsURL, header); err == nil {
+		t.Error("Expected handshake with unsupported subprotocol to fail")
+	} else if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unsupported subprotocol, got %v", resp)
+	} else {
+		t.Log("[OK] Unsupported subprotocol rejected")
 	}
 
-	return &response
-}
+	cases := []struct {
+		name  string
+		frame string
+		code  string
+	}{
+		{"malformed JSON", `{not json`, "bad_request"},
+		{"missing type", `{"id":"p-1","payload":{}}`, "bad_request"},
+		{"unknown type", `{"type":"teleport","id":"p-2","version":1}`, "unknown_type"},
+		{"unsupported version", `{"type":"mark_read","id":"p-3","version":2,"payload":{"message_id":"x"}}`, "unsupported_version"},
+		{"missing payload", `{"type":"send_message","id":"p-4","version":1}`, "invalid_payload"},
+		{"bad payload", `{"type":"send_message","id":"p-5","version":1,"payload":"hello"}`, "invalid_payload"},
+		{"unknown message", `{"type":"mark_read","id":"p-6","payload":{"message_id":"missing"}}`, "not_found"},
+	}
 
-func getChatID(t *testing.T, chats *domain.PaginatedResponse, participantID string) string {
-	t.Helper()
+	for _, tc := range cases {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(tc.frame)); err != nil {
+			t.Fatalf("Failed to write frame: %v", err)
+		}
 
-	chatList := chats.Data.([]interface{})
-	for _, chat := range chatList {
-		chatMap := chat.(map[string]interface{})
-		if chatMap["participant1"] == participantID || chatMap["participant2"] == participantID {
-			return chatMap["id"].(string)
+		frame := readWebSocketJSON(t, conn)
+		if frame["type"] != "error" || payloadOf(frame)["code"] != tc.code || frame["version"] != float64(1) {
+			t.Errorf("%s: expected error frame with code %s, got %v", tc.name, tc.code, frame)
+		} else {
+			t.Logf("[OK] %s reported as %s", tc.name, tc.code)
 		}
 	}
-	t.Fatalf("Chat with participant %s not found", participantID)
-	return ""
+
+	t.Log("=== E2E WebSocket Protocol Test Completed ===")
 }
 
-// Error scenario tests
+// TestE2E_MultiDevice tests that a user can be connected from several devices at once
+func TestE2E_MultiDevice(t *testing.T) {
+	// Setup
+	application := newTestApp(t, app.DefaultConfig())
+	server := httptest.NewServer(application.Handler())
+	defer server.Close()
 
-func testEmptyMessage(t *testing.T, client *http.Client, baseURL, senderID, recipientID string) {
-	messageData := map[string]string{
-		"sender_id":    senderID,
-		"recipient_id": recipientID,
-		"content":      "",
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	t.Log("=== Starting E2E Multi Device Test ===")
+
+	alice := createUser(t, client, server.URL, "alice_devices")
+	bob := createUser(t, client, server.URL, "bob_devices")
+
+	phone := connectDevice(t, server.URL, alice, "phone")
+	defer phone.Close()
+	laptop := connectDevice(t, server.URL, alice, "laptop")
+	defer laptop.Close()
+	bobConn := connectDevice(t, server.URL, bob, "desktop")
+	defer bobConn.Close()
+
+	devices := waitForDevices(t, client, server.URL, alice, alice.ID, 2)
+	if devices[0] != "phone" || devices[1] != "laptop" {
+		t.Errorf("Expected devices [phone laptop], got %v", devices)
+	} else {
+		t.Log("[OK] Both of Alice's devices are online")
+	}
+	waitForDevices(t, client, server.URL, bob, bob.ID, 1)
+
+	// Only users sharing a chat with Alice may see her devices
+	for _, tc := range []struct {
+		userID string
+		status int
+	}{{alice.ID, http.StatusForbidden}, {"missing-user", http.StatusNotFound}} {
+		resp, err := doRequest(client, "GET", server.URL+"/api/v1/users/"+tc.userID+"/devices", bob.Token, nil)
+		if err != nil {
+			t.Fatalf("Failed to list devices: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("Expected status %d for listing the devices of %s, got %d", tc.status, tc.userID, resp.StatusCode)
+		}
 	}
-	body, _ := json.Marshal(messageData)
 
-	resp, err := client.Post(baseURL+"/api/v1/messages", "application/json", bytes.NewReader(body))
-	if err != nil {
-		t.Fatalf("Failed to send empty message: %v", err)
+	// Messages to Alice reach every one of her devices
+	msg := sendMessage(t, client, server.URL, bob, alice.ID, "Hi on all devices", "md_1")
+	for name, conn := range map[string]*websocket.Conn{"phone": phone, "laptop": laptop} {
+		frame := readWebSocketJSON(t, conn)
+		if payloadOf(frame)["id"] != msg.ID {
+			t.Errorf("Alice's %s expected message %s, got %v", name, msg.ID, frame)
+		}
 	}
-	defer resp.Body.Close()
+	// Bob's own device receives the REST-sent message for sync
+	if frame := readWebSocketJSON(t, bobConn); payloadOf(frame)["id"] != msg.ID {
+		t.Errorf("Bob's device expected his own message %s for sync, got %v", msg.ID, frame)
+	}
+	expectReceipt(t, bobConn, msg.ID, domain.StatusDelivered)
+	t.Log("[OK] Message fanned out to all of Alice's devices")
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400 for empty message, got %d", resp.StatusCode)
+	if devices := onlineDevices(t, client, server.URL, bob, alice.ID); len(devices) != 2 {
+		t.Errorf("Expected Bob to see Alice's 2 devices once they share a chat, got %v", devices)
 	} else {
-		t.Log("[OK] Empty message correctly rejected")
+		t.Log("[OK] Devices are only listed to users sharing a chat")
 	}
-}
 
-func testSelfMessage(t *testing.T, client *http.Client, baseURL, userID string) {
-	messageData := map[string]string{
-		"sender_id":    userID,
-		"recipient_id": userID,
-		"content":      "Message to myself",
+	// A message sent from the phone syncs to the laptop but is not echoed to the phone
+	writeEnvelope(t, phone, "send_message", "md-req", map[string]string{"recipient_id": bob.ID, "content": "Sent from phone"})
+	ack := readWebSocketJSON(t, phone)
+	if ack["type"] != "message_ack" {
+		t.Fatalf("Expected message_ack on phone, got %v", ack)
 	}
-	body, _ := json.Marshal(messageData)
+	sentID := payloadOf(ack)["message_id"]
 
-	resp, err := client.Post(baseURL+"/api/v1/messages", "application/json", bytes.NewReader(body))
-	if err != nil {
-		t.Fatalf("Failed to send self-message: %v", err)
+	if frame := readWebSocketJSON(t, laptop); payloadOf(frame)["id"] != sentID {
+		t.Errorf("Laptop expected synced message %v, got %v", sentID, frame)
+	}
+	if frame := readWebSocketJSON(t, bobConn); payloadOf(frame)["id"] != sentID {
+		t.Errorf("Bob expected message %v, got %v", sentID, frame)
+	}
+	// Both of Alice's devices learn that Bob got it, but the phone never sees its own message
+	expectReceipt(t, laptop, sentID, domain.StatusDelivered)
+	expectReceipt(t, phone, sentID, domain.StatusDelivered)
+	expectNoFrame(t, phone)
+	t.Log("[OK] Message synced to the sender's other devices")
+
+	// Reconnecting the same device replaces its old connection
+	phone2 := connectDevice(t, server.URL, alice, "phone")
+	defer phone2.Close()
+
+	phone.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := phone.ReadMessage(); err == nil {
+		t.Error("Expected the replaced phone connection to be closed")
+	}
+	if devices := waitForDevices(t, client, server.URL, bob, alice.ID, 2); len(devices) != 2 {
+		t.Errorf("Expected 2 devices after reconnect, got %v", devices)
+	} else {
+		t.Log("[OK] Reconnecting device replaced its previous connection")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400 for self-message, got %d", resp.StatusCode)
+	// Disconnecting one device keeps the other online
+	laptop.Close()
+	devices = waitForDevices(t, client, server.URL, bob, alice.ID, 1)
+	if devices[0] != "phone" {
+		t.Errorf("Expected only the phone to remain online, got %v", devices)
 	} else {
-		t.Log("[OK] Self-message correctly rejected")
+		t.Log("[OK] Disconnecting the laptop left the phone online")
 	}
+
+	t.Log("=== E2E Multi Device Test Completed ===")
 }
 
-func testNonExistentUserCreatesChat(t *testing.T, client *http.Client, baseURL, senderID string) {
-	// Current behavior: messaging non-existent users creates a chat
-	// This might be intentional (allowing future users to see messages sent to them)
-	nonExistentUserID := "non-existent-user-123"
+// TestE2E_Receipts tests that the sender is told when their messages are delivered and read
+func TestE2E_Receipts(t *testing.T) {
+	// Setup
+	application := newTestApp(t, app.DefaultConfig())
+	server := httptest.NewServer(application.Handler())
+	defer server.Close()
 
-	messageData := map[string]string{
-		"sender_id":    senderID,
-		"recipient_id": nonExistentUserID,
-		"content":      "Hello non-existent user",
-	}
-	body, _ := json.Marshal(messageData)
+	client := &http.Client{Timeout: 10 * time.Second}
 
-	resp, err := client.Post(baseURL+"/api/v1/messages", "application/json", bytes.NewReader(body))
-	if err != nil {
-		t.Fatalf("Failed to send message to non-existent user: %v", err)
+	t.Log("=== Starting E2E Receipts Test ===")
+
+	alice := createUser(t, client, server.URL, "alice_receipts")
+	bob := createUser(t, client, server.URL, "bob_receipts")
+
+	aliceConn := connectWebSocket(t, server.URL, alice)
+	defer aliceConn.Close()
+	waitForDevices(t, client, server.URL, alice, alice.ID, 1)
+
+	// While Bob is offline Alice only gets her own message back for sync
+	msg := sendMessage(t, client, server.URL, alice, bob.ID, "Are you there?", "")
+	if frame := readWebSocketJSON(t, aliceConn); frame["type"] != "message" || payloadOf(frame)["id"] != msg.ID {
+		t.Fatalf("Expected Alice's own message for sync, got %v", frame)
+	}
+	if status := messageStatus(t, client, server.URL, alice, msg.ChatID, msg.ID); status != domain.StatusSent {
+		t.Errorf("Expected message to stay sent while Bob is offline, got %s", status)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusCreated {
-		t.Log("[OK] Current behavior: messages to non-existent users create chats (might be intentional)")
+	// Bob connecting delivers the queued message
+	bobConn := connectWebSocket(t, server.URL, bob)
+	defer bobConn.Close()
+	readWebSocketJSON(t, bobConn)
 
-		// Verify the chat was created
-		chats := listUserChats(t, client, baseURL, senderID, 1, 10)
-		found := false
-		chatList := chats.Data.([]interface{})
-		for _, chat := range chatList {
-			chatMap := chat.(map[string]interface{})
-			if chatMap["participant2"] == nonExistentUserID {
-				found = true
-				break
-			}
-		}
-		if found {
-			t.Log("[OK] Chat with non-existent user was created")
-		} else {
-			t.Error("Chat with non-existent user was not found in user's chat list")
-		}
+	receipt := readWebSocketJSON(t, aliceConn)
+	if receipt["type"] != "receipt" || payloadOf(receipt)["chat_id"] != msg.ChatID {
+		t.Errorf("Expected receipt for chat %s, got %v", msg.ChatID, receipt)
+	}
+	if payloadOf(receipt)["message_id"] != msg.ID || payloadOf(receipt)["status"] != "delivered" {
+		t.Errorf("Expected delivered receipt for %s, got %v", msg.ID, receipt)
 	} else {
-		t.Errorf("Unexpected status for non-existent user message: %d", resp.StatusCode)
+		t.Log("[OK] Delivery receipt sent when the offline queue was flushed")
 	}
-}
 
-func testInvalidUsers(t *testing.T, client *http.Client, baseURL string) {
-	messageData := map[string]string{
-		"sender_id":    "",
-		"recipient_id": "",
-		"content":      "Test message",
+	// Marking the message as read sends a read receipt
+	writeEnvelope(t, bobConn, "mark_read", "read-1", map[string]string{"message_id": msg.ID})
+	expectReceipt(t, aliceConn, msg.ID, domain.StatusRead)
+	expectNoFrame(t, bobConn)
+	t.Log("[OK] Read receipt sent to the sender")
+
+	// Rejected status updates produce no receipt
+	writeEnvelope(t, aliceConn, "mark_read", "read-2", map[string]string{"message_id": msg.ID})
+	if frame := readWebSocketJSON(t, aliceConn); frame["type"] != "error" || payloadOf(frame)["code"] != "forbidden" {
+		t.Errorf("Expected forbidden error for the sender marking their own message, got %v", frame)
 	}
-	body, _ := json.Marshal(messageData)
+	expectNoFrame(t, aliceConn)
 
-	resp, err := client.Post(baseURL+"/api/v1/messages", "application/json", bytes.NewReader(body))
-	if err != nil {
-		t.Fatalf("Failed to send message with invalid users: %v", err)
+	t.Log("=== E2E Receipts Test Completed ===")
+}
+
+// TestE2E_StatusTransitions tests that message statuses only move forward and record when each
+// status was reached
+func TestE2E_StatusTransitions(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_transitions")
+			bob := createUser(t, client, server.URL, "bob_transitions")
+
+			msg := sendMessage(t, client, server.URL, alice, bob.ID, "Track my status", "")
+			if msg.DeliveredAt != nil || msg.ReadAt != nil {
+				t.Errorf("Expected a sent message without delivered_at/read_at, got %+v", msg)
+			}
+
+			// Bob connecting delivers the message
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			readWebSocketJSON(t, bobConn)
+			waitForStatus(t, client, server.URL, alice, msg.ChatID, msg.ID, domain.StatusDelivered)
+
+			delivered := findMessage(t, client, server.URL, alice, msg.ChatID, msg.ID)
+			if delivered.DeliveredAt == nil || delivered.DeliveredAt.Before(msg.Timestamp) || delivered.ReadAt != nil {
+				t.Errorf("Expected delivered_at after the send and no read_at, got %+v", delivered)
+			} else {
+				t.Log("[OK] delivered_at recorded on delivery")
+			}
+
+			// Reading the message records read_at and keeps delivered_at
+			writeEnvelope(t, bobConn, "mark_read", "read-1", map[string]string{"message_id": msg.ID})
+			waitForStatus(t, client, server.URL, alice, msg.ChatID, msg.ID, domain.StatusRead)
+
+			read := findMessage(t, client, server.URL, alice, msg.ChatID, msg.ID)
+			if read.ReadAt == nil || read.DeliveredAt == nil || !read.DeliveredAt.Equal(*delivered.DeliveredAt) || read.ReadAt.Before(*read.DeliveredAt) {
+				t.Errorf("Expected read_at after an unchanged delivered_at, got %+v", read)
+			} else {
+				t.Log("[OK] read_at recorded on read")
+			}
+
+			// Statuses never repeat or move backwards
+			writeEnvelope(t, bobConn, "mark_read", "read-2", map[string]string{"message_id": msg.ID})
+			if frame := readWebSocketJSON(t, bobConn); frame["type"] != "error" || payloadOf(frame)["code"] != "conflict" {
+				t.Errorf("Expected conflict error for marking a read message again, got %v", frame)
+			} else {
+				t.Log("[OK] Repeated read rejected")
+			}
+
+			resp, err := doRequest(client, "GET", server.URL+"/api/v1/messages/undelivered", bob.Token, nil)
+			if err != nil {
+				t.Fatalf("Failed to fetch undelivered messages: %v", err)
+			}
+			resp.Body.Close()
+			if status := messageStatus(t, client, server.URL, alice, msg.ChatID, msg.ID); status != domain.StatusRead {
+				t.Errorf("Expected message to stay read, got %s", status)
+			}
+		})
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400 for invalid users, got %d", resp.StatusCode)
-	} else {
-		t.Log("[OK] Message with invalid users correctly rejected")
+// TestE2E_MarkChatRead tests marking a whole chat as read up to a message and the unread counts
+// of the chat list
+func TestE2E_MarkChatRead(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_read_upto")
+			bob := createUser(t, client, server.URL, "bob_read_upto")
+			charlie := createUser(t, client, server.URL, "charlie_read_upto")
+
+			var sent []*domain.Message
+			for i := 1; i <= 3; i++ {
+				sent = append(sent, sendMessage(t, client, server.URL, alice, bob.ID, fmt.Sprintf("Unread %d", i), ""))
+			}
+			reply := sendMessage(t, client, server.URL, bob, alice.ID, "Catching up", "")
+			chatID := sent[0].ChatID
+
+			if count := chatUnreadCount(t, client, server.URL, bob, chatID); count != 3 {
+				t.Errorf("Expected Bob to have 3 unread messages, got %d", count)
+			}
+			if count := chatUnreadCount(t, client, server.URL, alice, chatID); count != 1 {
+				t.Errorf("Expected Alice to have 1 unread message, got %d", count)
+			} else {
+				t.Log("[OK] Unread counts are tracked per participant")
+			}
+
+			aliceConn := connectWebSocket(t, server.URL, alice)
+			defer aliceConn.Close()
+			// Alice's device is flushed Bob's reply on connect
+			readWebSocketJSON(t, aliceConn)
+
+			// Reading up to the second message reads the first two in one go
+			mark := markChatRead(t, client, server.URL, bob, chatID, sent[1].ID, http.StatusOK)
+			if mark.MessageID != sent[1].ID || mark.UserID != bob.ID || mark.ChatID != chatID {
+				t.Errorf("Unexpected read mark %+v", mark)
+			}
+			for _, msg := range sent[:2] {
+				if status := messageStatus(t, client, server.URL, alice, chatID, msg.ID); status != domain.StatusRead {
+					t.Errorf("Expected message %s to be read, got %s", msg.ID, status)
+				}
+			}
+			if status := messageStatus(t, client, server.URL, alice, chatID, sent[2].ID); status == domain.StatusRead {
+				t.Errorf("Expected message %s after the watermark to stay unread", sent[2].ID)
+			}
+			if count := chatUnreadCount(t, client, server.URL, bob, chatID); count != 1 {
+				t.Errorf("Expected Bob to have 1 unread message after reading up to the second, got %d", count)
+			} else {
+				t.Log("[OK] Chat marked read up to a message")
+			}
+
+			frame := readWebSocketJSON(t, aliceConn)
+			if frame["type"] != "chat_read" || payloadOf(frame)["message_id"] != sent[1].ID || payloadOf(frame)["user_id"] != bob.ID {
+				t.Errorf("Expected chat_read event for Alice, got %v", frame)
+			} else {
+				t.Log("[OK] Sender notified with a chat_read event")
+			}
+
+			// The watermark never moves backwards
+			mark = markChatRead(t, client, server.URL, bob, chatID, sent[0].ID, http.StatusOK)
+			if mark.MessageID != sent[1].ID {
+				t.Errorf("Expected the watermark to stay at %s, got %s", sent[1].ID, mark.MessageID)
+			}
+
+			// Reading over the socket up to Bob's own reply reads the rest
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			readWebSocketJSON(t, bobConn)
+			writeEnvelope(t, bobConn, "mark_chat_read", "read-all", map[string]string{"chat_id": chatID, "message_id": reply.ID})
+			waitForStatus(t, client, server.URL, alice, chatID, sent[2].ID, domain.StatusRead)
+			if count := chatUnreadCount(t, client, server.URL, bob, chatID); count != 0 {
+				t.Errorf("Expected no unread messages for Bob, got %d", count)
+			}
+			if count := chatUnreadCount(t, client, server.URL, alice, chatID); count != 1 {
+				t.Errorf("Expected Bob's read to leave Alice's unread count at 1, got %d", count)
+			} else {
+				t.Log("[OK] Chat marked read over the WebSocket")
+			}
+
+			// Only participants may mark a chat, and only up to one of its messages
+			markChatRead(t, client, server.URL, charlie, chatID, sent[2].ID, http.StatusForbidden)
+			other := sendMessage(t, client, server.URL, charlie, bob.ID, "Different chat", "")
+			markChatRead(t, client, server.URL, bob, chatID, other.ID, http.StatusNotFound)
+		})
+	}
+}
+
+// TestE2E_ChatSummaries tests that the chat list carries everything needed to render an inbox
+func TestE2E_ChatSummaries(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_summary")
+			bob := createUser(t, client, server.URL, "bob_summary")
+			charlie := createUser(t, client, server.URL, "charlie_summary")
+
+			sendMessage(t, client, server.URL, charlie, alice.ID, "Old news", "")
+			sendMessage(t, client, server.URL, alice, bob.ID, "Hi Bob", "")
+			long := strings.Repeat("é", domain.MessagePreviewLength+20)
+			last := sendMessage(t, client, server.URL, bob, alice.ID, long, "")
+
+			resp, err := doRequest(client, "GET", server.URL+"/api/v1/chats", alice.Token, nil)
+			if err != nil {
+				t.Fatalf("Failed to list chats: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var response struct {
+				Data []*domain.ChatSummary `json:"data"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode chats response: %v", err)
+			}
+			if len(response.Data) != 2 {
+				t.Fatalf("Expected 2 chats for Alice, got %d", len(response.Data))
+			}
+
+			// The most recently active chat comes first, summarized from Alice's point of view
+			bobChat := response.Data[0]
+			if bobChat.Peer == nil || bobChat.Peer.ID != bob.ID || bobChat.Peer.Username != bob.Username {
+				t.Errorf("Expected Bob as the peer of the first chat, got %+v", bobChat.Peer)
+			} else {
+				t.Log("[OK] Chat summary includes the other participant's profile")
+			}
+
+			preview := bobChat.LastMessage
+			expected := strings.Repeat("é", domain.MessagePreviewLength) + "…"
+			if preview == nil || preview.ID != last.ID || preview.SenderID != bob.ID || preview.Status != domain.StatusSent || preview.Timestamp.IsZero() {
+				t.Errorf("Expected last message %s from Bob, got %+v", last.ID, preview)
+			} else if preview.Preview != expected {
+				t.Errorf("Expected preview truncated to %d characters, got %q", domain.MessagePreviewLength, preview.Preview)
+			} else {
+				t.Log("[OK] Chat summary includes a truncated last message preview")
+			}
+			if bobChat.UnreadCount != 1 {
+				t.Errorf("Expected 1 unread message from Bob, got %d", bobChat.UnreadCount)
+			}
+
+			charlieChat := response.Data[1]
+			if charlieChat.Peer == nil || charlieChat.Peer.ID != charlie.ID || charlieChat.LastMessage == nil || charlieChat.LastMessage.Preview != "Old news" {
+				t.Errorf("Expected Charlie's chat with an untruncated preview, got %+v", charlieChat)
+			}
+		})
+	}
+}
+
+// TestE2E_CursorPagination tests loading a chat page by page with before/after cursors
+func TestE2E_CursorPagination(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_cursor")
+			bob := createUser(t, client, server.URL, "bob_cursor")
+
+			var sent []*domain.Message
+			for i := 1; i <= 5; i++ {
+				sent = append(sent, sendMessage(t, client, server.URL, alice, bob.ID, fmt.Sprintf("Message %d", i), ""))
+			}
+			chatID := sent[0].ChatID
+			base := server.URL + "/api/v1/chats/" + chatID + "/messages?page_size=2"
+
+			// Newest first: the latest two messages, then older ones
+			page := cursorPage(t, client, bob, base+"&direction=backward", http.StatusOK)
+			expectPageIDs(t, page, sent[4], sent[3])
+			if page.NextCursor == "" || page.PrevCursor != "" || page.TotalCount != 5 {
+				t.Errorf("Expected only a next cursor on the newest page, got %+v", page)
+			}
+
+			// A message arriving meanwhile does not shift the older pages
+			newest := sendMessage(t, client, server.URL, bob, alice.ID, "Arrived while scrolling", "")
+
+			page = cursorPage(t, client, bob, base+"&direction=backward&before="+page.NextCursor, http.StatusOK)
+			expectPageIDs(t, page, sent[2], sent[1])
+			if page.NextCursor == "" || page.PrevCursor == "" {
+				t.Errorf("Expected next and prev cursors on a middle page, got %+v", page)
+			}
+			middlePrev := page.PrevCursor
+
+			page = cursorPage(t, client, bob, base+"&direction=backward&before="+page.NextCursor, http.StatusOK)
+			expectPageIDs(t, page, sent[0])
+			if page.NextCursor != "" {
+				t.Errorf("Expected no next cursor on the oldest page, got %q", page.NextCursor)
+			} else {
+				t.Log("[OK] Paged backwards through the history without shifting")
+			}
+
+			// The prev cursor goes back towards newer messages, oldest first
+			page = cursorPage(t, client, bob, base+"&after="+middlePrev, http.StatusOK)
+			expectPageIDs(t, page, sent[3], sent[4])
+			page = cursorPage(t, client, bob, base+"&after="+page.NextCursor, http.StatusOK)
+			expectPageIDs(t, page, newest)
+			if page.NextCursor != "" || page.PrevCursor == "" {
+				t.Errorf("Expected only a prev cursor on the newest forward page, got %+v", page)
+			} else {
+				t.Log("[OK] Paged forwards with after cursors")
+			}
+
+			// Messages deleted for the viewer do not count as a previous page
+			deleteMessage(t, client, server.URL, bob, newest.ID, "me", http.StatusNoContent)
+			deleteMessage(t, client, server.URL, bob, sent[0].ID, "me", http.StatusNoContent)
+			page = cursorPage(t, client, bob, base+"&direction=backward&before="+domain.CursorFor(newest).Encode(), http.StatusOK)
+			expectPageIDs(t, page, sent[4], sent[3])
+			if page.PrevCursor != "" {
+				t.Errorf("Expected no prev cursor when only hidden messages are newer, got %q", page.PrevCursor)
+			}
+			page = cursorPage(t, client, bob, base+"&after="+domain.CursorFor(sent[0]).Encode(), http.StatusOK)
+			expectPageIDs(t, page, sent[1], sent[2])
+			if page.PrevCursor != "" {
+				t.Errorf("Expected no prev cursor when only hidden messages are older, got %q", page.PrevCursor)
+			}
+			page = cursorPage(t, client, bob, base+"&direction=backward&before="+domain.CursorFor(sent[4]).Encode(), http.StatusOK)
+			expectPageIDs(t, page, sent[3], sent[2])
+			if page.PrevCursor == "" {
+				t.Errorf("Expected a prev cursor when a visible message is newer, got %+v", page)
+			} else {
+				t.Log("[OK] Prev cursors only point at messages the viewer sees")
+			}
+
+			// Invalid parameters and cursors from other chats are rejected
+			charlie := createUser(t, client, server.URL, "charlie_cursor")
+			other := sendMessage(t, client, server.URL, charlie, bob.ID, "Other chat", "")
+			foreign := domain.CursorFor(other).Encode()
+			cursorPage(t, client, bob, base+"&before="+foreign, http.StatusBadRequest)
+			cursorPage(t, client, bob, base+"&after=not-a-cursor", http.StatusBadRequest)
+			cursorPage(t, client, bob, base+"&direction=sideways", http.StatusBadRequest)
+			cursorPage(t, client, charlie, base+"&direction=backward", http.StatusForbidden)
+		})
+	}
+}
+
+// TestE2E_MessageSequence tests that every message of a chat gets the next sequence number, even
+// when sent concurrently from both sides, and that the sequence orders the chat
+func TestE2E_MessageSequence(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.OfflineQueueLimit = 0 // only the live message below should reach the sockets
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_seq")
+			bob := createUser(t, client, server.URL, "bob_seq")
+
+			first := sendMessage(t, client, server.URL, alice, bob.ID, "First", "")
+			if first.Seq != 1 {
+				t.Errorf("Expected the first message to get seq 1, got %d", first.Seq)
+			}
+
+			const numMessages = 20
+			var wg sync.WaitGroup
+			for i := 0; i < numMessages; i++ {
+				wg.Add(1)
+				go func(index int) {
+					defer wg.Done()
+					sender, recipient := alice, bob
+					if index%2 == 1 {
+						sender, recipient = bob, alice
+					}
+					if _, err := sendMessageWithError(client, server.URL, sender, recipient.ID, fmt.Sprintf("Concurrent %d", index), ""); err != nil {
+						t.Errorf("Concurrent message failed: %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			// Retries return the original sequence number instead of taking a new one
+			retry := sendMessage(t, client, server.URL, alice, bob.ID, "Retried", "seq_retry")
+			if again := sendMessage(t, client, server.URL, alice, bob.ID, "Retried", "seq_retry"); again.Seq != retry.Seq {
+				t.Errorf("Expected retry to keep seq %d, got %d", retry.Seq, again.Seq)
+			}
+
+			messages := listChatMessages(t, client, server.URL, alice, first.ChatID, 1, 100)
+			data := messages.Data.([]interface{})
+			for i, msg := range data {
+				if seq := msg.(map[string]interface{})["seq"]; seq != float64(i+1) {
+					t.Errorf("Expected message %d of the chat to have seq %d, got %v", i, i+1, seq)
+				}
+			}
+			if len(data) != numMessages+2 || retry.Seq != int64(numMessages+2) {
+				t.Errorf("Expected %d messages ending with seq %d, got %d ending with %d", numMessages+2, numMessages+2, len(data), retry.Seq)
+			} else {
+				t.Log("[OK] Sequence numbers are gapless and ordered under concurrency")
+			}
+
+			summary := listUserChats(t, client, server.URL, bob, 1, 10).Data.([]interface{})[0].(map[string]interface{})
+			lastMessage, _ := summary["last_message"].(map[string]interface{})
+			if summary["last_seq"] != float64(retry.Seq) || lastMessage["seq"] != float64(retry.Seq) {
+				t.Errorf("Expected chat last_seq and last message seq %d, got %v", retry.Seq, summary)
+			}
+
+			// WebSocket frames carry the sequence number
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			aliceConn := connectWebSocket(t, server.URL, alice)
+			defer aliceConn.Close()
+			waitForDevices(t, client, server.URL, alice, bob.ID, 1)
+
+			writeEnvelope(t, aliceConn, "send_message", "seq-1", map[string]string{"recipient_id": bob.ID, "content": "Live"})
+			ack := readWebSocketJSON(t, aliceConn)
+			if payloadOf(ack)["seq"] != float64(retry.Seq+1) {
+				t.Errorf("Expected message_ack with seq %d, got %v", retry.Seq+1, ack)
+			}
+			frame := readWebSocketJSON(t, bobConn)
+			if frame["type"] != "message" || payloadOf(frame)["seq"] != float64(retry.Seq+1) {
+				t.Errorf("Expected message frame with seq %d, got %v", retry.Seq+1, frame)
+			} else {
+				t.Log("[OK] WebSocket frames carry the sequence number")
+			}
+		})
+	}
+}
+
+// TestE2E_Sync tests that a user catches up on everything that happened in their chats since a
+// sync token, over REST and the WebSocket resume frame
+func TestE2E_Sync(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.OfflineQueueLimit = 0 // only the sync reply below should reach the socket
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_sync")
+			bob := createUser(t, client, server.URL, "bob_sync")
+
+			// A fresh user has nothing to catch up on
+			initial := syncChanges(t, client, server.URL, bob, "", 0, http.StatusOK)
+			if len(initial.Changes) != 0 || initial.HasMore || initial.NextToken == "" {
+				t.Fatalf("Expected an empty sync with a token, got %+v", initial)
+			}
+
+			// Bob is offline while Alice starts a chat with two messages
+			first := sendMessage(t, client, server.URL, alice, bob.ID, "Sync 1", "")
+			second := sendMessage(t, client, server.URL, alice, bob.ID, "Sync 2", "")
+
+			result := syncChanges(t, client, server.URL, bob, initial.NextToken, 0, http.StatusOK)
+			expectChangeTypes(t, result, domain.ChangeChatCreated, domain.ChangeMessageCreated, domain.ChangeMessageCreated)
+			if len(result.Messages) != 2 || result.Messages[0].ID != first.ID || result.Messages[1].ID != second.ID {
+				t.Errorf("Expected both messages in the sync result, got %+v", result.Messages)
+			}
+			if len(result.Chats) != 1 || result.Chats[0].ID != first.ChatID || result.Chats[0].LastSeq != second.Seq {
+				t.Errorf("Expected the chat in its latest state, got %+v", result.Chats)
+			}
+			if result.HasMore {
+				t.Error("Expected no more changes")
+			} else {
+				t.Log("[OK] Sync returns new chats and messages")
+			}
+
+			// Reading the chat is a single change carrying the watermark
+			markChatRead(t, client, server.URL, bob, first.ChatID, second.ID, http.StatusOK)
+			readSync := syncChanges(t, client, server.URL, bob, result.NextToken, 0, http.StatusOK)
+			expectChangeTypes(t, readSync, domain.ChangeChatRead)
+			if len(readSync.Changes) == 1 && (readSync.Changes[0].MessageID != second.ID || readSync.Changes[0].UserID != bob.ID) {
+				t.Errorf("Expected chat_read up to %s by Bob, got %+v", second.ID, readSync.Changes[0])
+			}
+			if len(readSync.Messages) != 1 || readSync.Messages[0].Status != domain.StatusRead {
+				t.Errorf("Expected the read message in the sync result, got %+v", readSync.Messages)
+			}
+
+			// Alice's log holds the same history, including Bob's read watermark
+			aliceSync := syncChanges(t, client, server.URL, alice, "", 0, http.StatusOK)
+			expectChangeTypes(t, aliceSync, domain.ChangeChatCreated, domain.ChangeMessageCreated, domain.ChangeMessageCreated, domain.ChangeChatRead)
+
+			// Alice fetching Bob's reply delivers it
+			sendMessage(t, client, server.URL, bob, alice.ID, "Reply", "")
+			resp, err := doRequest(client, "GET", server.URL+"/api/v1/messages/undelivered", alice.Token, nil)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("Failed to fetch the reply: %v", err)
+			}
+			resp.Body.Close()
+			statusSync := syncChanges(t, client, server.URL, bob, readSync.NextToken, 0, http.StatusOK)
+			expectChangeTypes(t, statusSync, domain.ChangeMessageCreated, domain.ChangeMessageStatus)
+			if len(statusSync.Messages) != 1 || statusSync.Messages[0].Status != domain.StatusDelivered {
+				t.Errorf("Expected the reply once in its delivered state, got %+v", statusSync.Messages)
+			} else {
+				t.Log("[OK] Sync returns status changes and read watermarks")
+			}
+
+			// A limit splits the log into batches chained by next_token
+			batch := syncChanges(t, client, server.URL, bob, initial.NextToken, 2, http.StatusOK)
+			expectChangeTypes(t, batch, domain.ChangeChatCreated, domain.ChangeMessageCreated)
+			if !batch.HasMore {
+				t.Error("Expected more changes after the first batch")
+			}
+			batch = syncChanges(t, client, server.URL, bob, batch.NextToken, 2, http.StatusOK)
+			expectChangeTypes(t, batch, domain.ChangeMessageCreated, domain.ChangeChatRead)
+			if !batch.HasMore {
+				t.Error("Expected more changes after the second batch")
+			} else {
+				t.Log("[OK] Sync batches chain through next_token")
+			}
+
+			// Tokens are opaque and bound to the user they were issued to
+			syncChanges(t, client, server.URL, bob, "not-a-token", 0, http.StatusBadRequest)
+			syncChanges(t, client, server.URL, bob, aliceSync.NextToken, 0, http.StatusBadRequest)
+			t.Log("[OK] Invalid and foreign sync tokens are rejected")
+
+			// The resume frame replies with the same batch over the WebSocket
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+
+			writeEnvelope(t, bobConn, "resume", "resume-1", map[string]interface{}{"since": readSync.NextToken})
+			frame := readWebSocketJSON(t, bobConn)
+			payload := payloadOf(frame)
+			changes, _ := payload["changes"].([]interface{})
+			if frame["type"] != "sync" || frame["id"] != "resume-1" || len(changes) != 2 || payload["next_token"] != statusSync.NextToken {
+				t.Errorf("Expected sync frame with two changes, got %v", frame)
+			}
+
+			writeEnvelope(t, bobConn, "resume", "resume-2", map[string]interface{}{"since": aliceSync.NextToken})
+			frame = readWebSocketJSON(t, bobConn)
+			if frame["type"] != "error" || frame["id"] != "resume-2" || payloadOf(frame)["code"] != "validation_failed" {
+				t.Errorf("Expected validation_failed error for a foreign token, got %v", frame)
+			} else {
+				t.Log("[OK] WebSocket resume replies with a sync frame")
+			}
+		})
+	}
+}
+
+// TestE2E_SyncMatchesHistory tests that sync leaves out what the chat history no longer shows:
+// messages the user deleted for themselves and group chats they left
+func TestE2E_SyncMatchesHistory(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_history")
+			bob := createUser(t, client, server.URL, "bob_history")
+			carol := createUser(t, client, server.URL, "carol_history")
+			dave := createUser(t, client, server.URL, "dave_history")
+
+			// Changes to a message deleted for the user only leave the deletion behind
+			hidden := sendMessage(t, client, server.URL, bob, alice.ID, "Forget this", "")
+			kept := sendMessage(t, client, server.URL, bob, alice.ID, "Keep this", "")
+			deleteMessage(t, client, server.URL, alice, hidden.ID, "me", http.StatusNoContent)
+			editMessage(t, client, server.URL, bob, hidden.ID, "Forget this!", http.StatusOK)
+			react(t, client, server.URL, bob, "POST", hidden.ID, "👍", http.StatusOK)
+
+			result := syncChanges(t, client, server.URL, alice, "", 0, http.StatusOK)
+			expectChangeTypes(t, result, domain.ChangeChatCreated, domain.ChangeMessageCreated, domain.ChangeMessageHidden)
+			history := listChatMessages(t, client, server.URL, alice, kept.ChatID, 1, 50).Data.([]interface{})
+			if len(result.Messages) != 1 || result.Messages[0].ID != kept.ID || len(history) != 1 || history[0].(map[string]interface{})["id"] != kept.ID {
+				t.Errorf("Expected sync and history to hold only %s, got %+v and %v", kept.ID, result.Messages, history)
+			} else {
+				t.Log("[OK] Sync leaves out messages deleted for the user")
+			}
+
+			// Leaving a group only leaves the leaving behind
+			chat := chatRequest(t, client, carol, "POST", server.URL+"/api/v1/chats", map[string]interface{}{"title": "Book club", "member_ids": []string{dave.ID}}, http.StatusCreated)
+			sendToChat(t, client, server.URL, dave, chat.ID, "See you Monday", http.StatusCreated)
+			resp, err := doRequest(client, "POST", server.URL+"/api/v1/chats/"+chat.ID+"/leave", dave.Token, nil)
+			if err != nil {
+				t.Fatalf("Failed to leave chat: %v", err)
+			}
+			resp.Body.Close()
+			sendToChat(t, client, server.URL, carol, chat.ID, "Bye Dave", http.StatusCreated)
+
+			result = syncChanges(t, client, server.URL, dave, "", 0, http.StatusOK)
+			expectChangeTypes(t, result, domain.ChangeMemberRemoved)
+			if len(result.Chats) != 0 || len(result.Messages) != 0 {
+				t.Errorf("Expected no state of the group left, got %+v and %+v", result.Chats, result.Messages)
+			} else {
+				t.Log("[OK] Sync leaves out group chats the user left")
+			}
+		})
+	}
+}
+
+// TestE2E_ChangeRetention tests that old change log entries are pruned and that syncing from a
+// token whose following changes were pruned fails, while newer tokens keep working
+func TestE2E_ChangeRetention(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.ChangeRetention = 500 * time.Millisecond
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_retention")
+			bob := createUser(t, client, server.URL, "bob_retention")
+
+			sendMessage(t, client, server.URL, alice, bob.ID, "First", "")
+			sendMessage(t, client, server.URL, alice, bob.ID, "Second", "")
+			stale := syncChanges(t, client, server.URL, bob, "", 1, http.StatusOK).NextToken
+			current := syncChanges(t, client, server.URL, bob, "", 0, http.StatusOK).NextToken
+
+			// Once the entries after the stale token are pruned, it no longer syncs
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				resp, err := doRequest(client, "GET", server.URL+"/api/v1/sync?since="+stale, bob.Token, nil)
+				if err != nil {
+					t.Fatalf("Failed to sync: %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusBadRequest {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected the stale sync token to be rejected, still got status %d", resp.StatusCode)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			t.Log("[OK] Tokens older than the kept change log are rejected")
+
+			// The newest entry of a log is kept, so a caught-up token still resumes
+			third := sendMessage(t, client, server.URL, alice, bob.ID, "Third", "")
+			result := syncChanges(t, client, server.URL, bob, current, 0, http.StatusOK)
+			expectChangeTypes(t, result, domain.ChangeMessageCreated)
+			if len(result.Messages) != 1 || result.Messages[0].ID != third.ID {
+				t.Errorf("Expected the caught-up token to resume with %s, got %+v", third.ID, result.Messages)
+			} else {
+				t.Log("[OK] Caught-up tokens keep resuming after pruning")
+			}
+
+			// A full resync starts from the oldest entry kept
+			result = syncChanges(t, client, server.URL, bob, "", 0, http.StatusOK)
+			if len(result.Changes) == 0 || result.Changes[len(result.Changes)-1].MessageID != third.ID {
+				t.Errorf("Expected a full resync to end with %s, got %+v", third.ID, result.Changes)
+			} else {
+				t.Log("[OK] A full resync returns the kept changes")
+			}
+		})
+	}
+}
+
+// TestE2E_UsernameRules tests that usernames are validated and unique regardless of case and
+// Unicode compatibility forms
+func TestE2E_UsernameRules(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "Alice_Rules")
+			if alice.Username != "Alice_Rules" {
+				t.Errorf("Expected the username to keep its case, got %s", alice.Username)
+			}
+
+			// Names differing only in case or width belong to the same user
+			for _, username := range []string{"alice_rules", "ALICE_RULES", "Ａｌｉｃｅ_Ｒｕｌｅｓ"} {
+				if status := registrationStatus(t, client, server.URL, username); status != http.StatusConflict {
+					t.Errorf("Expected status 409 for %q, got %d", username, status)
+				}
+				if login := loginUser(t, client, server.URL, username); login.ID != alice.ID {
+					t.Errorf("Expected %q to log in as Alice, got %s", username, login.ID)
+				}
+			}
+			t.Log("[OK] Usernames are unique and looked up regardless of case and width")
+
+			invalid := []string{
+				"ab",                    // too short
+				strings.Repeat("a", 33), // too long
+				"bad name",              // space
+				"bad@name",              // symbol
+				"_leading",              // must start with a letter or digit
+				"admin",                 // reserved
+				"Admin",                 // reserved in any case
+			}
+			for _, username := range invalid {
+				if status := registrationStatus(t, client, server.URL, username); status != http.StatusBadRequest {
+					t.Errorf("Expected status 400 for %q, got %d", username, status)
+				}
+			}
+			t.Log("[OK] Invalid and reserved usernames are rejected")
+
+			// Letters and digits of any script are allowed
+			jose := createUser(t, client, server.URL, "José.Ñandú-2")
+			if login := loginUser(t, client, server.URL, "JOSÉ.ÑANDÚ-2"); login.ID != jose.ID {
+				t.Errorf("Expected the upper-case name to log in as José, got %s", login.ID)
+			} else {
+				t.Log("[OK] Non-ASCII usernames are accepted and case-folded")
+			}
+		})
+	}
+}
+
+// TestE2E_LoginTiming tests that failed logins take about as long for unknown usernames as for
+// wrong passwords, so response times do not tell which usernames exist
+func TestE2E_LoginTiming(t *testing.T) {
+	application := newTestApp(t, app.DefaultConfig())
+	server := httptest.NewServer(application.Handler())
+	defer server.Close()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	createUser(t, client, server.URL, "alice_timing")
+
+	// The fastest of a few attempts filters out scheduling noise
+	fastestLogin := func(username string) time.Duration {
+		fastest := time.Duration(math.MaxInt64)
+		for i := 0; i < 3; i++ {
+			start := time.Now()
+			resp, err := doRequest(client, "POST", server.URL+"/api/v1/auth/login", "", map[string]string{"username": username, "password": "wrong-password"})
+			if err != nil {
+				t.Fatalf("Failed to log in: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("Expected status 401 for %s, got %d", username, resp.StatusCode)
+			}
+			fastest = min(fastest, time.Since(start))
+		}
+		return fastest
+	}
+
+	wrongPassword := fastestLogin("alice_timing")
+	unknownUser := fastestLogin("nobody_timing")
+	if unknownUser < wrongPassword/4 {
+		t.Errorf("Expected unknown usernames to take about as long as wrong passwords, got %v and %v", unknownUser, wrongPassword)
+	} else {
+		t.Log("[OK] Unknown usernames take as long to reject as wrong passwords")
+	}
+}
+
+// TestE2E_EditMessage tests that senders can edit their messages within the edit window, that
+// earlier contents are kept as revisions and that both participants are notified
+func TestE2E_EditMessage(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.OfflineQueueLimit = 0 // only edit events should reach the sockets
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_edit")
+			bob := createUser(t, client, server.URL, "bob_edit")
+			carol := createUser(t, client, server.URL, "carol_edit")
+
+			original := sendMessage(t, client, server.URL, alice, bob.ID, "Helo", "edit_key")
+
+			aliceConn := connectWebSocket(t, server.URL, alice)
+			defer aliceConn.Close()
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			waitForDevices(t, client, server.URL, alice, bob.ID, 1)
+			waitForDevices(t, client, server.URL, bob, alice.ID, 1)
+
+			// The sender edits over REST; both participants get the edited message
+			edited := editMessage(t, client, server.URL, alice, original.ID, "Hello", http.StatusOK)
+			if edited.Content != "Hello" || edited.EditedAt == nil || edited.Seq != original.Seq {
+				t.Errorf("Expected edited content with edited_at and the same seq, got %+v", edited)
+			}
+			for name, conn := range map[string]*websocket.Conn{"Alice": aliceConn, "Bob": bobConn} {
+				frame := readWebSocketJSON(t, conn)
+				if frame["type"] != "message_edited" || payloadOf(frame)["content"] != "Hello" || payloadOf(frame)["edited_at"] == nil {
+					t.Errorf("Expected %s to get message_edited, got %v", name, frame)
+				}
+			}
+			t.Log("[OK] Sender edits a message over REST and both participants are notified")
+
+			// Only the sender may edit, and never to empty content
+			editMessage(t, client, server.URL, bob, original.ID, "Hijacked", http.StatusForbidden)
+			editMessage(t, client, server.URL, alice, original.ID, "", http.StatusBadRequest)
+			editMessage(t, client, server.URL, alice, "missing-message", "Hello", http.StatusNotFound)
+			t.Log("[OK] Edits by others, empty edits and unknown messages are rejected")
+
+			// Editing over WebSocket replies to the editing device and notifies the other participant
+			writeEnvelope(t, aliceConn, "edit_message", "edit-1", map[string]string{"message_id": original.ID, "content": "Hello, Bob"})
+			reply := readWebSocketJSON(t, aliceConn)
+			if reply["type"] != "message_edited" || reply["id"] != "edit-1" || payloadOf(reply)["content"] != "Hello, Bob" {
+				t.Errorf("Expected message_edited reply to edit-1, got %v", reply)
+			}
+			frame := readWebSocketJSON(t, bobConn)
+			if frame["type"] != "message_edited" || payloadOf(frame)["content"] != "Hello, Bob" {
+				t.Errorf("Expected Bob to get message_edited, got %v", frame)
+			} else {
+				t.Log("[OK] Sender edits a message over WebSocket")
+			}
+
+			writeEnvelope(t, bobConn, "edit_message", "edit-2", map[string]string{"message_id": original.ID, "content": "Hijacked"})
+			if frame := readWebSocketJSON(t, bobConn); frame["type"] != "error" || payloadOf(frame)["code"] != "forbidden" {
+				t.Errorf("Expected forbidden error for Bob's edit, got %v", frame)
+			}
+
+			// Both participants see the revisions, oldest first; outsiders do not
+			revisions := messageRevisions(t, client, server.URL, bob, original.ID, http.StatusOK)
+			if len(revisions) != 2 || revisions[0].Content != "Helo" || revisions[0].Revision != 1 ||
+				revisions[1].Content != "Hello" || revisions[1].Revision != 2 {
+				t.Errorf("Expected revisions Helo, Hello, got %+v", revisions)
+			}
+			messageRevisions(t, client, server.URL, carol, original.ID, http.StatusForbidden)
+			if current := findMessage(t, client, server.URL, bob, original.ChatID, original.ID); current.Content != "Hello, Bob" {
+				t.Errorf("Expected the chat to show the latest content, got %q", current.Content)
+			} else {
+				t.Log("[OK] Earlier contents are kept as revisions")
+			}
+
+			// A retry of the original send still matches after the edit
+			if retry := sendMessage(t, client, server.URL, alice, bob.ID, "Helo", "edit_key"); retry.ID != original.ID {
+				t.Errorf("Expected the retry to return the edited message, got %s", retry.ID)
+			}
+
+			// Edits show up in the change log
+			edits := 0
+			for _, change := range syncChanges(t, client, server.URL, bob, "", 0, http.StatusOK).Changes {
+				if change.Type == domain.ChangeMessageEdited && change.MessageID == original.ID {
+					edits++
+				}
+			}
+			if edits != 2 {
+				t.Errorf("Expected two message_edited changes, got %d", edits)
+			} else {
+				t.Log("[OK] Edits are recorded in the change log")
+			}
+		})
+	}
+
+	// Outside the edit window messages can no longer be edited
+	cfg := app.DefaultConfig()
+	cfg.EditWindow = 0
+	application := newTestApp(t, cfg)
+	server := httptest.NewServer(application.Handler())
+	defer server.Close()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	alice := createUser(t, client, server.URL, "alice_window")
+	bob := createUser(t, client, server.URL, "bob_window")
+	message := sendMessage(t, client, server.URL, alice, bob.ID, "Too late", "")
+	editMessage(t, client, server.URL, alice, message.ID, "Too late to fix", http.StatusForbidden)
+	t.Log("[OK] Edits outside the edit window are rejected")
+}
+
+// TestE2E_DeleteMessage tests deleting messages for oneself and, by the sender within the delete
+// window, for everyone
+func TestE2E_DeleteMessage(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.OfflineQueueLimit = 0 // only deletion events should reach the sockets
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_delete")
+			bob := createUser(t, client, server.URL, "bob_delete")
+			carol := createUser(t, client, server.URL, "carol_delete")
+
+			first := sendMessage(t, client, server.URL, alice, bob.ID, "First", "")
+			second := sendMessage(t, client, server.URL, alice, bob.ID, "Second", "")
+			third := sendMessage(t, client, server.URL, alice, bob.ID, "Third", "")
+			chatID := first.ChatID
+
+			aliceConn := connectWebSocket(t, server.URL, alice)
+			defer aliceConn.Close()
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			waitForDevices(t, client, server.URL, alice, bob.ID, 1)
+			waitForDevices(t, client, server.URL, bob, alice.ID, 1)
+
+			// Deleting for oneself hides the message from that participant only
+			deleteMessage(t, client, server.URL, bob, first.ID, "me", http.StatusNoContent)
+			frame := readWebSocketJSON(t, bobConn)
+			if frame["type"] != "message_deleted" || payloadOf(frame)["scope"] != "me" || payloadOf(frame)["message_id"] != first.ID {
+				t.Errorf("Expected Bob's device to get message_deleted for me, got %v", frame)
+			}
+			bobMessages := listChatMessages(t, client, server.URL, bob, chatID, 1, 10)
+			if bobMessages.TotalCount != 2 || len(bobMessages.Data.([]interface{})) != 2 {
+				t.Errorf("Expected Bob to see 2 messages, got %+v", bobMessages)
+			}
+			expectPageIDs(t, cursorPage(t, client, bob, server.URL+"/api/v1/chats/"+chatID+"/messages?direction=forward&page_size=1", http.StatusOK), second)
+			if aliceMessages := listChatMessages(t, client, server.URL, alice, chatID, 1, 10); aliceMessages.TotalCount != 3 {
+				t.Errorf("Expected Alice to still see 3 messages, got %d", aliceMessages.TotalCount)
+			} else {
+				t.Log("[OK] Deleting for me hides the message from the requester only")
+			}
+
+			// Only the sender may delete for everyone
+			deleteMessage(t, client, server.URL, bob, second.ID, "everyone", http.StatusForbidden)
+			deleteMessage(t, client, server.URL, carol, second.ID, "me", http.StatusForbidden)
+			deleteMessage(t, client, server.URL, alice, second.ID, "nobody", http.StatusBadRequest)
+			deleteMessage(t, client, server.URL, alice, "missing-message", "everyone", http.StatusNotFound)
+			t.Log("[OK] Deletions by others, unknown scopes and unknown messages are rejected")
+
+			// Deleting for everyone leaves a tombstone both participants are told about
+			deleteMessage(t, client, server.URL, alice, second.ID, "everyone", http.StatusNoContent)
+			for name, conn := range map[string]*websocket.Conn{"Alice": aliceConn, "Bob": bobConn} {
+				frame := readWebSocketJSON(t, conn)
+				payload := payloadOf(frame)
+				if frame["type"] != "message_deleted" || payload["scope"] != "everyone" || payload["message_id"] != second.ID || payload["deleted_at"] == nil {
+					t.Errorf("Expected %s to get message_deleted for everyone, got %v", name, frame)
+				}
+			}
+			tombstone := findMessage(t, client, server.URL, bob, chatID, second.ID)
+			if tombstone.Content != "" || tombstone.DeletedAt == nil || tombstone.Seq != second.Seq {
+				t.Errorf("Expected a tombstone with wiped content, got %+v", tombstone)
+			} else {
+				t.Log("[OK] Deleting for everyone replaces the message with a tombstone")
+			}
+			editMessage(t, client, server.URL, alice, second.ID, "Resurrected", http.StatusConflict)
+
+			// Deleting over WebSocket replies to the deleting device and notifies the other participant
+			writeEnvelope(t, aliceConn, "delete_message", "delete-1", map[string]string{"message_id": third.ID, "scope": "everyone"})
+			reply := readWebSocketJSON(t, aliceConn)
+			if reply["type"] != "message_deleted" || reply["id"] != "delete-1" || payloadOf(reply)["message_id"] != third.ID {
+				t.Errorf("Expected message_deleted reply to delete-1, got %v", reply)
+			}
+			if frame := readWebSocketJSON(t, bobConn); frame["type"] != "message_deleted" || payloadOf(frame)["message_id"] != third.ID {
+				t.Errorf("Expected Bob to get message_deleted, got %v", frame)
+			} else {
+				t.Log("[OK] Sender deletes a message over WebSocket")
+			}
+
+			// Tombstones drop their revisions, and retries of the original send still match
+			keyed := sendMessage(t, client, server.URL, alice, bob.ID, "Typo", "delete_key")
+			editMessage(t, client, server.URL, alice, keyed.ID, "Fixed", http.StatusOK)
+			deleteMessage(t, client, server.URL, alice, keyed.ID, "everyone", http.StatusNoContent)
+			if revisions := messageRevisions(t, client, server.URL, bob, keyed.ID, http.StatusOK); len(revisions) != 0 {
+				t.Errorf("Expected the revisions to be wiped, got %+v", revisions)
+			}
+			if retry := sendMessage(t, client, server.URL, alice, bob.ID, "Typo", "delete_key"); retry.ID != keyed.ID || retry.DeletedAt == nil {
+				t.Errorf("Expected the retry to return the tombstone, got %+v", retry)
+			} else {
+				t.Log("[OK] Tombstones keep no earlier contents")
+			}
+		})
+	}
+
+	// Outside the delete window messages can only be deleted for oneself
+	cfg := app.DefaultConfig()
+	cfg.DeleteWindow = 0
+	application := newTestApp(t, cfg)
+	server := httptest.NewServer(application.Handler())
+	defer server.Close()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	alice := createUser(t, client, server.URL, "alice_late")
+	bob := createUser(t, client, server.URL, "bob_late")
+	message := sendMessage(t, client, server.URL, alice, bob.ID, "Too late", "")
+	deleteMessage(t, client, server.URL, alice, message.ID, "everyone", http.StatusForbidden)
+	deleteMessage(t, client, server.URL, alice, message.ID, "me", http.StatusNoContent)
+	t.Log("[OK] Deleting for everyone outside the delete window is rejected")
+}
+
+// TestE2E_ReplyTo tests replies quoting an earlier message of the chat, and how their quotes follow
+// edits and deletions of the quoted message
+func TestE2E_ReplyTo(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.OfflineQueueLimit = 0 // only live messages should reach the sockets
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_reply")
+			bob := createUser(t, client, server.URL, "bob_reply")
+			carol := createUser(t, client, server.URL, "carol_reply")
+
+			original := sendMessage(t, client, server.URL, alice, bob.ID, "Lunch at noon?", "")
+			elsewhere := sendMessage(t, client, server.URL, carol, alice.ID, "Not your chat", "")
+
+			aliceConn := connectWebSocket(t, server.URL, alice)
+			defer aliceConn.Close()
+			waitForDevices(t, client, server.URL, bob, alice.ID, 1)
+
+			// A reply carries the quoted message's sender and snippet
+			reply := sendReply(t, client, server.URL, bob, alice.ID, "Sure!", original.ID, "reply_key", http.StatusCreated)
+			if reply.ReplyToID != original.ID || reply.Quoted == nil || reply.Quoted.SenderID != alice.ID || reply.Quoted.Snippet != "Lunch at noon?" {
+				t.Errorf("Expected the reply to quote the original message, got %+v", reply)
+			}
+			frame := readWebSocketJSON(t, aliceConn)
+			if quoted, _ := payloadOf(frame)["quoted"].(map[string]interface{}); frame["type"] != "message" || payloadOf(frame)["reply_to_id"] != original.ID || quoted["snippet"] != "Lunch at noon?" {
+				t.Errorf("Expected Alice to receive the reply with its quote, got %v", frame)
+			} else {
+				t.Log("[OK] Replies quote the message they reply to")
+			}
+
+			// Replies can only quote messages of their own chat
+			sendReply(t, client, server.URL, alice, bob.ID, "Wrong chat", elsewhere.ID, "", http.StatusBadRequest)
+			sendReply(t, client, server.URL, alice, bob.ID, "Nothing", "missing-message", "", http.StatusBadRequest)
+			sendReply(t, client, server.URL, bob, alice.ID, "Sure!", reply.ID, "reply_key", http.StatusConflict)
+			if retry := sendReply(t, client, server.URL, bob, alice.ID, "Sure!", original.ID, "reply_key", http.StatusOK); retry.ID != reply.ID {
+				t.Errorf("Expected the retry to return the reply %s, got %s", reply.ID, retry.ID)
+			}
+			t.Log("[OK] Replies to other chats or unknown messages are rejected")
+
+			// Long messages are quoted as a truncated snippet
+			long := sendMessage(t, client, server.URL, alice, bob.ID, strings.Repeat("a", 150), "")
+			longReply := sendReply(t, client, server.URL, bob, alice.ID, "Too long", long.ID, "", http.StatusCreated)
+			if snippet := []rune(longReply.Quoted.Snippet); len(snippet) != domain.MessagePreviewLength+1 || snippet[len(snippet)-1] != '…' {
+				t.Errorf("Expected a truncated snippet, got %q", longReply.Quoted.Snippet)
+			} else {
+				t.Log("[OK] Long quoted messages are truncated")
+			}
+
+			// Replying over WebSocket quotes the message as well
+			writeEnvelope(t, aliceConn, "send_message", "reply-1", map[string]string{"recipient_id": bob.ID, "content": "Great", "reply_to_id": reply.ID})
+			for {
+				ack := readWebSocketJSON(t, aliceConn)
+				if ack["type"] == "message_ack" && ack["id"] == "reply-1" {
+					break
+				}
+				if ack["type"] == "error" {
+					t.Fatalf("Expected the WebSocket reply to be accepted, got %v", ack)
+				}
+			}
+			messages := listChatMessages(t, client, server.URL, bob, original.ChatID, 1, 100).Data.([]interface{})
+			last := messages[len(messages)-1].(map[string]interface{})
+			if quoted, _ := last["quoted"].(map[string]interface{}); last["reply_to_id"] != reply.ID || quoted["snippet"] != "Sure!" {
+				t.Errorf("Expected the WebSocket reply to quote Bob's reply, got %v", last)
+			} else {
+				t.Log("[OK] Replies sent over WebSocket quote the message they reply to")
+			}
+
+			// Edits of the quoted message show up in its replies, deletions blank the quote
+			editMessage(t, client, server.URL, alice, original.ID, "Lunch at one?", http.StatusOK)
+			if quoted := findMessage(t, client, server.URL, bob, original.ChatID, reply.ID).Quoted; quoted == nil || quoted.Snippet != "Lunch at one?" || quoted.Deleted {
+				t.Errorf("Expected the quote to follow the edit, got %+v", quoted)
+			} else {
+				t.Log("[OK] Quotes follow edits of the quoted message")
+			}
+
+			deleteMessage(t, client, server.URL, alice, original.ID, "everyone", http.StatusNoContent)
+			if quoted := findMessage(t, client, server.URL, alice, original.ChatID, reply.ID).Quoted; quoted == nil || quoted.Snippet != "" || !quoted.Deleted {
+				t.Errorf("Expected the quote of a deleted message to be blanked, got %+v", quoted)
+			}
+			late := sendReply(t, client, server.URL, bob, alice.ID, "Too late", original.ID, "", http.StatusCreated)
+			if late.Quoted == nil || late.Quoted.Snippet != "" || !late.Quoted.Deleted {
+				t.Errorf("Expected a reply to a deleted message to quote it as deleted, got %+v", late.Quoted)
+			} else {
+				t.Log("[OK] Quotes of deleted messages are blanked")
+			}
+		})
+	}
+}
+
+// TestE2E_Reactions tests adding and removing emoji reactions over REST and WebSocket, their
+// aggregation in message listings and the live events both participants receive
+func TestE2E_Reactions(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.OfflineQueueLimit = 0 // only reaction events should reach the sockets
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_react")
+			bob := createUser(t, client, server.URL, "bob_react")
+			carol := createUser(t, client, server.URL, "carol_react")
+
+			message := sendMessage(t, client, server.URL, alice, bob.ID, "Shipped it!", "")
+
+			aliceConn := connectWebSocket(t, server.URL, alice)
+			defer aliceConn.Close()
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			waitForDevices(t, client, server.URL, alice, bob.ID, 1)
+			waitForDevices(t, client, server.URL, bob, alice.ID, 1)
+
+			expectReactionEvent := func(conn *websocket.Conn, eventType, userID, emoji string) {
+				t.Helper()
+				frame := readWebSocketJSON(t, conn)
+				payload := payloadOf(frame)
+				if frame["type"] != eventType || payload["message_id"] != message.ID || payload["user_id"] != userID || payload["emoji"] != emoji {
+					t.Errorf("Expected %s of %s by %s, got %v", eventType, emoji, userID, frame)
+				}
+			}
+
+			// A reaction is pushed to both participants' devices
+			reacted := react(t, client, server.URL, bob, "POST", message.ID, "👍", http.StatusOK)
+			expectReactions(t, reacted, domain.ReactionSummary{Emoji: "👍", Count: 1, UserIDs: []string{bob.ID}})
+			expectReactionEvent(aliceConn, "reaction_added", bob.ID, "👍")
+			expectReactionEvent(bobConn, "reaction_added", bob.ID, "👍")
+			t.Log("[OK] Reactions are pushed to both participants")
+
+			// Reacting twice with the same emoji changes nothing; both participants may use it
+			expectReactions(t, react(t, client, server.URL, bob, "POST", message.ID, "👍", http.StatusOK),
+				domain.ReactionSummary{Emoji: "👍", Count: 1, UserIDs: []string{bob.ID}})
+			react(t, client, server.URL, alice, "POST", message.ID, "👍", http.StatusOK)
+			expectReactionEvent(aliceConn, "reaction_added", alice.ID, "👍")
+			expectReactionEvent(bobConn, "reaction_added", alice.ID, "👍")
+
+			// Reacting over WebSocket replies to the reacting device
+			writeEnvelope(t, aliceConn, "add_reaction", "react-1", map[string]string{"message_id": message.ID, "emoji": "❤️"})
+			reply := readWebSocketJSON(t, aliceConn)
+			if reply["type"] != "reaction_added" || reply["id"] != "react-1" || len(payloadOf(reply)["reactions"].([]interface{})) != 2 {
+				t.Errorf("Expected reaction_added reply to react-1 with 2 emoji, got %v", reply)
+			}
+			expectReactionEvent(bobConn, "reaction_added", alice.ID, "❤️")
+
+			// Listings aggregate reactions per emoji, in the order each emoji was first used
+			expectReactions(t, findMessage(t, client, server.URL, bob, message.ChatID, message.ID),
+				domain.ReactionSummary{Emoji: "👍", Count: 2, UserIDs: []string{bob.ID, alice.ID}},
+				domain.ReactionSummary{Emoji: "❤️", Count: 1, UserIDs: []string{alice.ID}})
+			t.Log("[OK] Message listings aggregate reactions per emoji")
+
+			// Removing a reaction leaves the others
+			expectReactions(t, react(t, client, server.URL, bob, "DELETE", message.ID, "👍", http.StatusOK),
+				domain.ReactionSummary{Emoji: "👍", Count: 1, UserIDs: []string{alice.ID}},
+				domain.ReactionSummary{Emoji: "❤️", Count: 1, UserIDs: []string{alice.ID}})
+			expectReactionEvent(aliceConn, "reaction_removed", bob.ID, "👍")
+			expectReactionEvent(bobConn, "reaction_removed", bob.ID, "👍")
+			react(t, client, server.URL, bob, "DELETE", message.ID, "👍", http.StatusOK)
+			t.Log("[OK] Reactions can be taken back")
+
+			// Only single emoji from participants are accepted
+			react(t, client, server.URL, bob, "POST", message.ID, "ok", http.StatusBadRequest)
+			react(t, client, server.URL, bob, "POST", message.ID, " 👍", http.StatusBadRequest)
+			react(t, client, server.URL, bob, "POST", message.ID, "", http.StatusBadRequest)
+			react(t, client, server.URL, carol, "POST", message.ID, "👍", http.StatusForbidden)
+			react(t, client, server.URL, bob, "POST", "missing-message", "👍", http.StatusNotFound)
+			for _, emoji := range []string{"👍🏽", "👨‍👩‍👧", "🇺🇸", "1️⃣"} {
+				react(t, client, server.URL, bob, "POST", message.ID, emoji, http.StatusOK)
+			}
+			t.Log("[OK] Invalid reactions and reactions of non-participants are rejected")
+
+			// The change log records reactions
+			added, removed := 0, 0
+			for _, change := range syncChanges(t, client, server.URL, alice, "", 500, http.StatusOK).Changes {
+				switch change.Type {
+				case domain.ChangeReactionAdded:
+					added++
+				case domain.ChangeReactionRemoved:
+					removed++
+				}
+			}
+			if added != 7 || removed != 1 {
+				t.Errorf("Expected 7 reaction_added and 1 reaction_removed changes, got %d and %d", added, removed)
+			}
+
+			// Deleting a message for everyone drops its reactions
+			deleteMessage(t, client, server.URL, alice, message.ID, "everyone", http.StatusNoContent)
+			if tombstone := findMessage(t, client, server.URL, bob, message.ChatID, message.ID); len(tombstone.Reactions) != 0 {
+				t.Errorf("Expected the tombstone to have no reactions, got %+v", tombstone.Reactions)
+			}
+			react(t, client, server.URL, bob, "POST", message.ID, "👍", http.StatusConflict)
+			t.Log("[OK] Deleted messages lose their reactions")
+		})
+	}
+}
+
+// TestE2E_GroupChats tests creating group chats, sending to them over REST and WebSocket with fan-out
+// to every member, read watermarks, and managing members, roles and the title
+func TestE2E_GroupChats(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.OfflineQueueLimit = 0 // only live events should reach the sockets
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_group")
+			bob := createUser(t, client, server.URL, "bob_group")
+			carol := createUser(t, client, server.URL, "carol_group")
+			dave := createUser(t, client, server.URL, "dave_group")
+			eve := createUser(t, client, server.URL, "eve_group")
+
+			chatsURL := server.URL + "/api/v1/chats"
+
+			// The creator owns the group; duplicate members and the creator are listed once
+			chat := chatRequest(t, client, alice, "POST", chatsURL, map[string]interface{}{
+				"title":      "  Launch crew ",
+				"member_ids": []string{bob.ID, carol.ID, bob.ID, alice.ID},
+			}, http.StatusCreated)
+			if chat.Type != domain.ChatGroup || chat.Title != "Launch crew" {
+				t.Errorf("Expected group chat titled Launch crew, got %s %q", chat.Type, chat.Title)
+			}
+			expectMembers(t, chat, alice.ID, domain.RoleOwner, bob.ID, domain.RoleMember, carol.ID, domain.RoleMember)
+			chatRequest(t, client, alice, "POST", chatsURL, map[string]interface{}{"title": " "}, http.StatusBadRequest)
+			chatRequest(t, client, alice, "POST", chatsURL, map[string]interface{}{"title": "Ghosts", "member_ids": []string{"missing-user"}}, http.StatusNotFound)
+			t.Log("[OK] Group chats are created with an owner, members and a title")
+
+			chatURL := chatsURL + "/" + chat.ID
+			aliceConn := connectWebSocket(t, server.URL, alice)
+			defer aliceConn.Close()
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			carolConn := connectWebSocket(t, server.URL, carol)
+			defer carolConn.Close()
+			for _, user := range []*testUser{alice, bob, carol} {
+				waitForDevices(t, client, server.URL, user, user.ID, 1)
+			}
+
+			expectEvent := func(conn *websocket.Conn, eventType string) map[string]interface{} {
+				t.Helper()
+				frame := readWebSocketJSON(t, conn)
+				if frame["type"] != eventType {
+					t.Fatalf("Expected %s event, got %v", eventType, frame)
+				}
+				return payloadOf(frame)
+			}
+
+			// A message sent to the chat reaches every member's devices and keeps the "sent" status
+			first := sendToChat(t, client, server.URL, alice, chat.ID, "Liftoff at noon", http.StatusCreated)
+			if first.ChatID != chat.ID || first.Status != domain.StatusSent {
+				t.Errorf("Expected a sent message in %s, got %+v", chat.ID, first)
+			}
+			for _, conn := range []*websocket.Conn{bobConn, carolConn, aliceConn} {
+				if payload := expectEvent(conn, "message"); payload["id"] != first.ID {
+					t.Errorf("Expected message %s, got %v", first.ID, payload)
+				}
+			}
+
+			writeEnvelope(t, bobConn, "send_message", "group-1", map[string]string{"chat_id": chat.ID, "content": "Copy that"})
+			ack := expectEvent(bobConn, "message_ack")
+			for _, conn := range []*websocket.Conn{aliceConn, carolConn} {
+				if payload := expectEvent(conn, "message"); payload["id"] != ack["message_id"] {
+					t.Errorf("Expected message %v, got %v", ack["message_id"], payload)
+				}
+			}
+			t.Log("[OK] Group messages fan out to every member over REST and WebSocket")
+
+			// Only members may send to or read the chat, and a message has one destination
+			sendToChat(t, client, server.URL, eve, chat.ID, "Let me in", http.StatusForbidden)
+			sendToChat(t, client, server.URL, alice, "missing-chat", "Hello?", http.StatusNotFound)
+			resp, err := doRequest(client, "POST", server.URL+"/api/v1/messages", alice.Token, map[string]string{
+				"chat_id": chat.ID, "recipient_id": bob.ID, "content": "Both",
+			})
+			if err != nil {
+				t.Fatalf("Failed to send message: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for chat_id and recipient_id, got %d", resp.StatusCode)
+			}
+			chatRequest(t, client, eve, "GET", chatURL, nil, http.StatusForbidden)
+			t.Log("[OK] Non-members cannot use the group")
+
+			// Unread counts follow each member's read watermark; marking read tells every member
+			if unread := chatUnreadCount(t, client, server.URL, carol, chat.ID); unread != 2 {
+				t.Errorf("Expected 2 unread messages for carol, got %d", unread)
+			}
+			if unread := chatUnreadCount(t, client, server.URL, bob, chat.ID); unread != 1 {
+				t.Errorf("Expected 1 unread message for bob, got %d", unread)
+			}
+			markChatRead(t, client, server.URL, carol, chat.ID, ack["message_id"].(string), http.StatusOK)
+			for _, conn := range []*websocket.Conn{aliceConn, bobConn, carolConn} {
+				if payload := expectEvent(conn, "chat_read"); payload["user_id"] != carol.ID {
+					t.Errorf("Expected carol's chat_read, got %v", payload)
+				}
+			}
+			if unread := chatUnreadCount(t, client, server.URL, carol, chat.ID); unread != 0 {
+				t.Errorf("Expected no unread messages for carol, got %d", unread)
+			}
+
+			// Group messages have no per-message status
+			writeEnvelope(t, bobConn, "mark_read", "group-2", map[string]string{"message_id": first.ID})
+			if payload := expectEvent(bobConn, "error"); payload["code"] != "validation_failed" {
+				t.Errorf("Expected validation_failed, got %v", payload)
+			}
+			t.Log("[OK] Group reads move watermarks instead of message statuses")
+
+			// Owners and admins manage members; new members start with nothing unread
+			membersURL := chatURL + "/members"
+			chatRequest(t, client, bob, "POST", membersURL, map[string]string{"user_id": dave.ID}, http.StatusForbidden)
+			chat = chatRequest(t, client, alice, "POST", membersURL, map[string]string{"user_id": dave.ID}, http.StatusOK)
+			expectMembers(t, chat, alice.ID, domain.RoleOwner, bob.ID, domain.RoleMember, carol.ID, domain.RoleMember, dave.ID, domain.RoleMember)
+			chatRequest(t, client, alice, "POST", membersURL, map[string]string{"user_id": dave.ID}, http.StatusConflict)
+			for _, conn := range []*websocket.Conn{aliceConn, bobConn, carolConn} {
+				expectEvent(conn, "chat_updated")
+			}
+			if unread := chatUnreadCount(t, client, server.URL, dave, chat.ID); unread != 0 {
+				t.Errorf("Expected no unread messages for dave, got %d", unread)
+			}
+			if history := listChatMessages(t, client, server.URL, dave, chat.ID, 1, 50); history.TotalCount != 2 {
+				t.Errorf("Expected dave to see 2 earlier messages, got %d", history.TotalCount)
+			}
+			t.Log("[OK] Members can be added and see the history")
+
+			// Only the owner changes roles; admins remove plain members but not the owner
+			chatRequest(t, client, alice, "PATCH", membersURL+"/"+bob.ID, map[string]string{"role": "owner"}, http.StatusBadRequest)
+			chat = chatRequest(t, client, alice, "PATCH", membersURL+"/"+bob.ID, map[string]string{"role": "admin"}, http.StatusOK)
+			expectMembers(t, chat, alice.ID, domain.RoleOwner, bob.ID, domain.RoleAdmin, carol.ID, domain.RoleMember, dave.ID, domain.RoleMember)
+			chatRequest(t, client, bob, "PATCH", membersURL+"/"+carol.ID, map[string]string{"role": "admin"}, http.StatusForbidden)
+			chatRequest(t, client, bob, "DELETE", membersURL+"/"+alice.ID, nil, http.StatusForbidden)
+			chatRequest(t, client, bob, "DELETE", membersURL+"/"+eve.ID, nil, http.StatusNotFound)
+			for _, conn := range []*websocket.Conn{aliceConn, bobConn, carolConn} {
+				expectEvent(conn, "chat_updated")
+			}
+
+			chat = chatRequest(t, client, bob, "DELETE", membersURL+"/"+carol.ID, nil, http.StatusOK)
+			expectMembers(t, chat, alice.ID, domain.RoleOwner, bob.ID, domain.RoleAdmin, dave.ID, domain.RoleMember)
+			for _, conn := range []*websocket.Conn{aliceConn, bobConn, carolConn} {
+				expectEvent(conn, "chat_updated")
+			}
+			chatRequest(t, client, carol, "GET", chatURL, nil, http.StatusForbidden)
+			sendToChat(t, client, server.URL, carol, chat.ID, "Still here?", http.StatusForbidden)
+			for _, item := range listUserChats(t, client, server.URL, carol, 1, 100).Data.([]interface{}) {
+				if item.(map[string]interface{})["id"] == chat.ID {
+					t.Errorf("Expected the group to leave carol's chat list")
+				}
+			}
+			last := syncChanges(t, client, server.URL, carol, "", 500, http.StatusOK).Changes
+			if change := last[len(last)-1]; change.Type != domain.ChangeMemberRemoved || change.UserID != carol.ID {
+				t.Errorf("Expected carol's removal last in her change log, got %+v", change)
+			}
+			t.Log("[OK] Roles are enforced and removed members lose access")
+
+			// When the owner leaves, the longest-standing admin takes over
+			resp, err = doRequest(client, "POST", chatURL+"/leave", alice.Token, nil)
+			if err != nil {
+				t.Fatalf("Failed to leave chat: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("Expected status 204 for leaving, got %d", resp.StatusCode)
+			}
+			expectEvent(aliceConn, "chat_updated")
+			expectEvent(bobConn, "chat_updated")
+			chat = chatRequest(t, client, bob, "GET", chatURL, nil, http.StatusOK)
+			expectMembers(t, chat, bob.ID, domain.RoleOwner, dave.ID, domain.RoleMember)
+			t.Log("[OK] Ownership passes on when the owner leaves")
+
+			// The title can be changed by the owner; new messages are unread for the other members
+			chat = chatRequest(t, client, bob, "PATCH", chatURL, map[string]string{"title": "Mission control"}, http.StatusOK)
+			if chat.Title != "Mission control" {
+				t.Errorf("Expected the new title, got %q", chat.Title)
+			}
+			chatRequest(t, client, dave, "PATCH", chatURL, map[string]string{"title": "Dave's"}, http.StatusForbidden)
+			sendToChat(t, client, server.URL, bob, chat.ID, "Welcome aboard", http.StatusCreated)
+			if unread := chatUnreadCount(t, client, server.URL, dave, chat.ID); unread != 1 {
+				t.Errorf("Expected 1 unread message for dave, got %d", unread)
+			}
+			t.Log("[OK] Group titles can be changed")
+
+			// 1:1 chats keep working and have no title or members to manage
+			direct := sendMessage(t, client, server.URL, alice, bob.ID, "Thanks for taking over", "")
+			directChat := chatRequest(t, client, bob, "GET", chatsURL+"/"+direct.ChatID, nil, http.StatusOK)
+			if directChat.Type != domain.ChatDirect || directChat.Members != nil {
+				t.Errorf("Expected a direct chat without members, got %+v", directChat)
+			}
+			chatRequest(t, client, bob, "PATCH", chatsURL+"/"+direct.ChatID, map[string]string{"title": "Us"}, http.StatusBadRequest)
+			chatRequest(t, client, bob, "POST", chatsURL+"/"+direct.ChatID+"/members", map[string]string{"user_id": dave.ID}, http.StatusBadRequest)
+			t.Log("[OK] 1:1 chats are unaffected")
+
+			expectNoFrame(t, carolConn)
+		})
+	}
+}
+
+// TestE2E_RemovedMemberMessages tests that members removed from a group can no longer edit or
+// delete the messages they sent there, nor be seen online by the group
+func TestE2E_RemovedMemberMessages(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_removed")
+			bob := createUser(t, client, server.URL, "bob_removed")
+
+			chatsURL := server.URL + "/api/v1/chats"
+			chat := chatRequest(t, client, alice, "POST", chatsURL, map[string]interface{}{"title": "Crew", "member_ids": []string{bob.ID}}, http.StatusCreated)
+			message := sendToChat(t, client, server.URL, bob, chat.ID, "Count me in", http.StatusCreated)
+			editMessage(t, client, server.URL, bob, message.ID, "Count me in!", http.StatusOK)
+			onlineDevices(t, client, server.URL, alice, bob.ID)
+
+			chatRequest(t, client, alice, "DELETE", chatsURL+"/"+chat.ID+"/members/"+bob.ID, nil, http.StatusOK)
+			resp, err := doRequest(client, "GET", server.URL+"/api/v1/users/"+bob.ID+"/devices", alice.Token, nil)
+			if err != nil {
+				t.Fatalf("Failed to list devices: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("Expected status 403 for the devices of a removed member, got %d", resp.StatusCode)
+			}
+			editMessage(t, client, server.URL, bob, message.ID, "Never mind", http.StatusForbidden)
+			deleteMessage(t, client, server.URL, bob, message.ID, "everyone", http.StatusForbidden)
+			deleteMessage(t, client, server.URL, bob, message.ID, "me", http.StatusForbidden)
+
+			if stored := findMessage(t, client, server.URL, alice, chat.ID, message.ID); stored.Content != "Count me in!" || stored.DeletedAt != nil {
+				t.Errorf("Expected the removed member's message to stay unchanged, got %+v", stored)
+			} else {
+				t.Log("[OK] Removed members cannot edit or delete their messages")
+			}
+		})
+	}
+}
+
+// TestE2E_Attachments tests uploading files and images, sending them in messages over REST and
+// WebSocket, and who may download them and their thumbnails
+func TestE2E_Attachments(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.BlobPath = t.TempDir()
+			cfg.MaxAttachmentSize = 64 << 10
+			cfg.OfflineQueueLimit = 0 // only live messages should reach the sockets
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_files")
+			bob := createUser(t, client, server.URL, "bob_files")
+			carol := createUser(t, client, server.URL, "carol_files")
+
+			// Images are detected from their content and measured, whatever their file name says
+			var picture bytes.Buffer
+			png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 640, 480)))
+			photo := uploadAttachment(t, client, server.URL, alice, "../holiday.jpg", picture.Bytes(), http.StatusCreated)
+			if photo.Kind != domain.AttachmentImage || photo.ContentType != "image/png" || photo.FileName != "holiday.jpg" ||
+				photo.Width != 640 || photo.Height != 480 || photo.ThumbnailURL == "" {
+				t.Errorf("Expected a 640x480 PNG image with a thumbnail, got %+v", photo)
+			}
+			notes := uploadAttachment(t, client, server.URL, alice, "notes.txt", []byte("Packing list: towel"), http.StatusCreated)
+			if notes.Kind != domain.AttachmentFile || notes.ContentType != "text/plain" || notes.Size != 19 || notes.ThumbnailURL != "" {
+				t.Errorf("Expected a plain text file without thumbnail, got %+v", notes)
+			}
+			t.Log("[OK] Files and images are uploaded with their detected type")
+
+			uploadAttachment(t, client, server.URL, alice, "tool.bin", []byte{0x7f, 'E', 'L', 'F', 0, 1, 2}, http.StatusUnsupportedMediaType)
+			uploadAttachment(t, client, server.URL, alice, "huge.txt", bytes.Repeat([]byte("a"), 64<<10+1), http.StatusRequestEntityTooLarge)
+			uploadAttachment(t, client, server.URL, alice, "empty.txt", nil, http.StatusBadRequest)
+			t.Log("[OK] Unsupported, oversized and empty uploads are rejected")
+
+			// Until it is sent, only the uploader can see an attachment
+			downloadAttachment(t, client, server.URL+photo.URL, alice, http.StatusOK)
+			downloadAttachment(t, client, server.URL+photo.URL, bob, http.StatusNotFound)
+			t.Log("[OK] Unsent attachments are private to their uploader")
+
+			// Attachments may make up the whole message
+			message := sendAttachments(t, client, server.URL, alice, bob.ID, "", "files_key", []string{photo.ID, notes.ID}, http.StatusCreated)
+			if len(message.Attachments) != 2 || message.Attachments[0].ID != photo.ID || message.Attachments[1].ID != notes.ID || message.Attachments[0].MessageID != message.ID {
+				t.Fatalf("Expected the message to carry both attachments in order, got %+v", message.Attachments)
+			}
+			if retry := sendAttachments(t, client, server.URL, alice, bob.ID, "", "files_key", []string{photo.ID, notes.ID}, http.StatusOK); retry.ID != message.ID {
+				t.Errorf("Expected the retry to return message %s, got %s", message.ID, retry.ID)
+			}
+			sendAttachments(t, client, server.URL, alice, bob.ID, "", "files_key", []string{photo.ID}, http.StatusConflict)
+			if listed := findMessage(t, client, server.URL, bob, message.ChatID, message.ID); len(listed.Attachments) != 2 || listed.Attachments[1].FileName != "notes.txt" {
+				t.Errorf("Expected the listed message to carry both attachments, got %+v", listed.Attachments)
+			}
+			if preview := chatPreview(t, client, server.URL, bob, message.ChatID); preview["attachment_count"] != float64(2) {
+				t.Errorf("Expected the chat preview to count 2 attachments, got %v", preview)
+			}
+			t.Log("[OK] Messages carry their attachments")
+
+			// Reacting returns the message with its attachments, like listings do
+			reacted := react(t, client, server.URL, bob, "POST", message.ID, "👍", http.StatusOK)
+			if len(reacted.Attachments) != 2 || len(reacted.Reactions) != 1 {
+				t.Errorf("Expected the reacted message to keep both attachments, got %+v", reacted)
+			}
+			if unreacted := react(t, client, server.URL, bob, "DELETE", message.ID, "👍", http.StatusOK); len(unreacted.Attachments) != 2 || len(unreacted.Reactions) != 0 {
+				t.Errorf("Expected the message to keep both attachments after removing the reaction, got %+v", unreacted)
+			} else {
+				t.Log("[OK] Reactions return messages with their attachments")
+			}
+
+			// An attachment belongs to a single message of its uploader
+			sendAttachments(t, client, server.URL, alice, bob.ID, "Again", "", []string{photo.ID}, http.StatusBadRequest)
+			foreign := uploadAttachment(t, client, server.URL, carol, "carol.txt", []byte("Hi"), http.StatusCreated)
+			sendAttachments(t, client, server.URL, alice, bob.ID, "Stolen", "", []string{foreign.ID}, http.StatusBadRequest)
+			sendAttachments(t, client, server.URL, alice, bob.ID, "Lost", "", []string{"missing-attachment"}, http.StatusBadRequest)
+			tooMany := make([]string, domain.MaxMessageAttachments+1)
+			for i := range tooMany {
+				tooMany[i] = foreign.ID
+			}
+			sendAttachments(t, client, server.URL, carol, bob.ID, "Flood", "", tooMany, http.StatusBadRequest)
+			t.Log("[OK] Sent, foreign, unknown and too many attachments are rejected")
+
+			// Participants download the content, inline for images; outsiders are forbidden
+			header, content := downloadAttachment(t, client, server.URL+photo.URL, bob, http.StatusOK)
+			if !bytes.Equal(content, picture.Bytes()) || header.Get("Content-Type") != "image/png" ||
+				!strings.HasPrefix(header.Get("Content-Disposition"), "inline") || header.Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("Expected the original PNG inline, got %v", header)
+			}
+			header, _ = downloadAttachment(t, client, server.URL+notes.URL, bob, http.StatusOK)
+			if header.Get("Content-Disposition") != `attachment; filename=notes.txt` {
+				t.Errorf("Expected the text file as a download, got %q", header.Get("Content-Disposition"))
+			}
+			downloadAttachment(t, client, server.URL+photo.URL, carol, http.StatusForbidden)
+			downloadAttachment(t, client, server.URL+"/api/v1/attachments/missing-attachment", bob, http.StatusNotFound)
+			t.Log("[OK] Attachments are downloaded by chat participants only")
+
+			header, content = downloadAttachment(t, client, server.URL+photo.ThumbnailURL, bob, http.StatusOK)
+			if config, format, err := image.DecodeConfig(bytes.NewReader(content)); err != nil || format != "jpeg" ||
+				config.Width != 320 || config.Height != 240 || header.Get("Content-Type") != "image/jpeg" {
+				t.Errorf("Expected a 320x240 JPEG thumbnail, got %s %dx%d (%v)", format, config.Width, config.Height, err)
+			}
+			downloadAttachment(t, client, server.URL+notes.URL+"/thumbnail", bob, http.StatusNotFound)
+			downloadAttachment(t, client, server.URL+photo.ThumbnailURL, carol, http.StatusForbidden)
+			t.Log("[OK] Image thumbnails are downloaded scaled down as JPEG")
+
+			// Attachments can be sent over WebSocket too
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			aliceConn := connectWebSocket(t, server.URL, alice)
+			defer aliceConn.Close()
+			waitForDevices(t, client, server.URL, bob, bob.ID, 1)
+
+			receipt := uploadAttachment(t, client, server.URL, alice, "receipt.txt", []byte("Paid"), http.StatusCreated)
+			writeEnvelope(t, aliceConn, "send_message", "files-1", map[string]interface{}{"recipient_id": bob.ID, "attachment_ids": []string{receipt.ID}})
+			frame := readWebSocketJSON(t, bobConn)
+			if attachments, _ := payloadOf(frame)["attachments"].([]interface{}); frame["type"] != "message" || len(attachments) != 1 ||
+				attachments[0].(map[string]interface{})["url"] != receipt.URL {
+				t.Errorf("Expected Bob to receive the message with its attachment, got %v", frame)
+			} else {
+				t.Log("[OK] Attachments sent over WebSocket reach the recipient")
+			}
+
+			// Deleting the message for everyone deletes its attachments
+			deleteMessage(t, client, server.URL, alice, message.ID, "everyone", http.StatusNoContent)
+			if listed := findMessage(t, client, server.URL, bob, message.ChatID, message.ID); len(listed.Attachments) != 0 {
+				t.Errorf("Expected the deleted message to have no attachments, got %+v", listed.Attachments)
+			}
+			downloadAttachment(t, client, server.URL+photo.URL, bob, http.StatusNotFound)
+			downloadAttachment(t, client, server.URL+photo.ThumbnailURL, alice, http.StatusNotFound)
+			t.Log("[OK] Attachments are deleted with their message")
+		})
+	}
+}
+
+// TestE2E_UnsentAttachmentsExpire tests that uploads which are not sent within the attachment TTL
+// are deleted with their content, while sent ones are kept
+func TestE2E_UnsentAttachmentsExpire(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.BlobPath = t.TempDir()
+			cfg.AttachmentTTL = 500 * time.Millisecond
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_expiry")
+			bob := createUser(t, client, server.URL, "bob_expiry")
+
+			var picture bytes.Buffer
+			png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 64, 64)))
+			unsent := uploadAttachment(t, client, server.URL, alice, "draft.png", picture.Bytes(), http.StatusCreated)
+			sent := uploadAttachment(t, client, server.URL, alice, "sent.txt", []byte("Keep me"), http.StatusCreated)
+			sendAttachments(t, client, server.URL, alice, bob.ID, "", "", []string{sent.ID}, http.StatusCreated)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				resp, err := doRequest(client, "GET", server.URL+unsent.URL, alice.Token, nil)
+				if err != nil {
+					t.Fatalf("Failed to download %s: %v", unsent.URL, err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusNotFound {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected the unsent attachment to expire, still got status %d", resp.StatusCode)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			sendAttachments(t, client, server.URL, alice, bob.ID, "Too late", "", []string{unsent.ID}, http.StatusBadRequest)
+			t.Log("[OK] Unsent attachments expire")
+
+			downloadAttachment(t, client, server.URL+sent.URL, bob, http.StatusOK)
+			if blobs, _ := filepath.Glob(filepath.Join(cfg.BlobPath, "*", "*")); len(blobs) != 1 {
+				t.Errorf("Expected only the sent attachment's blob to remain, got %v", blobs)
+			} else {
+				t.Log("[OK] Sent attachments and their content are kept")
+			}
+		})
+	}
+}
+
+// TestE2E_OfflineQueue tests that messages sent while a user is offline are pushed in order when
+// they connect, with the overflow beyond the configured limit left to the REST fallback
+func TestE2E_OfflineQueue(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+			cfg.OfflineQueueLimit = 2
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_offline")
+			bob := createUser(t, client, server.URL, "bob_offline")
+
+			// Bob is offline while Alice sends three messages
+			var sent []*domain.Message
+			for i := 1; i <= 3; i++ {
+				sent = append(sent, sendMessage(t, client, server.URL, alice, bob.ID, fmt.Sprintf("Offline %d", i), ""))
+			}
+			chatID := sent[0].ChatID
+			for _, msg := range sent {
+				if status := messageStatus(t, client, server.URL, alice, chatID, msg.ID); status != domain.StatusSent {
+					t.Errorf("Expected message %s to stay sent while Bob is offline, got %s", msg.ID, status)
+				}
+			}
+
+			// On connect Bob gets the two oldest messages in order, then an overflow notice
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+
+			for _, msg := range sent[:2] {
+				frame := readWebSocketJSON(t, bobConn)
+				if frame["type"] != "message" || payloadOf(frame)["id"] != msg.ID {
+					t.Errorf("Expected queued message %s, got %v", msg.ID, frame)
+				}
+			}
+			overflow := readWebSocketJSON(t, bobConn)
+			if overflow["type"] != "undelivered_overflow" || payloadOf(overflow)["remaining"] != float64(1) {
+				t.Errorf("Expected undelivered_overflow with 1 remaining, got %v", overflow)
+			} else {
+				t.Log("[OK] Offline queue flushed in order up to the limit")
+			}
+
+			for _, msg := range sent[:2] {
+				waitForStatus(t, client, server.URL, alice, chatID, msg.ID, domain.StatusDelivered)
+			}
+			if status := messageStatus(t, client, server.URL, alice, chatID, sent[2].ID); status != domain.StatusSent {
+				t.Errorf("Expected overflow message to stay sent, got %s", status)
+			}
+
+			// The REST fallback hands out the rest and marks it delivered
+			resp, err := doRequest(client, "GET", server.URL+"/api/v1/messages/undelivered", bob.Token, nil)
+			if err != nil {
+				t.Fatalf("Failed to fetch undelivered messages: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var undelivered struct {
+				Data      []*domain.Message `json:"data"`
+				Remaining int               `json:"remaining"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&undelivered); err != nil {
+				t.Fatalf("Failed to decode undelivered messages: %v", err)
+			}
+			if len(undelivered.Data) != 1 || undelivered.Data[0].ID != sent[2].ID || undelivered.Remaining != 0 {
+				t.Errorf("Expected only message %s from the fallback, got %+v", sent[2].ID, undelivered)
+			} else {
+				t.Log("[OK] REST fallback returned the overflow")
+			}
+			waitForStatus(t, client, server.URL, alice, chatID, sent[2].ID, domain.StatusDelivered)
+
+			// Nothing is pushed again on reconnect
+			bobConn.Close()
+			waitForDevices(t, client, server.URL, alice, bob.ID, 0)
+			bobConn = connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			expectNoFrame(t, bobConn)
+		})
+	}
+}
+
+// TestE2E_OfflineQueueWithLiveMessages tests that messages sent while the offline queue is being
+// flushed reach the device once each, after the queued ones
+func TestE2E_OfflineQueueWithLiveMessages(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			alice := createUser(t, client, server.URL, "alice_flush")
+			bob := createUser(t, client, server.URL, "bob_flush")
+
+			const queued, live = 20, 20
+			for i := 1; i <= queued; i++ {
+				sendMessage(t, client, server.URL, alice, bob.ID, fmt.Sprintf("Queued %d", i), "")
+			}
+
+			// Alice keeps sending while Bob connects and his queue is flushed
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 1; i <= live; i++ {
+					if _, err := sendMessageWithError(client, server.URL, alice, bob.ID, fmt.Sprintf("Live %d", i), ""); err != nil {
+						t.Errorf("Failed to send live message: %v", err)
+						return
+					}
+				}
+			}()
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			wg.Wait()
+
+			var lastSeq float64
+			seen := make(map[interface{}]bool)
+			for len(seen) < queued+live {
+				frame := readWebSocketJSON(t, bobConn)
+				if frame["type"] != "message" {
+					continue
+				}
+				payload := payloadOf(frame)
+				if seen[payload["id"]] {
+					t.Fatalf("Message %v was pushed twice", payload["id"])
+				}
+				if seq := payload["seq"].(float64); seq <= lastSeq {
+					t.Errorf("Expected messages in order, got seq %v after %v", seq, lastSeq)
+				} else {
+					lastSeq = seq
+				}
+				seen[payload["id"]] = true
+			}
+			expectNoFrame(t, bobConn)
+			t.Log("[OK] Live messages follow the offline queue once each")
+		})
+	}
+}
+
+// TestE2E_CloseDisconnectsClients tests that closing the application stops the WebSocket hub:
+// connected devices are disconnected and later connections are closed right away
+func TestE2E_CloseDisconnectsClients(t *testing.T) {
+	for _, driver := range []string{app.StorageMemory, app.StorageSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			cfg := app.DefaultConfig()
+			cfg.StorageDriver = driver
+			cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+			application := newTestApp(t, cfg)
+			server := httptest.NewServer(application.Handler())
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			bob := createUser(t, client, server.URL, "bob_close")
+
+			bobConn := connectWebSocket(t, server.URL, bob)
+			defer bobConn.Close()
+			waitForDevices(t, client, server.URL, bob, bob.ID, 1)
+
+			closed := make(chan error, 1)
+			go func() { closed <- application.Close() }()
+			select {
+			case err := <-closed:
+				if err != nil {
+					t.Errorf("Failed to close application: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Closing the application did not return")
+			}
+
+			expectClosed := func(conn *websocket.Conn) {
+				t.Helper()
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, _, err := conn.ReadMessage()
+				if _, ok := err.(*websocket.CloseError); !ok {
+					t.Errorf("Expected the connection to be closed, got %v", err)
+				}
+			}
+			expectClosed(bobConn)
+			t.Log("[OK] Closing the application disconnects connected devices")
+
+			// With SQLite the closed database already fails the authentication of late connections
+			if driver == app.StorageMemory {
+				lateConn := connectWebSocket(t, server.URL, bob)
+				defer lateConn.Close()
+				expectClosed(lateConn)
+				t.Log("[OK] Connections after closing are closed right away")
+			}
+		})
+	}
+}
+
+// TestE2E_ErrorScenarios tests various error scenarios
+func TestE2E_ErrorScenarios(t *testing.T) {
+	// Setup
+	application := newTestApp(t, app.DefaultConfig())
+	server := httptest.NewServer(application.Handler())
+	defer server.Close()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	t.Log("=== Starting E2E Error Scenarios Test ===")
+
+	// Create a user for testing
+	alice := createUser(t, client, server.URL, "alice_errors")
+
+	// Test scenarios
+	testEmptyMessage(t, client, server.URL, alice, "some_user")
+	testSelfMessage(t, client, server.URL, alice)
+
+	// Messaging to or from unknown users is rejected and creates no chat
+	testNonExistentUser(t, client, server.URL, alice)
+	testUnauthenticatedRequests(t, client, server.URL, alice)
+	testLogin(t, client, server.URL, "alice_errors")
+
+	testInvalidUsers(t, client, server.URL, alice)
+	testDuplicateUsername(t, client, server.URL, "alice_errors")
+	testInvalidJSON(t, client, server.URL)
+
+	t.Log("=== E2E Error Scenarios Test Completed ===")
+}
+
+// TestE2E_SQLitePersistence tests that users, chats and messages survive an application restart
+func TestE2E_SQLitePersistence(t *testing.T) {
+	cfg := app.DefaultConfig()
+	cfg.StorageDriver = app.StorageSQLite
+	cfg.SQLitePath = filepath.Join(t.TempDir(), "messaging.db")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	t.Log("=== Starting E2E SQLite Persistence Test ===")
+
+	// First run: create data
+	application := newTestApp(t, cfg)
+	server := httptest.NewServer(application.Handler())
+
+	alice := createUser(t, client, server.URL, "alice_sqlite")
+	bob := createUser(t, client, server.URL, "bob_sqlite")
+	msg1 := sendMessage(t, client, server.URL, alice, bob.ID, "Hello from SQLite", "sqlite_1")
+	sendMessage(t, client, server.URL, bob, alice.ID, "Hi Alice!", "sqlite_2")
+
+	duplicateMsg := sendMessage(t, client, server.URL, alice, bob.ID, "Hello from SQLite", "sqlite_1")
+	if duplicateMsg.ID != msg1.ID {
+		t.Errorf("Idempotency failed: expected message ID %s, got %s", msg1.ID, duplicateMsg.ID)
+	}
+	testIdempotencyKeyConflict(t, client, server.URL, alice, bob.ID, "Different content", "sqlite_1")
+
+	testDuplicateUsername(t, client, server.URL, "alice_sqlite")
+
+	server.Close()
+	application.Close()
+
+	// Second run: data must still be there
+	application = newTestApp(t, cfg)
+	server = httptest.NewServer(application.Handler())
+	defer server.Close()
+
+	// Tokens are signed with a per-process secret, so log in again; this also proves
+	// the password hash was persisted
+	alice = loginUser(t, client, server.URL, "alice_sqlite")
+
+	resp, err := doRequest(client, "GET", server.URL+"/api/v1/users/"+alice.ID, alice.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected user to survive restart, got status %d", resp.StatusCode)
+	} else {
+		t.Log("[OK] User persisted across restart")
+	}
+
+	chats := listUserChats(t, client, server.URL, alice, 1, 10)
+	chatID := getChatID(t, chats, bob.ID)
+	messages := listChatMessages(t, client, server.URL, alice, chatID, 1, 10)
+	if messages.TotalCount != 2 {
+		t.Errorf("Expected 2 persisted messages, got %d", messages.TotalCount)
+	} else {
+		t.Log("[OK] Chat and messages persisted across restart")
+	}
+
+	first := messages.Data.([]interface{})[0].(map[string]interface{})
+	if first["id"] != msg1.ID {
+		t.Errorf("Expected oldest message %s first, got %v", msg1.ID, first["id"])
+	}
+
+	t.Log("=== E2E SQLite Persistence Test Completed ===")
+}
+
+// Helper functions
+
+// testPassword is the password used for every user created by the tests
+const testPassword = "s3cret-passw0rd"
+
+// benchmarkChatCounts are the store sizes the repository benchmarks run against; with every
+// lookup served by an index, ns/op should stay flat as the store grows
+var benchmarkChatCounts = []int{100, 1000, 10000}
+
+// benchmarkMessagesPerChat is the number of messages seeded into every benchmark chat
+const benchmarkMessagesPerChat = 10
+
+// seedMemoryChatRepository fills a memory repository with chats between a hub user and each of
+// the other users, every chat holding benchmarkMessagesPerChat messages with idempotency keys
+func seedMemoryChatRepository(b *testing.B, chats int) (*repositories.MemoryChatRepository, []*domain.Message) {
+	b.Helper()
+
+	repo := repositories.NewMemoryChatRepository()
+	messages := make([]*domain.Message, 0, chats*benchmarkMessagesPerChat)
+	for i := 0; i < chats; i++ {
+		chat, err := repo.FindOrCreateByParticipants("hub", fmt.Sprintf("user-%d", i))
+		if err != nil {
+			b.Fatalf("Failed to create chat: %v", err)
+		}
+		for j := 0; j < benchmarkMessagesPerChat; j++ {
+			message := &domain.Message{
+				ChatID:         chat.ID,
+				SenderID:       "hub",
+				Content:        "Benchmark",
+				Status:         domain.StatusSent,
+				IdempotencyKey: fmt.Sprintf("key-%d-%d", i, j),
+			}
+			if err := repo.AddMessage(message); err != nil {
+				b.Fatalf("Failed to add message: %v", err)
+			}
+			messages = append(messages, message)
+		}
+	}
+
+	return repo, messages
+}
+
+// BenchmarkMemoryChatRepository_FindMessageByID measures message lookups by ID
+func BenchmarkMemoryChatRepository_FindMessageByID(b *testing.B) {
+	for _, chats := range benchmarkChatCounts {
+		b.Run(fmt.Sprintf("chats=%d", chats), func(b *testing.B) {
+			repo, messages := seedMemoryChatRepository(b, chats)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := repo.FindMessageByID(messages[i%len(messages)].ID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMemoryChatRepository_UpdateMessageStatus measures status updates, which look the
+// message up by ID; the store is reseeded whenever every message has been delivered
+func BenchmarkMemoryChatRepository_UpdateMessageStatus(b *testing.B) {
+	for _, chats := range benchmarkChatCounts {
+		b.Run(fmt.Sprintf("chats=%d", chats), func(b *testing.B) {
+			repo, messages := seedMemoryChatRepository(b, chats)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if i > 0 && i%len(messages) == 0 {
+					b.StopTimer()
+					repo, messages = seedMemoryChatRepository(b, chats)
+					b.StartTimer()
+				}
+				if _, err := repo.UpdateMessageStatus(messages[i%len(messages)].ID, domain.StatusDelivered); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMemoryChatRepository_FindByParticipants measures chat lookups by participant pair
+func BenchmarkMemoryChatRepository_FindByParticipants(b *testing.B) {
+	for _, chats := range benchmarkChatCounts {
+		b.Run(fmt.Sprintf("chats=%d", chats), func(b *testing.B) {
+			repo, _ := seedMemoryChatRepository(b, chats)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := repo.FindByParticipants(fmt.Sprintf("user-%d", i%chats), "hub"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMemoryChatRepository_FindMessageByKey measures idempotency key lookups
+func BenchmarkMemoryChatRepository_FindMessageByKey(b *testing.B) {
+	for _, chats := range benchmarkChatCounts {
+		b.Run(fmt.Sprintf("chats=%d", chats), func(b *testing.B) {
+			repo, messages := seedMemoryChatRepository(b, chats)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := repo.FindMessageByKey("hub", messages[i%len(messages)].IdempotencyKey); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMemoryChatRepository_FindUserChats measures loading the first page of the chat list
+// of a user who takes part in every chat of the store
+func BenchmarkMemoryChatRepository_FindUserChats(b *testing.B) {
+	for _, chats := range benchmarkChatCounts {
+		b.Run(fmt.Sprintf("chats=%d", chats), func(b *testing.B) {
+			repo, _ := seedMemoryChatRepository(b, chats)
+			pagination := domain.PaginationParams{Page: 1, PageSize: 20}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, _, err := repo.FindUserChats("hub", pagination); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// testUser is a registered user together with its access token
+type testUser struct {
+	*domain.User
+	Token string
+}
+
+func newTestApp(t *testing.T, cfg app.Config) *app.App {
+	t.Helper()
+
+	application, err := app.NewApp(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create application: %v", err)
+	}
+	t.Cleanup(func() { application.Close() })
+
+	return application
+}
+
+func createUser(t *testing.T, client *http.Client, baseURL, username string) *testUser {
+	t.Helper()
+
+	userData := map[string]string{"username": username, "password": testPassword}
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/users", "", userData)
+	if err != nil {
+		t.Fatalf("Failed to create user %s: %v", username, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 for user creation, got %d", resp.StatusCode)
+	}
+
+	var user domain.User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Fatalf("Failed to decode user response: %v", err)
+	}
+
+	loggedIn := loginUser(t, client, baseURL, username)
+	if loggedIn.ID != user.ID {
+		t.Fatalf("Login returned user %s, expected %s", loggedIn.ID, user.ID)
+	}
+
+	return loggedIn
+}
+
+func loginUser(t *testing.T, client *http.Client, baseURL, username string) *testUser {
+	t.Helper()
+
+	credentials := map[string]string{"username": username, "password": testPassword}
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/auth/login", "", credentials)
+	if err != nil {
+		t.Fatalf("Failed to log in %s: %v", username, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for login, got %d", resp.StatusCode)
+	}
+
+	var token domain.AuthToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		t.Fatalf("Failed to decode login response: %v", err)
+	}
+
+	return &testUser{User: token.User, Token: token.Token}
+}
+
+// registrationStatus tries to register the username and returns the response status
+func registrationStatus(t *testing.T, client *http.Client, baseURL, username string) int {
+	t.Helper()
+
+	userData := map[string]string{"username": username, "password": testPassword}
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/users", "", userData)
+	if err != nil {
+		t.Fatalf("Failed to register %s: %v", username, err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// doRequest sends a JSON request, authenticated with the bearer token when one is given
+func doRequest(client *http.Client, method, url, token string, payload interface{}) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return client.Do(req)
+}
+
+func sendMessage(t *testing.T, client *http.Client, baseURL string, sender *testUser, recipientID, content, idempotencyKey string) *domain.Message {
+	t.Helper()
+
+	msg, err := sendMessageWithError(client, baseURL, sender, recipientID, content, idempotencyKey)
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	return msg
+}
+
+func sendMessageWithError(client *http.Client, baseURL string, sender *testUser, recipientID, content, idempotencyKey string) (*domain.Message, error) {
+	messageData := map[string]string{
+		"recipient_id":    recipientID,
+		"content":         content,
+		"idempotency_key": idempotencyKey,
+	}
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", sender.Token, messageData)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Retries of a stored message answer 200 instead of 201
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected status 201 or 200, got %d", resp.StatusCode)
+	}
+
+	var message domain.Message
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// sendReply sends a message replying to replyToID over REST and asserts the response status; the
+// message is returned on success
+func sendReply(t *testing.T, client *http.Client, baseURL string, sender *testUser, recipientID, content, replyToID, idempotencyKey string, expectedStatus int) *domain.Message {
+	t.Helper()
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", sender.Token, map[string]string{
+		"recipient_id":    recipientID,
+		"content":         content,
+		"idempotency_key": idempotencyKey,
+		"reply_to_id":     replyToID,
+	})
+	if err != nil {
+		t.Fatalf("Failed to send reply: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for replying to %s, got %d", expectedStatus, replyToID, resp.StatusCode)
+	}
+	if expectedStatus != http.StatusCreated && expectedStatus != http.StatusOK {
+		return nil
+	}
+
+	var message domain.Message
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		t.Fatalf("Failed to decode reply: %v", err)
+	}
+	return &message
+}
+
+// sendToChat sends a message to an existing chat over REST and asserts the response status; the
+// message is returned on success
+func sendToChat(t *testing.T, client *http.Client, baseURL string, sender *testUser, chatID, content string, expectedStatus int) *domain.Message {
+	t.Helper()
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", sender.Token, map[string]string{
+		"chat_id": chatID,
+		"content": content,
+	})
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for sending to chat %s, got %d", expectedStatus, chatID, resp.StatusCode)
+	}
+	if expectedStatus != http.StatusCreated {
+		return nil
+	}
+
+	var message domain.Message
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	return &message
+}
+
+// chatRequest calls a chat endpoint and asserts the response status; the chat is returned on
+// success
+func chatRequest(t *testing.T, client *http.Client, user *testUser, method, url string, payload interface{}, expectedStatus int) *domain.Chat {
+	t.Helper()
+
+	resp, err := doRequest(client, method, url, user.Token, payload)
+	if err != nil {
+		t.Fatalf("Failed to call %s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for %s %s, got %d", expectedStatus, method, url, resp.StatusCode)
+	}
+	if expectedStatus >= http.StatusMultipleChoices {
+		return nil
+	}
+
+	var chat domain.Chat
+	if err := json.NewDecoder(resp.Body).Decode(&chat); err != nil {
+		t.Fatalf("Failed to decode chat: %v", err)
+	}
+	return &chat
+}
+
+// expectMembers asserts the members of a group chat in join order, given as user ID and role pairs
+func expectMembers(t *testing.T, chat *domain.Chat, expected ...interface{}) {
+	t.Helper()
+
+	members := []interface{}{}
+	for _, member := range chat.Members {
+		members = append(members, member.UserID, member.Role)
+	}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("Expected members %v, got %v", expected, members)
+	}
+}
+
+// uploadAttachment uploads a file as multipart form data and asserts the response status; the
+// attachment is returned on success
+func uploadAttachment(t *testing.T, client *http.Client, baseURL string, user *testUser, fileName string, content []byte, expectedStatus int) *domain.Attachment {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write(content)
+	form.Close()
+
+	req, err := http.NewRequest("POST", baseURL+"/api/v1/attachments", &body)
+	if err != nil {
+		t.Fatalf("Failed to create upload request: %v", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to upload %s: %v", fileName, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for uploading %s, got %d", expectedStatus, fileName, resp.StatusCode)
+	}
+	if expectedStatus != http.StatusCreated {
+		return nil
+	}
+
+	var attachment domain.Attachment
+	if err := json.NewDecoder(resp.Body).Decode(&attachment); err != nil {
+		t.Fatalf("Failed to decode attachment: %v", err)
+	}
+	return &attachment
+}
+
+// sendAttachments sends a message with attachments over REST and asserts the response status
+func sendAttachments(t *testing.T, client *http.Client, baseURL string, sender *testUser, recipientID, content, idempotencyKey string, attachmentIDs []string, expectedStatus int) *domain.Message {
+	t.Helper()
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", sender.Token, map[string]interface{}{
+		"recipient_id":    recipientID,
+		"content":         content,
+		"idempotency_key": idempotencyKey,
+		"attachment_ids":  attachmentIDs,
+	})
+	if err != nil {
+		t.Fatalf("Failed to send attachments: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for sending attachments %v, got %d", expectedStatus, attachmentIDs, resp.StatusCode)
+	}
+	if expectedStatus != http.StatusCreated && expectedStatus != http.StatusOK {
+		return nil
+	}
+
+	var message domain.Message
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	return &message
+}
+
+// downloadAttachment fetches an attachment or thumbnail URL and asserts the response status,
+// returning the response headers and body
+func downloadAttachment(t *testing.T, client *http.Client, url string, user *testUser, expectedStatus int) (http.Header, []byte) {
+	t.Helper()
+
+	resp, err := doRequest(client, "GET", url, user.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for downloading %s, got %d", expectedStatus, url, resp.StatusCode)
+	}
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", url, err)
+	}
+	return resp.Header, content
+}
+
+// chatPreview returns the last message preview of a chat in the user's chat list
+func chatPreview(t *testing.T, client *http.Client, baseURL string, user *testUser, chatID string) map[string]interface{} {
+	t.Helper()
+
+	chats := listUserChats(t, client, baseURL, user, 1, 100)
+	for _, chat := range chats.Data.([]interface{}) {
+		chatMap := chat.(map[string]interface{})
+		if chatMap["id"] == chatID {
+			preview, _ := chatMap["last_message"].(map[string]interface{})
+			return preview
+		}
+	}
+
+	t.Fatalf("Chat %s not found in the chat list of %s", chatID, user.Username)
+	return nil
+}
+
+func listUserChats(t *testing.T, client *http.Client, baseURL string, user *testUser, page, pageSize int) *domain.PaginatedResponse {
+	t.Helper()
+
+	url := fmt.Sprintf("%s/api/v1/chats?page=%d&page_size=%d", baseURL, page, pageSize)
+	resp, err := doRequest(client, "GET", url, user.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to list user chats: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for chat listing, got %d", resp.StatusCode)
+	}
+
+	var response domain.PaginatedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode chats response: %v", err)
+	}
+
+	return &response
+}
+
+func listChatMessages(t *testing.T, client *http.Client, baseURL string, user *testUser, chatID string, page, pageSize int) *domain.PaginatedResponse {
+	t.Helper()
+
+	url := fmt.Sprintf("%s/api/v1/chats/%s/messages?page=%d&page_size=%d", baseURL, chatID, page, pageSize)
+	resp, err := doRequest(client, "GET", url, user.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to list chat messages: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for message listing, got %d", resp.StatusCode)
+	}
+
+	var response domain.PaginatedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode messages response: %v", err)
+	}
+
+	return &response
+}
+
+func getChatID(t *testing.T, chats *domain.PaginatedResponse, participantID string) string {
+	t.Helper()
+
+	chatList := chats.Data.([]interface{})
+	for _, chat := range chatList {
+		chatMap := chat.(map[string]interface{})
+		if chatMap["participant1"] == participantID || chatMap["participant2"] == participantID {
+			return chatMap["id"].(string)
+		}
+	}
+	t.Fatalf("Chat with participant %s not found", participantID)
+	return ""
+}
+
+// chatUnreadCount returns the unread count of a chat in the user's chat list
+func chatUnreadCount(t *testing.T, client *http.Client, baseURL string, user *testUser, chatID string) int {
+	t.Helper()
+
+	chats := listUserChats(t, client, baseURL, user, 1, 100)
+	for _, chat := range chats.Data.([]interface{}) {
+		chatMap := chat.(map[string]interface{})
+		if chatMap["id"] == chatID {
+			return int(chatMap["unread_count"].(float64))
+		}
+	}
+
+	t.Fatalf("Chat %s not found in the chat list of %s", chatID, user.Username)
+	return 0
+}
+
+// markChatRead marks the chat as read up to the message and asserts the response status
+func markChatRead(t *testing.T, client *http.Client, baseURL string, user *testUser, chatID, messageID string, expectedStatus int) *domain.ReadMark {
+	t.Helper()
+
+	url := baseURL + "/api/v1/chats/" + chatID + "/read"
+	resp, err := doRequest(client, "POST", url, user.Token, map[string]string{"message_id": messageID})
+	if err != nil {
+		t.Fatalf("Failed to mark chat as read: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for marking chat read, got %d", expectedStatus, resp.StatusCode)
+	}
+
+	var mark domain.ReadMark
+	json.NewDecoder(resp.Body).Decode(&mark)
+	return &mark
+}
+
+// cursorPage requests a page of messages and asserts the response status
+func cursorPage(t *testing.T, client *http.Client, user *testUser, url string, expectedStatus int) *domain.PaginatedResponse {
+	t.Helper()
+
+	resp, err := doRequest(client, "GET", url, user.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to list chat messages: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for %s, got %d", expectedStatus, url, resp.StatusCode)
+	}
+
+	var response domain.PaginatedResponse
+	json.NewDecoder(resp.Body).Decode(&response)
+	return &response
+}
+
+// expectPageIDs asserts that the page holds exactly the given messages, in order
+func expectPageIDs(t *testing.T, page *domain.PaginatedResponse, expected ...*domain.Message) {
+	t.Helper()
+
+	data, _ := page.Data.([]interface{})
+	ids := make([]interface{}, len(data))
+	for i, msg := range data {
+		ids[i] = msg.(map[string]interface{})["id"]
+	}
+
+	if len(ids) != len(expected) {
+		t.Errorf("Expected %d messages on the page, got %v", len(expected), ids)
+		return
+	}
+	for i, msg := range expected {
+		if ids[i] != msg.ID {
+			t.Errorf("Expected message %s at position %d, got %v", msg.ID, i, ids)
+		}
+	}
+}
+
+// syncChanges requests the user's changes since the token and asserts the response status
+func syncChanges(t *testing.T, client *http.Client, baseURL string, user *testUser, since string, limit int, expectedStatus int) *domain.SyncResult {
+	t.Helper()
+
+	resp, err := doRequest(client, "GET", fmt.Sprintf("%s/api/v1/sync?since=%s&limit=%d", baseURL, since, limit), user.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for sync since %q, got %d", expectedStatus, since, resp.StatusCode)
+	}
+
+	var result domain.SyncResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	return &result
+}
+
+// expectChangeTypes asserts that the sync result holds changes of exactly the given types, in order
+func expectChangeTypes(t *testing.T, result *domain.SyncResult, expected ...domain.ChangeType) {
+	t.Helper()
+
+	types := make([]domain.ChangeType, len(result.Changes))
+	for i, change := range result.Changes {
+		types[i] = change.Type
+	}
+
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Errorf("Expected changes %v, got %v", expected, types)
+	}
+}
+
+// editMessage edits a message over REST and asserts the response status
+func editMessage(t *testing.T, client *http.Client, baseURL string, user *testUser, messageID, content string, expectedStatus int) *domain.Message {
+	t.Helper()
+
+	resp, err := doRequest(client, "PATCH", baseURL+"/api/v1/messages/"+messageID, user.Token, map[string]string{"content": content})
+	if err != nil {
+		t.Fatalf("Failed to edit message: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for editing %s, got %d", expectedStatus, messageID, resp.StatusCode)
+	}
+
+	var message domain.Message
+	json.NewDecoder(resp.Body).Decode(&message)
+	return &message
+}
+
+// deleteMessage deletes a message over REST with the given scope and asserts the response status
+func deleteMessage(t *testing.T, client *http.Client, baseURL string, user *testUser, messageID, scope string, expectedStatus int) {
+	t.Helper()
+
+	resp, err := doRequest(client, "DELETE", baseURL+"/api/v1/messages/"+messageID+"?scope="+scope, user.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to delete message: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for deleting %s for %s, got %d", expectedStatus, messageID, scope, resp.StatusCode)
+	}
+}
+
+// react adds (POST) or removes (DELETE) a reaction over REST and asserts the response status; the
+// message with its reactions is returned on success
+func react(t *testing.T, client *http.Client, baseURL string, user *testUser, method, messageID, emoji string, expectedStatus int) *domain.Message {
+	t.Helper()
+
+	endpoint := baseURL + "/api/v1/messages/" + messageID + "/reactions"
+	var payload interface{}
+	if method == "DELETE" {
+		endpoint += "?emoji=" + url.QueryEscape(emoji)
+	} else {
+		payload = map[string]string{"emoji": emoji}
+	}
+
+	resp, err := doRequest(client, method, endpoint, user.Token, payload)
+	if err != nil {
+		t.Fatalf("Failed to change reaction: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for %s of reaction %q, got %d", expectedStatus, method, emoji, resp.StatusCode)
+	}
+	if expectedStatus != http.StatusOK {
+		return nil
+	}
+
+	var message domain.Message
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	return &message
+}
+
+// expectReactions asserts the aggregated reactions of a message
+func expectReactions(t *testing.T, message *domain.Message, expected ...domain.ReactionSummary) {
+	t.Helper()
+
+	if !reflect.DeepEqual(message.Reactions, expected) {
+		t.Errorf("Expected reactions %+v, got %+v", expected, message.Reactions)
+	}
+}
+
+// messageRevisions lists the earlier contents of a message and asserts the response status
+func messageRevisions(t *testing.T, client *http.Client, baseURL string, user *testUser, messageID string, expectedStatus int) []*domain.MessageRevision {
+	t.Helper()
+
+	resp, err := doRequest(client, "GET", baseURL+"/api/v1/messages/"+messageID+"/revisions", user.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to list message revisions: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d for revisions of %s, got %d", expectedStatus, messageID, resp.StatusCode)
+	}
+
+	var response struct {
+		Data []*domain.MessageRevision `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&response)
+	return response.Data
+}
+
+// connectWebSocket opens an authenticated WebSocket connection for the user
+func connectWebSocket(t *testing.T, baseURL string, user *testUser) *websocket.Conn {
+	t.Helper()
+	return connectDevice(t, baseURL, user, "")
+}
+
+// connectDevice opens an authenticated WebSocket connection for one of the user's devices
+func connectDevice(t *testing.T, baseURL string, user *testUser, deviceID string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(baseURL, "http") + "/ws"
+	if deviceID != "" {
+		url += "?device_id=" + deviceID
+	}
+	header := http.Header{"Authorization": []string{"Bearer " + user.Token}}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Failed to connect WebSocket for %s: %v", user.Username, err)
+	}
+
+	return conn
+}
+
+// onlineDevices returns the IDs of the user's connected devices
+func onlineDevices(t *testing.T, client *http.Client, baseURL string, viewer *testUser, userID string) []string {
+	t.Helper()
+
+	resp, err := doRequest(client, "GET", baseURL+"/api/v1/users/"+userID+"/devices", viewer.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to list devices: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for device listing, got %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Online []struct {
+			DeviceID string `json:"device_id"`
+		} `json:"online"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode devices response: %v", err)
+	}
+
+	ids := make([]string, len(response.Online))
+	for i, device := range response.Online {
+		ids[i] = device.DeviceID
+	}
+	return ids
+}
+
+// waitForDevices polls until the user has the expected number of connected devices
+func waitForDevices(t *testing.T, client *http.Client, baseURL string, viewer *testUser, userID string, expected int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		devices := onlineDevices(t, client, baseURL, viewer, userID)
+		if len(devices) == expected {
+			return devices
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("User %s has %d online devices, expected %d", userID, len(devices), expected)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// expectNoFrame asserts that nothing arrives on the connection for a short while
+func expectNoFrame(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var frame map[string]interface{}
+	if err := conn.ReadJSON(&frame); err == nil {
+		t.Errorf("Expected no frame, got %v", frame)
+	}
+}
+
+// readWebSocketJSON reads the next frame from the connection as a JSON object
+func readWebSocketJSON(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame map[string]interface{}
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatalf("Failed to read WebSocket frame: %v", err)
+	}
+
+	return frame
+}
+
+// writeEnvelope sends a protocol envelope over the connection
+func writeEnvelope(t *testing.T, conn *websocket.Conn, eventType, id string, payload interface{}) {
+	t.Helper()
+
+	envelope := map[string]interface{}{
+		"type":    eventType,
+		"id":      id,
+		"version": 1,
+		"payload": payload,
+	}
+	if err := conn.WriteJSON(envelope); err != nil {
+		t.Fatalf("Failed to write %s envelope: %v", eventType, err)
+	}
+}
+
+// expectReceipt reads the next frame and asserts it is a receipt for the message with the given status
+func expectReceipt(t *testing.T, conn *websocket.Conn, messageID interface{}, status domain.MessageStatus) {
+	t.Helper()
+
+	frame := readWebSocketJSON(t, conn)
+	payload := payloadOf(frame)
+	if frame["type"] != "receipt" || payload["message_id"] != messageID || payload["status"] != string(status) || payload["timestamp"] == nil {
+		t.Errorf("Expected %s receipt for message %v, got %v", status, messageID, frame)
+	}
+}
+
+// payloadOf returns the payload object of a decoded envelope
+func payloadOf(frame map[string]interface{}) map[string]interface{} {
+	payload, _ := frame["payload"].(map[string]interface{})
+	return payload
+}
+
+// messageStatus returns the current status of a message as seen by the given participant
+func messageStatus(t *testing.T, client *http.Client, baseURL string, user *testUser, chatID, messageID string) domain.MessageStatus {
+	t.Helper()
+
+	messages := listChatMessages(t, client, baseURL, user, chatID, 1, 100)
+	for _, msg := range messages.Data.([]interface{}) {
+		msgMap := msg.(map[string]interface{})
+		if msgMap["id"] == messageID {
+			return domain.MessageStatus(msgMap["status"].(string))
+		}
+	}
+
+	t.Fatalf("Message %s not found in chat %s", messageID, chatID)
+	return ""
+}
+
+// findMessage returns a message of the chat as seen by the given participant
+func findMessage(t *testing.T, client *http.Client, baseURL string, user *testUser, chatID, messageID string) *domain.Message {
+	t.Helper()
+
+	url := fmt.Sprintf("%s/api/v1/chats/%s/messages?page=1&page_size=100", baseURL, chatID)
+	resp, err := doRequest(client, "GET", url, user.Token, nil)
+	if err != nil {
+		t.Fatalf("Failed to list chat messages: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Data []*domain.Message `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode messages response: %v", err)
+	}
+
+	for _, msg := range response.Data {
+		if msg.ID == messageID {
+			return msg
+		}
+	}
+
+	t.Fatalf("Message %s not found in chat %s", messageID, chatID)
+	return nil
+}
+
+// waitForStatus polls the chat until the message reaches the expected status
+func waitForStatus(t *testing.T, client *http.Client, baseURL string, user *testUser, chatID, messageID string, expected domain.MessageStatus) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status := messageStatus(t, client, baseURL, user, chatID, messageID)
+		if status == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Message %s has status %q, expected %q", messageID, status, expected)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Error scenario tests
+
+func testEmptyMessage(t *testing.T, client *http.Client, baseURL string, sender *testUser, recipientID string) {
+	messageData := map[string]string{
+		"recipient_id": recipientID,
+		"content":      "",
+	}
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", sender.Token, messageData)
+	if err != nil {
+		t.Fatalf("Failed to send empty message: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for empty message, got %d", resp.StatusCode)
+	} else {
+		t.Log("[OK] Empty message correctly rejected")
+	}
+}
+
+func testSelfMessage(t *testing.T, client *http.Client, baseURL string, user *testUser) {
+	messageData := map[string]string{
+		"recipient_id": user.ID,
+		"content":      "Message to myself",
+	}
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", user.Token, messageData)
+	if err != nil {
+		t.Fatalf("Failed to send self-message: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for self-message, got %d", resp.StatusCode)
+	} else {
+		t.Log("[OK] Self-message correctly rejected")
+	}
+}
+
+func testNonExistentUser(t *testing.T, client *http.Client, baseURL string, sender *testUser) {
+	nonExistentUserID := "non-existent-user-123"
+
+	messageData := map[string]string{
+		"recipient_id": nonExistentUserID,
+		"content":      "Hello non-existent user",
+	}
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", sender.Token, messageData)
+	if err != nil {
+		t.Fatalf("Failed to send message to non-existent user: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for non-existent recipient, got %d", resp.StatusCode)
+	} else {
+		t.Log("[OK] Message to non-existent user correctly rejected")
+	}
+
+	// No "ghost" chat must have been created
+	chats := listUserChats(t, client, baseURL, sender, 1, 10)
+	for _, chat := range chats.Data.([]interface{}) {
+		chatMap := chat.(map[string]interface{})
+		if chatMap["participant1"] == nonExistentUserID || chatMap["participant2"] == nonExistentUserID {
+			t.Error("Chat with non-existent user should not have been created")
+		}
+	}
+}
+
+func testUnauthenticatedRequests(t *testing.T, client *http.Client, baseURL string, user *testUser) {
+	messageData := map[string]string{
+		"recipient_id": user.ID,
+		"content":      "Hello from nobody",
+	}
+
+	// Missing, forged and tampered tokens are all rejected
+	tampered := user.Token[:len(user.Token)-2] + "xx"
+	for _, token := range []string{"", "not-a-token", tampered} {
+		resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", token, messageData)
+		if err != nil {
+			t.Fatalf("Failed to send unauthenticated message: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 for token %q, got %d", token, resp.StatusCode)
+		}
+	}
+
+	// The WebSocket endpoint requires a token as well
+	resp, err := doRequest(client, "GET", baseURL+"/ws", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to call WebSocket endpoint: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for unauthenticated WebSocket, got %d", resp.StatusCode)
+	}
+
+	// A client-supplied sender_id is ignored in favour of the token's identity
+	messageData = map[string]string{
+		"sender_id":    "someone-else",
+		"recipient_id": "non-existent-user-123",
+		"content":      "Impersonation attempt",
+	}
+	resp, err = doRequest(client, "POST", baseURL+"/api/v1/messages", user.Token, messageData)
+	if err != nil {
+		t.Fatalf("Failed to send impersonation attempt: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown recipient, got %d", resp.StatusCode)
+	}
+
+	t.Log("[OK] Unauthenticated requests correctly rejected")
+}
+
+func testLogin(t *testing.T, client *http.Client, baseURL, username string) {
+	credentials := map[string]string{"username": username, "password": "wrong-password"}
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/auth/login", "", credentials)
+	if err != nil {
+		t.Fatalf("Failed to log in: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for wrong password, got %d", resp.StatusCode)
+	} else {
+		t.Log("[OK] Wrong password correctly rejected")
+	}
+}
+
+func testInvalidUsers(t *testing.T, client *http.Client, baseURL string, sender *testUser) {
+	messageData := map[string]string{
+		"recipient_id": "",
+		"content":      "Test message",
+	}
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", sender.Token, messageData)
+	if err != nil {
+		t.Fatalf("Failed to send message with invalid users: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid users, got %d", resp.StatusCode)
+	} else {
+		t.Log("[OK] Message with invalid users correctly rejected")
+	}
+}
+
+func testIdempotencyKeyConflict(t *testing.T, client *http.Client, baseURL string, sender *testUser, recipientID, content, idempotencyKey string) {
+	messageData := map[string]string{
+		"recipient_id":    recipientID,
+		"content":         content,
+		"idempotency_key": idempotencyKey,
+	}
+
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/messages", sender.Token, messageData)
+	if err != nil {
+		t.Fatalf("Failed to send message with reused key: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 for reused idempotency key, got %d", resp.StatusCode)
+	} else {
+		t.Log("[OK] Reused idempotency key with different payload correctly rejected")
 	}
 }
 
 func testDuplicateUsername(t *testing.T, client *http.Client, baseURL, username string) {
-	userData := map[string]string{"username": username}
-	body, _ := json.Marshal(userData)
+	userData := map[string]string{"username": username, "password": testPassword}
 
-	resp, err := client.Post(baseURL+"/api/v1/users", "application/json", bytes.NewReader(body))
+	resp, err := doRequest(client, "POST", baseURL+"/api/v1/users", "", userData)
 	if err != nil {
 		t.Fatalf("Failed to create duplicate user: %v", err)
 	}
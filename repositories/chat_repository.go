@@ -1,7 +1,7 @@
 package repositories
 
 import (
-	"sort"
+	"container/list"
 	"sync"
 	"time"
 
@@ -10,26 +10,98 @@ import (
 	"github.com/google/uuid"
 )
 
-// MemoryChatRepository implements ChatRepository with in-memory storage
+// MemoryChatRepository implements ChatRepository with in-memory storage.
+// Stored entities are never handed out directly: callers always receive copies, so
+// later updates under the mutex cannot race with callers reading (e.g. marshaling) them.
+// Secondary indexes, maintained under the same mutex, keep lookups independent of the
+// number of stored chats and messages.
 type MemoryChatRepository struct {
-	chats    map[string]*domain.Chat
-	messages map[string][]*domain.Message // chatID -> messages
-	mutex    sync.RWMutex
+	chats     map[string]*domain.Chat
+	messages  map[string][]*domain.Message // chatID -> messages
+	byID      map[string]*domain.Message   // messageID -> message, located in its chat at Seq-1
+	pairs     map[string]string            // participant pair key -> chatID
+	keys      map[string]*domain.Message   // sender + idempotency key -> message
+	userChats map[string]*recentChats      // userID -> the user's chats, most recently updated first
+
+	undelivered map[string][]*domain.Message         // recipientID -> messages still "sent", oldest first
+	readMarks   map[string]*readMark                 // chat + user -> read watermark
+	unread      map[string]int                       // chat + user -> messages the user has not read yet
+	changes     map[string][]*domain.Change          // userID -> change log, oldest first
+	revisions   map[string][]*domain.MessageRevision // messageID -> earlier contents, oldest first
+	hidden      map[string]map[int64]bool            // chat + user -> seqs of messages deleted for the user
+	replies     map[string][]*domain.Message         // messageID -> messages quoting it
+	reactions   map[string][]*domain.Reaction        // messageID -> reactions, oldest first
+	attachments map[string]*domain.Attachment        // attachmentID -> attachment, sent or not
+	mutex       sync.RWMutex
+}
+
+// readMark is a stored read watermark together with the position of its message in the chat
+type readMark struct {
+	mark  domain.ReadMark
+	index int
+}
+
+// recentChats orders a user's chats by UpdatedAt, most recent first. Chats only ever become the
+// most recently updated one, so moving a chat to the front keeps the order sorted.
+type recentChats struct {
+	order    *list.List               // *domain.Chat elements
+	elements map[string]*list.Element // chatID -> element of order
+}
+
+// touch moves the chat to the front, adding it if needed
+func (c *recentChats) touch(chat *domain.Chat) {
+	if element, exists := c.elements[chat.ID]; exists {
+		c.order.MoveToFront(element)
+		return
+	}
+	c.elements[chat.ID] = c.order.PushFront(chat)
+}
+
+// remove drops the chat, e.g. when the user left it
+func (c *recentChats) remove(chatID string) {
+	if element, exists := c.elements[chatID]; exists {
+		c.order.Remove(element)
+		delete(c.elements, chatID)
+	}
 }
 
 // NewMemoryChatRepository creates a new in-memory chat repository
 func NewMemoryChatRepository() *MemoryChatRepository {
 	return &MemoryChatRepository{
-		chats:    make(map[string]*domain.Chat),
-		messages: make(map[string][]*domain.Message),
+		chats:     make(map[string]*domain.Chat),
+		messages:  make(map[string][]*domain.Message),
+		byID:      make(map[string]*domain.Message),
+		pairs:     make(map[string]string),
+		keys:      make(map[string]*domain.Message),
+		userChats: make(map[string]*recentChats),
+
+		undelivered: make(map[string][]*domain.Message),
+		readMarks:   make(map[string]*readMark),
+		unread:      make(map[string]int),
+		changes:     make(map[string][]*domain.Change),
+		revisions:   make(map[string][]*domain.MessageRevision),
+		hidden:      make(map[string]map[int64]bool),
+		replies:     make(map[string][]*domain.Message),
+		reactions:   make(map[string][]*domain.Reaction),
+		attachments: make(map[string]*domain.Attachment),
 	}
 }
 
-// Create adds a new chat to the repository
+// Create adds a new 1:1 or group chat to the repository
 func (r *MemoryChatRepository) Create(chat *domain.Chat) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	if _, exists := r.pairs[chat.PairKey()]; exists && !chat.IsGroup() {
+		return domain.ErrChatExists
+	}
+
+	r.createLocked(chat)
+	return nil
+}
+
+// createLocked stores a new chat; the caller must hold the write lock
+func (r *MemoryChatRepository) createLocked(chat *domain.Chat) {
 	if chat.ID == "" {
 		chat.ID = uuid.New().String()
 	}
@@ -38,11 +110,20 @@ func (r *MemoryChatRepository) Create(chat *domain.Chat) error {
 		chat.CreatedAt = time.Now()
 	}
 
+	if chat.Type == "" {
+		chat.Type = domain.ChatDirect
+	}
+
 	chat.UpdatedAt = time.Now()
-	r.chats[chat.ID] = chat
+	stored := cloneChat(chat)
+	r.chats[chat.ID] = stored
 	r.messages[chat.ID] = []*domain.Message{}
+	if !chat.IsGroup() {
+		r.pairs[chat.PairKey()] = chat.ID
+	}
+	r.touchLocked(stored)
 
-	return nil
+	r.logChangeLocked(domain.Change{Type: domain.ChangeChatCreated, ChatID: chat.ID}, chat.ParticipantIDs()...)
 }
 
 // FindByID retrieves a chat by its ID
@@ -55,7 +136,7 @@ func (r *MemoryChatRepository) FindByID(id string) (*domain.Chat, error) {
 		return nil, domain.ErrChatNotFound
 	}
 
-	return chat, nil
+	return cloneChat(chat), nil
 }
 
 // FindByParticipants finds a chat between two users
@@ -63,45 +144,206 @@ func (r *MemoryChatRepository) FindByParticipants(user1ID, user2ID string) (*dom
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for _, chat := range r.chats {
-		if (chat.Participant1 == user1ID && chat.Participant2 == user2ID) ||
-			(chat.Participant1 == user2ID && chat.Participant2 == user1ID) {
-			return chat, nil
-		}
+	chatID, exists := r.pairs[domain.ParticipantPairKey(user1ID, user2ID)]
+	if !exists {
+		return nil, domain.ErrChatNotFound
 	}
 
-	return nil, domain.ErrChatNotFound
+	return cloneChat(r.chats[chatID]), nil
 }
 
-// FindUserChats retrieves all chats for a user with pagination
-func (r *MemoryChatRepository) FindUserChats(userID string, pagination domain.PaginationParams) ([]*domain.Chat, int, error) {
+// SharesChat reports whether both users take part in a common chat, 1:1 or group
+func (r *MemoryChatRepository) SharesChat(user1ID, user2ID string) (bool, error) {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	var userChats []*domain.Chat
-	for _, chat := range r.chats {
-		if chat.Participant1 == userID || chat.Participant2 == userID {
-			userChats = append(userChats, chat)
+	if _, exists := r.pairs[domain.ParticipantPairKey(user1ID, user2ID)]; exists {
+		return true, nil
+	}
+
+	if chats, exists := r.userChats[user1ID]; exists {
+		for chatID := range chats.elements {
+			if r.chats[chatID].HasParticipant(user2ID) {
+				return true, nil
+			}
 		}
 	}
 
-	// Sort by updated_at (most recent first)
-	sort.Slice(userChats, func(i, j int) bool {
-		return userChats[i].UpdatedAt.After(userChats[j].UpdatedAt)
-	})
+	return false, nil
+}
+
+// FindOrCreateByParticipants atomically returns the chat between two users, creating it if needed
+func (r *MemoryChatRepository) FindOrCreateByParticipants(user1ID, user2ID string) (*domain.Chat, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if chatID, exists := r.pairs[domain.ParticipantPairKey(user1ID, user2ID)]; exists {
+		return cloneChat(r.chats[chatID]), nil
+	}
+
+	chat := &domain.Chat{
+		Type:         domain.ChatDirect,
+		Participant1: user1ID,
+		Participant2: user2ID,
+	}
+	r.createLocked(chat)
+
+	return chat, nil
+}
+
+// AddChatMember adds a member to a group chat and returns the updated chat. The new member starts
+// with the whole history read, so only later messages count as unread.
+func (r *MemoryChatRepository) AddChatMember(chatID string, member domain.ChatMember) (*domain.Chat, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	chat, exists := r.chats[chatID]
+	if !exists {
+		return nil, domain.ErrChatNotFound
+	}
+	if err := chat.AddMember(member); err != nil {
+		return nil, err
+	}
+
+	chat.UpdatedAt = member.JoinedAt
+	r.touchLocked(chat)
+
+	key := chatUserKey(chatID, member.UserID)
+	delete(r.unread, key)
+	delete(r.readMarks, key)
+	if messages := r.messages[chatID]; len(messages) > 0 {
+		last := messages[len(messages)-1]
+		r.readMarks[key] = &readMark{
+			mark:  domain.ReadMark{ChatID: chatID, UserID: member.UserID, MessageID: last.ID, ReadAt: member.JoinedAt},
+			index: len(messages) - 1,
+		}
+	}
+
+	change := domain.Change{Type: domain.ChangeMemberAdded, ChatID: chatID, UserID: member.UserID, Timestamp: member.JoinedAt}
+	r.logChangeLocked(change, chat.ParticipantIDs()...)
+
+	return cloneChat(chat), nil
+}
+
+// RemoveChatMember removes a member from a group chat, handing ownership on when the owner leaves,
+// and returns the updated chat; the chat disappears from the former member's chats
+func (r *MemoryChatRepository) RemoveChatMember(chatID, userID string, removedAt time.Time) (*domain.Chat, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	chat, exists := r.chats[chatID]
+	if !exists {
+		return nil, domain.ErrChatNotFound
+	}
+	if err := chat.RemoveMember(userID); err != nil {
+		return nil, err
+	}
+
+	chat.UpdatedAt = removedAt
+	r.touchLocked(chat)
+	if recent, exists := r.userChats[userID]; exists {
+		recent.remove(chatID)
+	}
+	delete(r.unread, chatUserKey(chatID, userID))
+
+	// The former member learns about the removal as well
+	change := domain.Change{Type: domain.ChangeMemberRemoved, ChatID: chatID, UserID: userID, Timestamp: removedAt}
+	r.logChangeLocked(change, append(chat.ParticipantIDs(), userID)...)
+
+	return cloneChat(chat), nil
+}
+
+// UpdateChatMemberRole changes the role of a member of a group chat and returns the updated chat
+func (r *MemoryChatRepository) UpdateChatMemberRole(chatID, userID string, role domain.ChatRole, updatedAt time.Time) (*domain.Chat, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	chat, exists := r.chats[chatID]
+	if !exists {
+		return nil, domain.ErrChatNotFound
+	}
+	if err := chat.SetMemberRole(userID, role); err != nil {
+		return nil, err
+	}
+
+	chat.UpdatedAt = updatedAt
+	r.touchLocked(chat)
+
+	change := domain.Change{Type: domain.ChangeChatUpdated, ChatID: chatID, UserID: userID, Timestamp: updatedAt}
+	r.logChangeLocked(change, chat.ParticipantIDs()...)
+
+	return cloneChat(chat), nil
+}
+
+// UpdateChatTitle renames a group chat and returns the updated chat
+func (r *MemoryChatRepository) UpdateChatTitle(chatID, title string, updatedAt time.Time) (*domain.Chat, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	chat, exists := r.chats[chatID]
+	if !exists {
+		return nil, domain.ErrChatNotFound
+	}
+	if !chat.IsGroup() {
+		return nil, domain.ErrNotGroupChat
+	}
+
+	chat.Title = title
+	chat.UpdatedAt = updatedAt
+	r.touchLocked(chat)
+
+	change := domain.Change{Type: domain.ChangeChatUpdated, ChatID: chatID, Timestamp: updatedAt}
+	r.logChangeLocked(change, chat.ParticipantIDs()...)
+
+	return cloneChat(chat), nil
+}
+
+// FindUserChats retrieves all chats for a user with pagination, summarized with their last message
+// and the user's unread count
+func (r *MemoryChatRepository) FindUserChats(userID string, pagination domain.PaginationParams) ([]*domain.ChatSummary, int, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 
-	total := len(userChats)
+	recent, exists := r.userChats[userID]
+	if !exists {
+		return []*domain.ChatSummary{}, 0, nil
+	}
+
+	total := recent.order.Len()
 	start, end := calculatePaginationBounds(pagination.Page, pagination.PageSize, total)
 
 	if start >= total {
-		return []*domain.Chat{}, total, nil
+		return []*domain.ChatSummary{}, total, nil
+	}
+
+	// The index is already sorted by updated_at (most recent first); walk to the page
+	element := recent.order.Front()
+	for i := 0; i < start; i++ {
+		element = element.Next()
+	}
+
+	result := make([]*domain.ChatSummary, end-start)
+	for i := start; i < end; i, element = i+1, element.Next() {
+		chat := element.Value.(*domain.Chat)
+		summary := &domain.ChatSummary{
+			Chat:        *cloneChat(chat),
+			UnreadCount: r.unread[chatUserKey(chat.ID, userID)],
+		}
+
+		// Messages are appended in order, so the last one is the most recent
+		if messages := r.messages[chat.ID]; len(messages) > 0 {
+			summary.LastMessage = domain.NewMessagePreview(messages[len(messages)-1])
+		}
+
+		result[i-start] = summary
 	}
 
-	return userChats[start:end], total, nil
+	return result, total, nil
 }
 
-// FindChatMessages retrieves messages for a chat with pagination
-func (r *MemoryChatRepository) FindChatMessages(chatID string, pagination domain.PaginationParams) ([]*domain.Message, int, error) {
+// FindChatMessages retrieves messages for a chat with pagination, leaving out the messages the
+// viewer deleted for themselves
+func (r *MemoryChatRepository) FindChatMessages(chatID, viewerID string, pagination domain.PaginationParams) ([]*domain.Message, int, error) {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
@@ -110,6 +352,16 @@ func (r *MemoryChatRepository) FindChatMessages(chatID string, pagination domain
 		return nil, 0, domain.ErrChatNotFound
 	}
 
+	if hidden := r.hidden[chatUserKey(chatID, viewerID)]; len(hidden) > 0 {
+		visible := make([]*domain.Message, 0, len(messages)-len(hidden))
+		for _, msg := range messages {
+			if !hidden[msg.Seq] {
+				visible = append(visible, msg)
+			}
+		}
+		messages = visible
+	}
+
 	total := len(messages)
 	start, end := calculatePaginationBounds(pagination.Page, pagination.PageSize, total)
 
@@ -120,17 +372,118 @@ func (r *MemoryChatRepository) FindChatMessages(chatID string, pagination domain
 	// Return messages in chronological order (oldest first)
 	result := make([]*domain.Message, end-start)
 	for i := start; i < end; i++ {
-		result[i-start] = messages[i]
+		result[i-start] = cloneMessage(messages[i])
 	}
 
 	return result, total, nil
 }
 
+// FindChatMessagesPage retrieves a page of a chat's messages relative to the cursors in params,
+// leaving out the messages the viewer deleted for themselves
+func (r *MemoryChatRepository) FindChatMessagesPage(chatID, viewerID string, params domain.CursorParams) (*domain.MessagePage, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	messages, exists := r.messages[chatID]
+	if !exists {
+		return nil, domain.ErrChatNotFound
+	}
+
+	// Narrow the chat down to the messages strictly between the cursors: positions [low, high),
+	// where the message with sequence number seq sits at position seq-1
+	count := int64(len(messages))
+	low, high := int64(0), count
+	if params.After != nil {
+		if params.After.ChatID != chatID {
+			return nil, domain.ErrInvalidCursor
+		}
+		low = min(params.After.Seq, count)
+	}
+	if params.Before != nil {
+		if params.Before.ChatID != chatID {
+			return nil, domain.ErrInvalidCursor
+		}
+		high = min(params.Before.Seq-1, count)
+	}
+	high = max(high, low)
+
+	hidden := r.hidden[chatUserKey(chatID, viewerID)]
+	page := &domain.MessagePage{
+		Messages:   []*domain.Message{},
+		TotalCount: len(messages) - len(hidden),
+	}
+
+	// Walk from one end of the range, skipping hidden messages, until the page is full; the page
+	// has a next one if a visible message remains in the range, and a previous one if a visible
+	// message lies beyond the end it started from
+	if params.Direction == domain.DirectionBackward {
+		i := high - 1
+		for ; i >= low && len(page.Messages) < params.Limit; i-- {
+			if !hidden[i+1] {
+				page.Messages = append(page.Messages, cloneMessage(messages[i]))
+			}
+		}
+		for ; i >= low && !page.HasNext; i-- {
+			page.HasNext = !hidden[i+1]
+		}
+		for i := high; i < count && !page.HasPrevious; i++ {
+			page.HasPrevious = !hidden[i+1]
+		}
+		return page, nil
+	}
+
+	i := low
+	for ; i < high && len(page.Messages) < params.Limit; i++ {
+		if !hidden[i+1] {
+			page.Messages = append(page.Messages, cloneMessage(messages[i]))
+		}
+	}
+	for ; i < high && !page.HasNext; i++ {
+		page.HasNext = !hidden[i+1]
+	}
+	for i := low - 1; i >= 0 && !page.HasPrevious; i-- {
+		page.HasPrevious = !hidden[i+1]
+	}
+	return page, nil
+}
+
 // AddMessage adds a message to a chat
 func (r *MemoryChatRepository) AddMessage(message *domain.Message) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	return r.addMessageLocked(message)
+}
+
+// AddMessageIfKeyAbsent atomically adds a message unless its sender already used the same
+// idempotency key, in which case the previously stored message is returned with created=false
+func (r *MemoryChatRepository) AddMessageIfKeyAbsent(message *domain.Message) (*domain.Message, bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if message.IdempotencyKey != "" {
+		if existing, exists := r.keys[idempotencyIndexKey(message.SenderID, message.IdempotencyKey)]; exists {
+			return cloneMessage(existing), false, nil
+		}
+	}
+
+	if err := r.addMessageLocked(message); err != nil {
+		return nil, false, err
+	}
+	return message, true, nil
+}
+
+// addMessageLocked stores a message, which claims its attachments; the caller must hold the
+// write lock
+func (r *MemoryChatRepository) addMessageLocked(message *domain.Message) error {
+	// Only uploads of the sender that were not sent yet can be attached
+	for _, attachment := range message.Attachments {
+		stored, exists := r.attachments[attachment.ID]
+		if !exists || stored.UploaderID != message.SenderID || stored.MessageID != "" {
+			return domain.ErrAttachmentUnavailable
+		}
+	}
+
 	if message.ID == "" {
 		message.ID = uuid.New().String()
 	}
@@ -139,30 +492,370 @@ func (r *MemoryChatRepository) AddMessage(message *domain.Message) error {
 		message.Timestamp = time.Now()
 	}
 
-	// Update chat's updated_at timestamp
+	// Messages are appended in sequence order, so a message's position in the chat is Seq-1
+	message.Seq = int64(len(r.messages[message.ChatID])) + 1
+
+	quoted, quotes := r.byID[message.ReplyToID]
+	if quotes {
+		message.Quoted = domain.NewQuotedMessage(quoted)
+	}
+
+	for i, attachment := range message.Attachments {
+		stored := r.attachments[attachment.ID]
+		stored.MessageID = message.ID
+		message.Attachments[i] = *stored
+	}
+
+	stored := cloneMessage(message)
+	r.messages[message.ChatID] = append(r.messages[message.ChatID], stored)
+	r.byID[stored.ID] = stored
+	if quotes {
+		r.replies[quoted.ID] = append(r.replies[quoted.ID], stored)
+	}
+	if message.IdempotencyKey != "" {
+		r.keys[idempotencyIndexKey(message.SenderID, message.IdempotencyKey)] = stored
+	}
+
+	// Update chat's updated_at timestamp and last sequence number, and track the message until
+	// the recipient gets and reads it
 	if chat, exists := r.chats[message.ChatID]; exists {
 		chat.UpdatedAt = time.Now()
+		chat.LastSeq = stored.Seq
+		r.touchLocked(chat)
+		if chat.IsGroup() {
+			// Group messages have no delivery status; members catch up through their read watermarks
+			for _, memberID := range chat.ParticipantIDs() {
+				if memberID != stored.SenderID {
+					r.unread[chatUserKey(chat.ID, memberID)]++
+				}
+			}
+		} else {
+			recipientID := chat.OtherParticipant(stored.SenderID)
+			if stored.Status == domain.StatusSent {
+				r.undelivered[recipientID] = append(r.undelivered[recipientID], stored)
+			}
+			if stored.Status != domain.StatusRead {
+				r.unread[chatUserKey(chat.ID, recipientID)]++
+			}
+		}
+
+		change := domain.Change{Type: domain.ChangeMessageCreated, ChatID: chat.ID, MessageID: stored.ID}
+		r.logChangeLocked(change, chat.ParticipantIDs()...)
 	}
 
-	r.messages[message.ChatID] = append(r.messages[message.ChatID], message)
 	return nil
 }
 
-// UpdateMessageStatus updates the status of a message
-func (r *MemoryChatRepository) UpdateMessageStatus(messageID string, status domain.MessageStatus) error {
+// UpdateMessageStatus moves a message forward to the given status and returns the updated message;
+// transitions that would move it backwards or repeat its status fail with ErrInvalidStatusTransition
+func (r *MemoryChatRepository) UpdateMessageStatus(messageID string, status domain.MessageStatus) (*domain.Message, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	for _, messages := range r.messages {
-		for _, msg := range messages {
-			if msg.ID == messageID {
-				msg.Status = status
-				return nil
+	msg, exists := r.byID[messageID]
+	if !exists {
+		return nil, domain.ErrMessageNotFound
+	}
+
+	if err := r.transitionLocked(msg, status, time.Now()); err != nil {
+		return nil, err
+	}
+	if chat, exists := r.chats[msg.ChatID]; exists {
+		change := domain.Change{Type: domain.ChangeMessageStatus, ChatID: chat.ID, MessageID: msg.ID}
+		r.logChangeLocked(change, chat.ParticipantIDs()...)
+	}
+
+	return cloneMessage(msg), nil
+}
+
+// MarkChatReadUpTo marks every message the other participant sent up to and including messageID
+// as read by the user and advances the user's read watermark of the chat. It returns the watermark
+// and the messages that became read; a message behind the current watermark changes nothing.
+func (r *MemoryChatRepository) MarkChatReadUpTo(chatID, userID, messageID string) (*domain.ReadMark, []*domain.Message, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	messages, exists := r.messages[chatID]
+	if !exists {
+		return nil, nil, domain.ErrChatNotFound
+	}
+
+	msg, exists := r.byID[messageID]
+	if !exists || msg.ChatID != chatID {
+		return nil, nil, domain.ErrMessageNotFound
+	}
+	target := int(msg.Seq - 1)
+
+	key := chatUserKey(chatID, userID)
+	current, exists := r.readMarks[key]
+	if !exists {
+		current = &readMark{index: -1}
+	}
+	if target <= current.index {
+		mark := current.mark
+		return &mark, []*domain.Message{}, nil
+	}
+
+	now := time.Now()
+	read := []*domain.Message{}
+	group := r.chats[chatID].IsGroup()
+	for _, msg := range messages[current.index+1 : target+1] {
+		if msg.SenderID == userID {
+			continue
+		}
+		if group {
+			// Group messages have no status; only the reader's unread count goes down
+			if r.unread[key] > 0 {
+				r.unread[key]--
 			}
+			continue
+		}
+		if msg.Status == domain.StatusRead {
+			continue
+		}
+		if err := r.transitionLocked(msg, domain.StatusRead, now); err != nil {
+			return nil, nil, err
+		}
+		read = append(read, cloneMessage(msg))
+	}
+
+	current.index = target
+	current.mark = domain.ReadMark{
+		ChatID:    chatID,
+		UserID:    userID,
+		MessageID: messageID,
+		ReadAt:    now,
+	}
+	r.readMarks[key] = current
+
+	// One change covers every message that became read
+	if chat, exists := r.chats[chatID]; exists {
+		change := domain.Change{Type: domain.ChangeChatRead, ChatID: chatID, MessageID: messageID, UserID: userID, Timestamp: now}
+		r.logChangeLocked(change, chat.ParticipantIDs()...)
+	}
+
+	mark := current.mark
+	return &mark, read, nil
+}
+
+// EditMessage replaces the content of a message, keeping the previous content as a revision, and
+// returns the updated message
+func (r *MemoryChatRepository) EditMessage(messageID, content string, editedAt time.Time) (*domain.Message, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	msg, exists := r.byID[messageID]
+	if !exists {
+		return nil, domain.ErrMessageNotFound
+	}
+
+	// The replaced content was written when the message was sent or last edited
+	writtenAt := msg.Timestamp
+	if msg.EditedAt != nil {
+		writtenAt = *msg.EditedAt
+	}
+	r.revisions[messageID] = append(r.revisions[messageID], &domain.MessageRevision{
+		MessageID: messageID,
+		Revision:  len(r.revisions[messageID]) + 1,
+		Content:   msg.Content,
+		Timestamp: writtenAt,
+	})
+
+	msg.Content = content
+	msg.EditedAt = &editedAt
+	r.refreshQuotesLocked(msg)
+
+	if chat, exists := r.chats[msg.ChatID]; exists {
+		change := domain.Change{Type: domain.ChangeMessageEdited, ChatID: chat.ID, MessageID: msg.ID, Timestamp: editedAt}
+		r.logChangeLocked(change, chat.ParticipantIDs()...)
+	}
+
+	return cloneMessage(msg), nil
+}
+
+// DeleteMessage replaces a message with a tombstone for both participants, wiping its content and
+// revisions, and returns the tombstone; deleting a tombstone changes nothing
+func (r *MemoryChatRepository) DeleteMessage(messageID string, deletedAt time.Time) (*domain.Message, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	msg, exists := r.byID[messageID]
+	if !exists {
+		return nil, domain.ErrMessageNotFound
+	}
+	if msg.DeletedAt != nil {
+		return cloneMessage(msg), nil
+	}
+
+	for _, attachment := range msg.Attachments {
+		delete(r.attachments, attachment.ID)
+	}
+	msg.Tombstone(deletedAt)
+	delete(r.revisions, messageID)
+	delete(r.reactions, messageID)
+	r.refreshQuotesLocked(msg)
+
+	if chat, exists := r.chats[msg.ChatID]; exists {
+		change := domain.Change{Type: domain.ChangeMessageDeleted, ChatID: chat.ID, MessageID: msg.ID, Timestamp: deletedAt}
+		r.logChangeLocked(change, chat.ParticipantIDs()...)
+	}
+
+	return cloneMessage(msg), nil
+}
+
+// HideMessage deletes a message for the given user only: it no longer shows up in the messages
+// of the chat they list
+func (r *MemoryChatRepository) HideMessage(messageID, userID string, hiddenAt time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	msg, exists := r.byID[messageID]
+	if !exists {
+		return domain.ErrMessageNotFound
+	}
+
+	key := chatUserKey(msg.ChatID, userID)
+	if r.hidden[key][msg.Seq] {
+		return nil
+	}
+	if r.hidden[key] == nil {
+		r.hidden[key] = make(map[int64]bool)
+	}
+	r.hidden[key][msg.Seq] = true
+
+	change := domain.Change{Type: domain.ChangeMessageHidden, ChatID: msg.ChatID, MessageID: msg.ID, UserID: userID, Timestamp: hiddenAt}
+	r.logChangeLocked(change, userID)
+	return nil
+}
+
+// AddReaction adds a participant's reaction to a message and returns the message with its
+// reactions; reacting again with the same emoji changes nothing and reports false. Deleted
+// messages cannot be reacted to.
+func (r *MemoryChatRepository) AddReaction(reaction *domain.Reaction) (*domain.Message, bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	msg, exists := r.byID[reaction.MessageID]
+	if !exists {
+		return nil, false, domain.ErrMessageNotFound
+	}
+	if msg.DeletedAt != nil {
+		return nil, false, domain.ErrMessageDeleted
+	}
+
+	for _, existing := range r.reactions[msg.ID] {
+		if existing.UserID == reaction.UserID && existing.Emoji == reaction.Emoji {
+			return cloneMessage(msg), false, nil
+		}
+	}
+
+	stored := *reaction
+	r.reactions[msg.ID] = append(r.reactions[msg.ID], &stored)
+	msg.Reactions = domain.AggregateReactions(r.reactions[msg.ID])
+
+	if chat, exists := r.chats[msg.ChatID]; exists {
+		change := domain.Change{Type: domain.ChangeReactionAdded, ChatID: chat.ID, MessageID: msg.ID, UserID: reaction.UserID, Timestamp: reaction.CreatedAt}
+		r.logChangeLocked(change, chat.ParticipantIDs()...)
+	}
+
+	return cloneMessage(msg), true, nil
+}
+
+// RemoveReaction takes back a participant's reaction to a message and returns the message with its
+// remaining reactions; removing a reaction that does not exist changes nothing and reports false
+func (r *MemoryChatRepository) RemoveReaction(messageID, userID, emoji string, removedAt time.Time) (*domain.Message, bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	msg, exists := r.byID[messageID]
+	if !exists {
+		return nil, false, domain.ErrMessageNotFound
+	}
+
+	reactions := r.reactions[messageID]
+	for i, existing := range reactions {
+		if existing.UserID != userID || existing.Emoji != emoji {
+			continue
+		}
+
+		r.reactions[messageID] = append(reactions[:i], reactions[i+1:]...)
+		if len(r.reactions[messageID]) == 0 {
+			delete(r.reactions, messageID)
+		}
+		msg.Reactions = domain.AggregateReactions(r.reactions[messageID])
+
+		if chat, exists := r.chats[msg.ChatID]; exists {
+			change := domain.Change{Type: domain.ChangeReactionRemoved, ChatID: chat.ID, MessageID: msg.ID, UserID: userID, Timestamp: removedAt}
+			r.logChangeLocked(change, chat.ParticipantIDs()...)
+		}
+
+		return cloneMessage(msg), true, nil
+	}
+
+	return cloneMessage(msg), false, nil
+}
+
+// FindMessageRevisions returns the earlier contents of a message, oldest first
+func (r *MemoryChatRepository) FindMessageRevisions(messageID string) ([]*domain.MessageRevision, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if _, exists := r.byID[messageID]; !exists {
+		return nil, domain.ErrMessageNotFound
+	}
+
+	revisions := make([]*domain.MessageRevision, len(r.revisions[messageID]))
+	for i, revision := range r.revisions[messageID] {
+		clone := *revision
+		revisions[i] = &clone
+	}
+
+	return revisions, nil
+}
+
+// AddAttachment stores an uploaded attachment that is not part of a message yet
+func (r *MemoryChatRepository) AddAttachment(attachment *domain.Attachment) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if attachment.ID == "" {
+		attachment.ID = uuid.New().String()
+	}
+
+	stored := *attachment
+	r.attachments[attachment.ID] = &stored
+	return nil
+}
+
+// FindAttachment finds an attachment by its ID
+func (r *MemoryChatRepository) FindAttachment(id string) (*domain.Attachment, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	attachment, exists := r.attachments[id]
+	if !exists {
+		return nil, domain.ErrAttachmentNotFound
+	}
+
+	clone := *attachment
+	return &clone, nil
+}
+
+// DeleteUnclaimedAttachments deletes the attachments uploaded before the given time that were never
+// sent in a message and returns them, so their content can be deleted as well
+func (r *MemoryChatRepository) DeleteUnclaimedAttachments(uploadedBefore time.Time) ([]domain.Attachment, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	deleted := []domain.Attachment{}
+	for id, attachment := range r.attachments {
+		if attachment.MessageID == "" && attachment.CreatedAt.Before(uploadedBefore) {
+			deleted = append(deleted, *attachment)
+			delete(r.attachments, id)
 		}
 	}
 
-	return domain.ErrMessageNotFound
+	return deleted, nil
 }
 
 // FindMessageByID finds a message by its ID
@@ -170,34 +863,226 @@ func (r *MemoryChatRepository) FindMessageByID(id string) (*domain.Message, erro
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for _, messages := range r.messages {
-		for _, msg := range messages {
-			if msg.ID == id {
-				return msg, nil
-			}
-		}
+	msg, exists := r.byID[id]
+	if !exists {
+		return nil, domain.ErrMessageNotFound
 	}
 
-	return nil, domain.ErrMessageNotFound
+	return cloneMessage(msg), nil
 }
 
-// FindMessageByKey finds a message by idempotency key
-func (r *MemoryChatRepository) FindMessageByKey(chatID, idempotencyKey string) (*domain.Message, error) {
+// FindVisibleMessage finds a message by its ID as the viewer sees it: messages they deleted for
+// themselves are not found
+func (r *MemoryChatRepository) FindVisibleMessage(id, viewerID string) (*domain.Message, error) {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	messages, exists := r.messages[chatID]
+	msg, exists := r.byID[id]
+	if !exists || r.hidden[chatUserKey(msg.ChatID, viewerID)][msg.Seq] {
+		return nil, domain.ErrMessageNotFound
+	}
+
+	return cloneMessage(msg), nil
+}
+
+// FindMessageByKey finds a message by its sender and idempotency key
+func (r *MemoryChatRepository) FindMessageByKey(senderID, idempotencyKey string) (*domain.Message, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	msg, exists := r.keys[idempotencyIndexKey(senderID, idempotencyKey)]
 	if !exists {
-		return nil, domain.ErrChatNotFound
+		return nil, domain.ErrMessageNotFound
+	}
+
+	return cloneMessage(msg), nil
+}
+
+// FindUndeliveredMessages returns up to limit of the oldest messages addressed to the recipient
+// that are still in "sent" status, along with the total number of such messages
+func (r *MemoryChatRepository) FindUndeliveredMessages(recipientID string, limit int) ([]*domain.Message, int, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	pending := r.undelivered[recipientID]
+	total := len(pending)
+	if limit > total {
+		limit = total
+	}
+
+	result := make([]*domain.Message, limit)
+	for i := 0; i < limit; i++ {
+		result[i] = cloneMessage(pending[i])
+	}
+
+	return result, total, nil
+}
+
+// FindChanges returns up to limit entries of the user's change log that follow afterSeq, oldest
+// first, and whether more entries follow them. Pruned entries are skipped.
+func (r *MemoryChatRepository) FindChanges(userID string, afterSeq int64, limit int) ([]*domain.Change, bool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	// Entry seq sits at position seq-first of the log, first being the seq of its oldest kept entry
+	log := r.changes[userID]
+	first := int64(1)
+	if len(log) > 0 {
+		first = log[0].Seq
+	}
+	start := min(max(afterSeq+1-first, 0), int64(len(log)))
+	end := min(start+int64(limit), int64(len(log)))
+
+	changes := make([]*domain.Change, 0, end-start)
+	for _, change := range log[start:end] {
+		entry := *change
+		changes = append(changes, &entry)
 	}
 
-	for _, msg := range messages {
-		if msg.IdempotencyKey == idempotencyKey {
-			return msg, nil
+	return changes, end < int64(len(log)), nil
+}
+
+// DeleteChangesBefore prunes the entries logged before the given time from the front of every
+// change log and returns how many were deleted. The newest entry of a log is always kept so that
+// sequence numbers keep growing.
+func (r *MemoryChatRepository) DeleteChangesBefore(loggedBefore time.Time) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	deleted := 0
+	for userID, log := range r.changes {
+		pruned := 0
+		for pruned < len(log)-1 && log[pruned].Timestamp.Before(loggedBefore) {
+			pruned++
+		}
+		if pruned > 0 {
+			// Copy the kept entries so the pruned ones can be garbage collected
+			r.changes[userID] = append([]*domain.Change(nil), log[pruned:]...)
+			deleted += pruned
+		}
+	}
+
+	return deleted, nil
+}
+
+// logChangeLocked appends the change to the change log of every given user; the caller must hold
+// the write lock
+func (r *MemoryChatRepository) logChangeLocked(change domain.Change, userIDs ...string) {
+	if change.Timestamp.IsZero() {
+		change.Timestamp = time.Now()
+	}
+
+	for _, userID := range userIDs {
+		log := r.changes[userID]
+		entry := change
+		entry.Seq = 1
+		if len(log) > 0 {
+			entry.Seq = log[len(log)-1].Seq + 1
+		}
+		r.changes[userID] = append(log, &entry)
+	}
+}
+
+// touchLocked moves a chat to the front of its participants' recent chats, which must follow
+// every update of its UpdatedAt; the caller must hold the write lock
+func (r *MemoryChatRepository) touchLocked(chat *domain.Chat) {
+	for _, userID := range chat.ParticipantIDs() {
+		recent, exists := r.userChats[userID]
+		if !exists {
+			recent = &recentChats{order: list.New(), elements: make(map[string]*list.Element)}
+			r.userChats[userID] = recent
+		}
+		recent.touch(chat)
+	}
+}
+
+// transitionLocked moves a stored message to the given status and updates the delivery and
+// unread tracking accordingly; the caller must hold the write lock
+func (r *MemoryChatRepository) transitionLocked(message *domain.Message, status domain.MessageStatus, at time.Time) error {
+	if err := message.TransitionTo(status, at); err != nil {
+		return err
+	}
+
+	r.removeUndeliveredLocked(message)
+	if status == domain.StatusRead {
+		if chat, exists := r.chats[message.ChatID]; exists {
+			key := chatUserKey(chat.ID, chat.OtherParticipant(message.SenderID))
+			if r.unread[key] > 0 {
+				r.unread[key]--
+			}
 		}
 	}
 
-	return nil, domain.ErrMessageNotFound
+	return nil
+}
+
+// removeUndeliveredLocked stops tracking a message that left the "sent" status;
+// the caller must hold the write lock
+func (r *MemoryChatRepository) removeUndeliveredLocked(message *domain.Message) {
+	chat, exists := r.chats[message.ChatID]
+	if !exists {
+		return
+	}
+
+	recipientID := chat.OtherParticipant(message.SenderID)
+	pending := r.undelivered[recipientID]
+	for i, msg := range pending {
+		if msg == message {
+			r.undelivered[recipientID] = append(pending[:i], pending[i+1:]...)
+			break
+		}
+	}
+
+	if len(r.undelivered[recipientID]) == 0 {
+		delete(r.undelivered, recipientID)
+	}
+}
+
+// refreshQuotesLocked updates the quote of the message in every reply to it after an edit or a
+// deletion; the caller must hold the write lock
+func (r *MemoryChatRepository) refreshQuotesLocked(message *domain.Message) {
+	for _, reply := range r.replies[message.ID] {
+		reply.Quoted = domain.NewQuotedMessage(message)
+	}
+}
+
+// cloneChat returns a copy of a chat that is safe to hand out or store
+func cloneChat(chat *domain.Chat) *domain.Chat {
+	clone := *chat
+	if chat.Members != nil {
+		clone.Members = append([]domain.ChatMember(nil), chat.Members...)
+	}
+	return &clone
+}
+
+// cloneMessage returns a copy of a message that is safe to hand out or store
+func cloneMessage(message *domain.Message) *domain.Message {
+	clone := *message
+	if message.Quoted != nil {
+		quoted := *message.Quoted
+		clone.Quoted = &quoted
+	}
+	if message.Attachments != nil {
+		clone.Attachments = append([]domain.Attachment(nil), message.Attachments...)
+	}
+	if message.Reactions != nil {
+		clone.Reactions = make([]domain.ReactionSummary, len(message.Reactions))
+		for i, summary := range message.Reactions {
+			clone.Reactions[i] = summary
+			clone.Reactions[i].UserIDs = append([]string(nil), summary.UserIDs...)
+		}
+	}
+	return &clone
+}
+
+// idempotencyIndexKey builds the lookup key for idempotency keys, which are scoped per sender
+func idempotencyIndexKey(senderID, idempotencyKey string) string {
+	return senderID + "\x00" + idempotencyKey
+}
+
+// chatUserKey builds the lookup key of per-user chat state such as read watermarks
+func chatUserKey(chatID, userID string) string {
+	return chatID + "\x00" + userID
 }
 
 // calculatePaginationBounds calculates start and end indices for pagination
@@ -0,0 +1,98 @@
+package repositories
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"messaging-app/domain"
+)
+
+// FileBlobStore implements BlobStore on the local filesystem. Blobs are spread over subdirectories
+// named after the first two characters of their key so that no directory grows too large.
+type FileBlobStore struct {
+	root string
+}
+
+// NewFileBlobStore creates a blob store keeping its files below root; the directory is created on
+// the first write
+func NewFileBlobStore(root string) *FileBlobStore {
+	return &FileBlobStore{root: root}
+}
+
+// errInvalidBlobKey rejects keys that could escape the store's directory
+var errInvalidBlobKey = errors.New("invalid blob key")
+
+// path maps a key to its file; keys are limited to letters, digits, '-' and '_'
+func (s *FileBlobStore) path(key string) (string, error) {
+	if len(key) < 3 || strings.IndexFunc(key, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) >= 0 {
+		return "", errInvalidBlobKey
+	}
+
+	return filepath.Join(s.root, key[:2], key), nil
+}
+
+// Put stores the content under the key, replacing any earlier blob, and returns its size. The
+// content is written to a temporary file first, so a failed write never leaves a partial blob.
+func (s *FileBlobStore) Put(key string, content io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(dir, key+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, content)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	return size, os.Rename(tmp.Name(), path)
+}
+
+// Open returns a reader of the blob stored under the key; the caller must close it
+func (s *FileBlobStore) Open(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, domain.ErrBlobNotFound
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, domain.ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// Delete removes the blob stored under the key
+func (s *FileBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,11 @@
 package repositories
 
-import "messaging-app/domain"
+import (
+	"io"
+	"time"
+
+	"messaging-app/domain"
+)
 
 // UserRepository defines the interface for user data operations
 type UserRepository interface {
@@ -15,10 +20,39 @@ type ChatRepository interface {
 	Create(chat *domain.Chat) error
 	FindByID(id string) (*domain.Chat, error)
 	FindByParticipants(user1ID, user2ID string) (*domain.Chat, error)
-	FindUserChats(userID string, pagination domain.PaginationParams) ([]*domain.Chat, int, error)
-	FindChatMessages(chatID string, pagination domain.PaginationParams) ([]*domain.Message, int, error)
+	FindOrCreateByParticipants(user1ID, user2ID string) (*domain.Chat, error)
+	SharesChat(user1ID, user2ID string) (bool, error)
+	AddChatMember(chatID string, member domain.ChatMember) (*domain.Chat, error)
+	RemoveChatMember(chatID, userID string, removedAt time.Time) (*domain.Chat, error)
+	UpdateChatMemberRole(chatID, userID string, role domain.ChatRole, updatedAt time.Time) (*domain.Chat, error)
+	UpdateChatTitle(chatID, title string, updatedAt time.Time) (*domain.Chat, error)
+	FindUserChats(userID string, pagination domain.PaginationParams) ([]*domain.ChatSummary, int, error)
+	FindChatMessages(chatID, viewerID string, pagination domain.PaginationParams) ([]*domain.Message, int, error)
+	FindChatMessagesPage(chatID, viewerID string, params domain.CursorParams) (*domain.MessagePage, error)
 	AddMessage(message *domain.Message) error
-	UpdateMessageStatus(messageID string, status domain.MessageStatus) error
+	AddMessageIfKeyAbsent(message *domain.Message) (*domain.Message, bool, error)
+	UpdateMessageStatus(messageID string, status domain.MessageStatus) (*domain.Message, error)
+	MarkChatReadUpTo(chatID, userID, messageID string) (*domain.ReadMark, []*domain.Message, error)
+	EditMessage(messageID, content string, editedAt time.Time) (*domain.Message, error)
+	FindMessageRevisions(messageID string) ([]*domain.MessageRevision, error)
+	DeleteMessage(messageID string, deletedAt time.Time) (*domain.Message, error)
+	HideMessage(messageID, userID string, hiddenAt time.Time) error
+	AddReaction(reaction *domain.Reaction) (*domain.Message, bool, error)
+	RemoveReaction(messageID, userID, emoji string, removedAt time.Time) (*domain.Message, bool, error)
+	AddAttachment(attachment *domain.Attachment) error
+	FindAttachment(id string) (*domain.Attachment, error)
+	DeleteUnclaimedAttachments(uploadedBefore time.Time) ([]domain.Attachment, error)
 	FindMessageByID(id string) (*domain.Message, error)
-	FindMessageByKey(chatID, idempotencyKey string) (*domain.Message, error)
+	FindVisibleMessage(id, viewerID string) (*domain.Message, error)
+	FindMessageByKey(senderID, idempotencyKey string) (*domain.Message, error)
+	FindUndeliveredMessages(recipientID string, limit int) ([]*domain.Message, int, error)
+	FindChanges(userID string, afterSeq int64, limit int) ([]*domain.Change, bool, error)
+	DeleteChangesBefore(loggedBefore time.Time) (int, error)
+}
+
+// BlobStore keeps the binary content of attachments under keys chosen by the caller
+type BlobStore interface {
+	Put(key string, content io.Reader) (int64, error)
+	Open(key string) (io.ReadCloser, error) // fails with ErrBlobNotFound for unknown keys
+	Delete(key string) error                // deleting an unknown key is not an error
 }
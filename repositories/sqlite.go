@@ -0,0 +1,329 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"messaging-app/domain"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema creates the tables and indexes used by the SQLite repositories
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id            TEXT PRIMARY KEY,
+	username      TEXT NOT NULL UNIQUE,
+	username_key  TEXT,
+	password_hash TEXT NOT NULL DEFAULT '',
+	created_at    TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS chats (
+	id           TEXT PRIMARY KEY,
+	participant1 TEXT NOT NULL,
+	participant2 TEXT NOT NULL,
+	pair_key     TEXT NOT NULL UNIQUE, -- the chat ID for group chats
+	created_at   TIMESTAMP NOT NULL,
+	updated_at   TIMESTAMP NOT NULL,
+	last_seq     INTEGER NOT NULL DEFAULT 0,
+	type         TEXT NOT NULL DEFAULT 'direct',
+	title        TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_chats_participant1 ON chats (participant1, updated_at);
+CREATE INDEX IF NOT EXISTS idx_chats_participant2 ON chats (participant2, updated_at);
+
+CREATE TABLE IF NOT EXISTS chat_members (
+	chat_id   TEXT NOT NULL REFERENCES chats (id),
+	user_id   TEXT NOT NULL,
+	role      TEXT NOT NULL,
+	joined_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (chat_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_members_user ON chat_members (user_id);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id              TEXT PRIMARY KEY,
+	chat_id         TEXT NOT NULL REFERENCES chats (id),
+	sender_id       TEXT NOT NULL,
+	content         TEXT NOT NULL,
+	status          TEXT NOT NULL,
+	timestamp       TIMESTAMP NOT NULL,
+	idempotency_key TEXT NOT NULL DEFAULT '',
+	delivered_at    TIMESTAMP,
+	read_at         TIMESTAMP,
+	seq             INTEGER NOT NULL DEFAULT 0,
+	edited_at       TIMESTAMP,
+	deleted_at      TIMESTAMP,
+	reply_to_id     TEXT NOT NULL DEFAULT '',
+	quoted_sender   TEXT NOT NULL DEFAULT '',
+	quoted_snippet  TEXT NOT NULL DEFAULT '',
+	quoted_deleted  INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_chat_timestamp ON messages (chat_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_messages_undelivered ON messages (chat_id, timestamp) WHERE status = 'sent';
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_idempotency_key ON messages (sender_id, idempotency_key) WHERE idempotency_key <> '';
+CREATE INDEX IF NOT EXISTS idx_messages_unread ON messages (chat_id, sender_id) WHERE status <> 'read';
+
+CREATE TABLE IF NOT EXISTS changes (
+	user_id    TEXT NOT NULL,
+	seq        INTEGER NOT NULL,
+	type       TEXT NOT NULL,
+	chat_id    TEXT NOT NULL,
+	message_id TEXT NOT NULL DEFAULT '',
+	actor_id   TEXT NOT NULL DEFAULT '',
+	timestamp  TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_changes_timestamp ON changes (timestamp);
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+	message_id TEXT NOT NULL REFERENCES messages (id),
+	revision   INTEGER NOT NULL,
+	content    TEXT NOT NULL,
+	timestamp  TIMESTAMP NOT NULL,
+	PRIMARY KEY (message_id, revision)
+);
+
+CREATE TABLE IF NOT EXISTS hidden_messages (
+	message_id TEXT NOT NULL REFERENCES messages (id),
+	user_id    TEXT NOT NULL,
+	hidden_at  TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS reactions (
+	message_id TEXT NOT NULL REFERENCES messages (id),
+	user_id    TEXT NOT NULL,
+	emoji      TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (message_id, user_id, emoji)
+);
+
+CREATE TABLE IF NOT EXISTS attachments (
+	id            TEXT PRIMARY KEY,
+	message_id    TEXT NOT NULL DEFAULT '', -- empty until the attachment is sent
+	position      INTEGER NOT NULL DEFAULT 0,
+	uploader_id   TEXT NOT NULL,
+	file_name     TEXT NOT NULL,
+	content_type  TEXT NOT NULL,
+	kind          TEXT NOT NULL,
+	size          INTEGER NOT NULL,
+	width         INTEGER NOT NULL DEFAULT 0,
+	height        INTEGER NOT NULL DEFAULT 0,
+	has_thumbnail INTEGER NOT NULL DEFAULT 0,
+	created_at    TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments (message_id, position);
+CREATE INDEX IF NOT EXISTS idx_attachments_unclaimed ON attachments (message_id, created_at);
+
+CREATE TABLE IF NOT EXISTS chat_reads (
+	chat_id    TEXT NOT NULL REFERENCES chats (id),
+	user_id    TEXT NOT NULL,
+	message_id TEXT NOT NULL REFERENCES messages (id),
+	read_at    TIMESTAMP NOT NULL,
+	PRIMARY KEY (chat_id, user_id)
+);
+`
+
+// sqliteColumnMigrations adds columns introduced after a table was first created, so databases
+// created by earlier versions keep working; CREATE TABLE above already includes them
+var sqliteColumnMigrations = []struct {
+	table, column, definition string
+}{
+	{"messages", "delivered_at", "TIMESTAMP"},
+	{"messages", "read_at", "TIMESTAMP"},
+	{"messages", "seq", "INTEGER NOT NULL DEFAULT 0"},
+	{"chats", "last_seq", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "username_key", "TEXT"},
+	{"messages", "edited_at", "TIMESTAMP"},
+	{"messages", "deleted_at", "TIMESTAMP"},
+	{"messages", "reply_to_id", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "quoted_sender", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "quoted_snippet", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "quoted_deleted", "INTEGER NOT NULL DEFAULT 0"},
+	{"chats", "type", "TEXT NOT NULL DEFAULT 'direct'"},
+	{"chats", "title", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// sqliteBackfill runs after the column migrations: it numbers messages stored before sequence
+// numbers existed, in their chat order, and creates the indexes that depend on migrated columns.
+// Username keys are backfilled afterwards by backfillUsernameKeys, which needs Go normalization.
+const sqliteBackfill = `
+UPDATE messages SET seq = (
+	SELECT COUNT(*) FROM messages p
+	WHERE p.chat_id = messages.chat_id AND (p.timestamp, p.rowid) <= (messages.timestamp, messages.rowid)
+) WHERE seq = 0;
+
+UPDATE chats SET last_seq = (SELECT COALESCE(MAX(seq), 0) FROM messages WHERE chat_id = chats.id)
+WHERE last_seq = 0;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_chat_seq ON messages (chat_id, seq);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_key ON users (username_key);
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages (reply_to_id) WHERE reply_to_id <> '';
+`
+
+// OpenSQLite opens (or creates) the SQLite database at path and applies the schema
+func OpenSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer; serializing connections avoids "database is locked"
+	// errors and keeps in-memory databases (":memory:") shared across queries
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, migration := range sqliteColumnMigrations {
+		if err := ensureColumn(db, migration.table, migration.column, migration.definition); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := db.Exec(sqliteBackfill); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := backfillUsernameKeys(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// backfillUsernameKeys stores the normalized username of users created before usernames were
+// normalized. Where earlier versions let several users register the same normalized name, the
+// oldest user keeps it and the others stay without a key, so they can no longer be looked up by
+// username.
+func backfillUsernameKeys(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, username FROM users WHERE username_key IS NULL ORDER BY created_at, rowid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	usernames := make(map[string]string) // userID -> username
+	var ids []string
+	for rows.Next() {
+		var id, username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return err
+		}
+		usernames[id] = username
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		key := domain.NormalizeUsername(usernames[id])
+		_, err := db.Exec(
+			`UPDATE users SET username_key = ? WHERE id = ? AND NOT EXISTS (SELECT 1 FROM users WHERE username_key = ?)`,
+			key, id, key,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureColumn adds the column to the table unless it already exists
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+// qualifyColumns prefixes every column of a comma separated list with a table alias
+func qualifyColumns(alias, columns string) string {
+	return alias + "." + strings.ReplaceAll(columns, ", ", ", "+alias+".")
+}
+
+// nullTime converts an optional timestamp into a value for a nullable TIMESTAMP column
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+// timePtr converts a nullable TIMESTAMP column into an optional timestamp
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// queryer runs queries on the database or within a transaction
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// isUniqueViolation reports whether err is a SQLite UNIQUE constraint failure
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+// normalizePagination applies the same defaults as calculatePaginationBounds and
+// returns the LIMIT/OFFSET pair for a SQL query
+func normalizePagination(pagination domain.PaginationParams) (limit, offset int) {
+	page := pagination.Page
+	pageSize := pagination.PageSize
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = 20
+	}
+
+	return pageSize, (page - 1) * pageSize
+}
@@ -0,0 +1,1481 @@
+package repositories
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"messaging-app/domain"
+
+	"github.com/google/uuid"
+)
+
+// SQLiteChatRepository implements ChatRepository backed by a SQLite database
+type SQLiteChatRepository struct {
+	db *sql.DB
+}
+
+// NewSQLiteChatRepository creates a new SQLite chat repository using a database opened with OpenSQLite
+func NewSQLiteChatRepository(db *sql.DB) *SQLiteChatRepository {
+	return &SQLiteChatRepository{
+		db: db,
+	}
+}
+
+const (
+	chatColumns       = `id, type, title, participant1, participant2, created_at, updated_at, last_seq`
+	attachmentColumns = `id, message_id, uploader_id, file_name, content_type, kind, size, width, height, has_thumbnail, created_at`
+	messageColumns    = `id, chat_id, sender_id, content, status, timestamp, idempotency_key, delivered_at, read_at, seq, edited_at, deleted_at, reply_to_id, quoted_sender, quoted_snippet, quoted_deleted`
+
+	// visibleTo filters out the messages a user deleted for themselves; it takes the user ID
+	visibleTo = `id NOT IN (SELECT message_id FROM hidden_messages WHERE user_id = ?)`
+)
+
+// Create adds a new 1:1 or group chat to the repository
+func (r *SQLiteChatRepository) Create(chat *domain.Chat) error {
+	if chat.ID == "" {
+		chat.ID = uuid.New().String()
+	}
+
+	if chat.CreatedAt.IsZero() {
+		chat.CreatedAt = time.Now()
+	}
+
+	if chat.Type == "" {
+		chat.Type = domain.ChatDirect
+	}
+
+	chat.UpdatedAt = time.Now()
+
+	// Group chats have no participant pair; their ID keeps pair_key unique
+	pairKey := chat.PairKey()
+	if chat.IsGroup() {
+		pairKey = chat.ID
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO chats (`+chatColumns+`, pair_key) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		chat.ID, chat.Type, chat.Title, chat.Participant1, chat.Participant2,
+		chat.CreatedAt.UTC(), chat.UpdatedAt.UTC(), chat.LastSeq, pairKey,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrChatExists
+		}
+		return err
+	}
+
+	if err := saveMembers(tx, chat); err != nil {
+		return err
+	}
+
+	change := domain.Change{Type: domain.ChangeChatCreated, ChatID: chat.ID}
+	if err := logChange(tx, change, chat.ParticipantIDs()...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FindByID retrieves a chat by its ID
+func (r *SQLiteChatRepository) FindByID(id string) (*domain.Chat, error) {
+	chat, err := scanChat(r.db.QueryRow(`SELECT `+chatColumns+` FROM chats WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+
+	return chat, loadMembers(r.db, chat)
+}
+
+// FindByParticipants finds a chat between two users
+func (r *SQLiteChatRepository) FindByParticipants(user1ID, user2ID string) (*domain.Chat, error) {
+	row := r.db.QueryRow(
+		`SELECT `+chatColumns+` FROM chats WHERE pair_key = ?`,
+		domain.ParticipantPairKey(user1ID, user2ID),
+	)
+	return scanChat(row)
+}
+
+// SharesChat reports whether both users take part in a common chat, 1:1 or group
+func (r *SQLiteChatRepository) SharesChat(user1ID, user2ID string) (bool, error) {
+	var shares bool
+	err := r.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM chats WHERE pair_key = ?)
+		     OR EXISTS (SELECT 1 FROM chat_members a JOIN chat_members b ON b.chat_id = a.chat_id
+		                WHERE a.user_id = ? AND b.user_id = ?)`,
+		domain.ParticipantPairKey(user1ID, user2ID), user1ID, user2ID,
+	).Scan(&shares)
+	return shares, err
+}
+
+// FindOrCreateByParticipants atomically returns the chat between two users, creating it if needed
+func (r *SQLiteChatRepository) FindOrCreateByParticipants(user1ID, user2ID string) (*domain.Chat, error) {
+	now := time.Now().UTC()
+	chatID := uuid.New().String()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The UNIQUE pair_key constraint guarantees a single chat per pair even with concurrent writers
+	result, err := tx.Exec(
+		`INSERT INTO chats (`+chatColumns+`, pair_key) VALUES (?, ?, '', ?, ?, ?, ?, 0, ?)
+		 ON CONFLICT (pair_key) DO NOTHING`,
+		chatID, domain.ChatDirect, user1ID, user2ID, now, now, domain.ParticipantPairKey(user1ID, user2ID),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if created, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if created > 0 {
+		change := domain.Change{Type: domain.ChangeChatCreated, ChatID: chatID}
+		if err := logChange(tx, change, user1ID, user2ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return r.FindByParticipants(user1ID, user2ID)
+}
+
+// AddChatMember adds a member to a group chat and returns the updated chat; the new member's read
+// watermark starts at the chat's last message
+func (r *SQLiteChatRepository) AddChatMember(chatID string, member domain.ChatMember) (*domain.Chat, error) {
+	return r.updateGroup(chatID, member.JoinedAt, func(tx *sql.Tx, chat *domain.Chat) (domain.Change, []string, error) {
+		if err := chat.AddMember(member); err != nil {
+			return domain.Change{}, nil, err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM chat_reads WHERE chat_id = ? AND user_id = ?`, chatID, member.UserID); err != nil {
+			return domain.Change{}, nil, err
+		}
+		_, err := tx.Exec(
+			`INSERT INTO chat_reads (chat_id, user_id, message_id, read_at)
+			 SELECT chat_id, ?, id, ? FROM messages WHERE chat_id = ? AND seq = ?`,
+			member.UserID, member.JoinedAt.UTC(), chatID, chat.LastSeq,
+		)
+		if err != nil {
+			return domain.Change{}, nil, err
+		}
+
+		change := domain.Change{Type: domain.ChangeMemberAdded, ChatID: chatID, UserID: member.UserID, Timestamp: member.JoinedAt}
+		return change, chat.ParticipantIDs(), nil
+	})
+}
+
+// RemoveChatMember removes a member from a group chat, handing ownership on when the owner leaves,
+// and returns the updated chat
+func (r *SQLiteChatRepository) RemoveChatMember(chatID, userID string, removedAt time.Time) (*domain.Chat, error) {
+	return r.updateGroup(chatID, removedAt, func(tx *sql.Tx, chat *domain.Chat) (domain.Change, []string, error) {
+		if err := chat.RemoveMember(userID); err != nil {
+			return domain.Change{}, nil, err
+		}
+
+		// The former member learns about the removal as well
+		change := domain.Change{Type: domain.ChangeMemberRemoved, ChatID: chatID, UserID: userID, Timestamp: removedAt}
+		return change, append(chat.ParticipantIDs(), userID), nil
+	})
+}
+
+// UpdateChatMemberRole changes the role of a member of a group chat and returns the updated chat
+func (r *SQLiteChatRepository) UpdateChatMemberRole(chatID, userID string, role domain.ChatRole, updatedAt time.Time) (*domain.Chat, error) {
+	return r.updateGroup(chatID, updatedAt, func(tx *sql.Tx, chat *domain.Chat) (domain.Change, []string, error) {
+		if err := chat.SetMemberRole(userID, role); err != nil {
+			return domain.Change{}, nil, err
+		}
+
+		change := domain.Change{Type: domain.ChangeChatUpdated, ChatID: chatID, UserID: userID, Timestamp: updatedAt}
+		return change, chat.ParticipantIDs(), nil
+	})
+}
+
+// UpdateChatTitle renames a group chat and returns the updated chat
+func (r *SQLiteChatRepository) UpdateChatTitle(chatID, title string, updatedAt time.Time) (*domain.Chat, error) {
+	return r.updateGroup(chatID, updatedAt, func(tx *sql.Tx, chat *domain.Chat) (domain.Change, []string, error) {
+		chat.Title = title
+
+		change := domain.Change{Type: domain.ChangeChatUpdated, ChatID: chatID, Timestamp: updatedAt}
+		return change, chat.ParticipantIDs(), nil
+	})
+}
+
+// updateGroup loads a group chat with its members in a transaction, applies update to it and stores
+// the result, logging the change update returns for the given users
+func (r *SQLiteChatRepository) updateGroup(chatID string, updatedAt time.Time, update func(tx *sql.Tx, chat *domain.Chat) (domain.Change, []string, error)) (*domain.Chat, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	chat, err := scanChat(tx.QueryRow(`SELECT `+chatColumns+` FROM chats WHERE id = ?`, chatID))
+	if err != nil {
+		return nil, err
+	}
+	if !chat.IsGroup() {
+		return nil, domain.ErrNotGroupChat
+	}
+	if err := loadMembers(tx, chat); err != nil {
+		return nil, err
+	}
+
+	change, userIDs, err := update(tx, chat)
+	if err != nil {
+		return nil, err
+	}
+
+	chat.UpdatedAt = updatedAt
+	_, err = tx.Exec(`UPDATE chats SET title = ?, updated_at = ? WHERE id = ?`, chat.Title, chat.UpdatedAt.UTC(), chatID)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveMembers(tx, chat); err != nil {
+		return nil, err
+	}
+	if err := logChange(tx, change, userIDs...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return chat, nil
+}
+
+// FindUserChats retrieves all chats for a user with pagination, summarized with their last message
+// and the user's unread count
+func (r *SQLiteChatRepository) FindUserChats(userID string, pagination domain.PaginationParams) ([]*domain.ChatSummary, int, error) {
+	const userChatsFilter = `c.participant1 = ? OR c.participant2 = ? OR c.id IN (SELECT chat_id FROM chat_members WHERE user_id = ?)`
+
+	var total int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM chats c WHERE `+userChatsFilter, userID, userID, userID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The last message is looked up by its sequence number and only the start of its content is
+	// loaded. In 1:1 chats the unread count uses idx_messages_unread; group messages have no
+	// status, so there it counts the messages of others after the user's read watermark.
+	limit, offset := normalizePagination(pagination)
+	rows, err := r.db.Query(
+		`SELECT `+qualifyColumns("c", chatColumns)+`,
+		   CASE WHEN c.type = 'group' THEN
+		     (SELECT COUNT(*) FROM messages u
+		      WHERE u.chat_id = c.id AND u.sender_id <> ? AND u.seq > COALESCE(
+		        (SELECT w.seq FROM chat_reads r JOIN messages w ON w.id = r.message_id
+		         WHERE r.chat_id = c.id AND r.user_id = ?), 0))
+		   ELSE
+		     (SELECT COUNT(*) FROM messages u
+		      WHERE u.chat_id = c.id AND u.sender_id <> ? AND u.status <> 'read')
+		   END,
+		   m.id, m.seq, m.sender_id, substr(m.content, 1, ?), m.status, m.timestamp,
+		   (SELECT COUNT(*) FROM attachments a WHERE a.message_id = m.id)
+		 FROM chats c
+		 LEFT JOIN messages m ON m.chat_id = c.id AND m.seq = c.last_seq
+		 WHERE `+userChatsFilter+`
+		 ORDER BY c.updated_at DESC
+		 LIMIT ? OFFSET ?`,
+		userID, userID, userID, domain.MessagePreviewLength+1, userID, userID, userID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	summaries := []*domain.ChatSummary{}
+	for rows.Next() {
+		var unreadCount, lastAttachments int
+		var lastID, lastSenderID, lastContent, lastStatus sql.NullString
+		var lastSeq sql.NullInt64
+		var lastTimestamp sql.NullTime
+		chat, err := scanChat(rows, &unreadCount, &lastID, &lastSeq, &lastSenderID, &lastContent, &lastStatus, &lastTimestamp, &lastAttachments)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		summary := &domain.ChatSummary{
+			Chat:        *chat,
+			UnreadCount: unreadCount,
+		}
+		if lastID.Valid {
+			summary.LastMessage = &domain.MessagePreview{
+				ID:        lastID.String,
+				Seq:       lastSeq.Int64,
+				SenderID:  lastSenderID.String,
+				Preview:   domain.TruncatePreview(lastContent.String),
+				Status:    domain.MessageStatus(lastStatus.String),
+				Timestamp: lastTimestamp.Time,
+
+				AttachmentCount: lastAttachments,
+			}
+		}
+
+		summaries = append(summaries, summary)
+	}
+	// The rows hold the only connection until closed, which members are loaded over
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	chats := make([]*domain.Chat, len(summaries))
+	for i, summary := range summaries {
+		chats[i] = &summary.Chat
+	}
+	if err := loadMembers(r.db, chats...); err != nil {
+		return nil, 0, err
+	}
+
+	return summaries, total, nil
+}
+
+// FindChatMessages retrieves messages for a chat with pagination, leaving out the messages the
+// viewer deleted for themselves
+func (r *SQLiteChatRepository) FindChatMessages(chatID, viewerID string, pagination domain.PaginationParams) ([]*domain.Message, int, error) {
+	if _, err := r.FindByID(chatID); err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE chat_id = ? AND `+visibleTo, chatID, viewerID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Return messages in chronological order (oldest first)
+	limit, offset := normalizePagination(pagination)
+	messages, err := queryMessages(r.db,
+		`SELECT `+messageColumns+` FROM messages
+		 WHERE chat_id = ? AND `+visibleTo+`
+		 ORDER BY seq
+		 LIMIT ? OFFSET ?`,
+		chatID, viewerID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return messages, total, nil
+}
+
+// FindChatMessagesPage retrieves a page of a chat's messages relative to the cursors in params,
+// leaving out the messages the viewer deleted for themselves
+func (r *SQLiteChatRepository) FindChatMessagesPage(chatID, viewerID string, params domain.CursorParams) (*domain.MessagePage, error) {
+	if _, err := r.FindByID(chatID); err != nil {
+		return nil, err
+	}
+
+	page := &domain.MessagePage{Messages: []*domain.Message{}}
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE chat_id = ? AND `+visibleTo, chatID, viewerID).Scan(&page.TotalCount)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := `chat_id = ? AND ` + visibleTo
+	args := []interface{}{chatID, viewerID}
+	if params.After != nil {
+		if params.After.ChatID != chatID {
+			return nil, domain.ErrInvalidCursor
+		}
+		conditions += ` AND seq > ?`
+		args = append(args, params.After.Seq)
+	}
+	if params.Before != nil {
+		if params.Before.ChatID != chatID {
+			return nil, domain.ErrInvalidCursor
+		}
+		conditions += ` AND seq < ?`
+		args = append(args, params.Before.Seq)
+	}
+
+	// A previous page exists if a visible message lies beyond the cursor the page starts from
+	order, start, beyondStart := `seq`, params.After, `seq <= ?`
+	if params.Direction == domain.DirectionBackward {
+		order, start, beyondStart = `seq DESC`, params.Before, `seq >= ?`
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	page.Messages, err = queryMessages(r.db,
+		`SELECT `+messageColumns+` FROM messages WHERE `+conditions+` ORDER BY `+order+` LIMIT ?`,
+		append(args, params.Limit+1)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.Messages) > params.Limit {
+		page.Messages = page.Messages[:params.Limit]
+		page.HasNext = true
+	}
+
+	if start != nil {
+		err := r.db.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM messages WHERE chat_id = ? AND `+visibleTo+` AND `+beyondStart+`)`,
+			chatID, viewerID, start.Seq,
+		).Scan(&page.HasPrevious)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+// AddMessage adds a message to a chat
+func (r *SQLiteChatRepository) AddMessage(message *domain.Message) error {
+	_, _, err := r.insertMessage(message, false)
+	return err
+}
+
+// AddMessageIfKeyAbsent atomically adds a message unless its sender already used the same
+// idempotency key, in which case the previously stored message is returned with created=false
+func (r *SQLiteChatRepository) AddMessageIfKeyAbsent(message *domain.Message) (*domain.Message, bool, error) {
+	return r.insertMessage(message, true)
+}
+
+// insertMessage stores a message with the chat's next sequence number and bumps the chat's updated_at
+// and last_seq in a single transaction. When ignoreDuplicateKey is set, a (sender_id, idempotency_key)
+// conflict returns the stored message instead.
+func (r *SQLiteChatRepository) insertMessage(message *domain.Message, ignoreDuplicateKey bool) (*domain.Message, bool, error) {
+	if message.ID == "" {
+		message.ID = uuid.New().String()
+	}
+
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// The single connection serializes transactions, so no other writer can take the same number;
+	// the unique (chat_id, seq) index enforces it regardless
+	participants, err := chatParticipants(tx, message.ChatID)
+	if err != nil {
+		return nil, false, err
+	}
+	err = tx.QueryRow(`SELECT last_seq + 1 FROM chats WHERE id = ?`, message.ChatID).Scan(&message.Seq)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The quote is taken inside the transaction so that it matches the quoted message as stored
+	if message.ReplyToID != "" {
+		quoted, err := scanMessage(tx.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id = ?`, message.ReplyToID))
+		if err != nil {
+			return nil, false, err
+		}
+		message.Quoted = domain.NewQuotedMessage(quoted)
+	}
+	quoted := message.Quoted
+	if quoted == nil {
+		quoted = &domain.QuotedMessage{}
+	}
+
+	query := `INSERT INTO messages (` + messageColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if ignoreDuplicateKey {
+		query += ` ON CONFLICT (sender_id, idempotency_key) WHERE idempotency_key <> '' DO NOTHING`
+	}
+
+	result, err := tx.Exec(query,
+		message.ID, message.ChatID, message.SenderID, message.Content,
+		message.Status, message.Timestamp.UTC(), message.IdempotencyKey,
+		nullTime(message.DeliveredAt), nullTime(message.ReadAt), message.Seq, nullTime(message.EditedAt), nullTime(message.DeletedAt),
+		message.ReplyToID, quoted.SenderID, quoted.Snippet, quoted.Deleted,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, false, domain.ErrIdempotencyKeyReused
+		}
+		return nil, false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if affected == 0 {
+		existing, err := queryMessage(tx,
+			`SELECT `+messageColumns+` FROM messages WHERE sender_id = ? AND idempotency_key = ?`,
+			message.SenderID, message.IdempotencyKey,
+		)
+		if err != nil {
+			return nil, false, err
+		}
+		return existing, false, nil
+	}
+
+	// Only uploads of the sender that were not sent yet can be attached
+	for i := range message.Attachments {
+		attachment := &message.Attachments[i]
+		result, err := tx.Exec(
+			`UPDATE attachments SET message_id = ?, position = ? WHERE id = ? AND uploader_id = ? AND message_id = ''`,
+			message.ID, i, attachment.ID, message.SenderID,
+		)
+		if err != nil {
+			return nil, false, err
+		}
+		if claimed, err := result.RowsAffected(); err != nil {
+			return nil, false, err
+		} else if claimed == 0 {
+			return nil, false, domain.ErrAttachmentUnavailable
+		}
+
+		stored, err := scanAttachment(tx.QueryRow(`SELECT `+attachmentColumns+` FROM attachments WHERE id = ?`, attachment.ID))
+		if err != nil {
+			return nil, false, err
+		}
+		*attachment = *stored
+	}
+
+	// Update chat's updated_at timestamp and last sequence number
+	_, err = tx.Exec(`UPDATE chats SET updated_at = ?, last_seq = ? WHERE id = ?`, time.Now().UTC(), message.Seq, message.ChatID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	change := domain.Change{Type: domain.ChangeMessageCreated, ChatID: message.ChatID, MessageID: message.ID}
+	if err := logChange(tx, change, participants...); err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	return message, true, nil
+}
+
+// UpdateMessageStatus moves a message forward to the given status and returns the updated message;
+// transitions that would move it backwards or repeat its status fail with ErrInvalidStatusTransition
+func (r *SQLiteChatRepository) UpdateMessageStatus(messageID string, status domain.MessageStatus) (*domain.Message, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	message, err := queryMessage(tx, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := message.TransitionTo(status, time.Now()); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE messages SET status = ?, delivered_at = ?, read_at = ? WHERE id = ?`,
+		message.Status, nullTime(message.DeliveredAt), nullTime(message.ReadAt), messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	participants, err := chatParticipants(tx, message.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	change := domain.Change{Type: domain.ChangeMessageStatus, ChatID: message.ChatID, MessageID: messageID}
+	if err := logChange(tx, change, participants...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// EditMessage replaces the content of a message, keeping the previous content as a revision, and
+// returns the updated message
+func (r *SQLiteChatRepository) EditMessage(messageID, content string, editedAt time.Time) (*domain.Message, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	message, err := queryMessage(tx, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The replaced content was written when the message was sent or last edited
+	writtenAt := message.Timestamp
+	if message.EditedAt != nil {
+		writtenAt = *message.EditedAt
+	}
+	_, err = tx.Exec(
+		`INSERT INTO message_revisions (message_id, revision, content, timestamp)
+		 SELECT ?, COALESCE(MAX(revision), 0) + 1, ?, ? FROM message_revisions WHERE message_id = ?`,
+		messageID, message.Content, writtenAt.UTC(), messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	message.Content = content
+	message.EditedAt = &editedAt
+	_, err = tx.Exec(`UPDATE messages SET content = ?, edited_at = ? WHERE id = ?`, content, editedAt.UTC(), messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := refreshQuotes(tx, message); err != nil {
+		return nil, err
+	}
+
+	participants, err := chatParticipants(tx, message.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	change := domain.Change{Type: domain.ChangeMessageEdited, ChatID: message.ChatID, MessageID: messageID, Timestamp: editedAt}
+	if err := logChange(tx, change, participants...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// DeleteMessage replaces a message with a tombstone for both participants, wiping its content and
+// revisions, and returns the tombstone; deleting a tombstone changes nothing
+func (r *SQLiteChatRepository) DeleteMessage(messageID string, deletedAt time.Time) (*domain.Message, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	message, err := scanMessage(tx.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id = ?`, messageID))
+	if err != nil {
+		return nil, err
+	}
+	if message.DeletedAt != nil {
+		return message, nil
+	}
+
+	message.Tombstone(deletedAt)
+	_, err = tx.Exec(`UPDATE messages SET content = ?, deleted_at = ? WHERE id = ?`, message.Content, deletedAt.UTC(), messageID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM message_revisions WHERE message_id = ?`, messageID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM reactions WHERE message_id = ?`, messageID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM attachments WHERE message_id = ?`, messageID); err != nil {
+		return nil, err
+	}
+	if err := refreshQuotes(tx, message); err != nil {
+		return nil, err
+	}
+
+	participants, err := chatParticipants(tx, message.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	change := domain.Change{Type: domain.ChangeMessageDeleted, ChatID: message.ChatID, MessageID: messageID, Timestamp: deletedAt}
+	if err := logChange(tx, change, participants...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// HideMessage deletes a message for the given user only: it no longer shows up in the messages
+// of the chat they list
+func (r *SQLiteChatRepository) HideMessage(messageID, userID string, hiddenAt time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var chatID string
+	if err := tx.QueryRow(`SELECT chat_id FROM messages WHERE id = ?`, messageID).Scan(&chatID); err != nil {
+		if err == sql.ErrNoRows {
+			return domain.ErrMessageNotFound
+		}
+		return err
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO hidden_messages (message_id, user_id, hidden_at) VALUES (?, ?, ?)
+		 ON CONFLICT (user_id, message_id) DO NOTHING`,
+		messageID, userID, hiddenAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if hidden, err := result.RowsAffected(); err != nil {
+		return err
+	} else if hidden > 0 {
+		change := domain.Change{Type: domain.ChangeMessageHidden, ChatID: chatID, MessageID: messageID, UserID: userID, Timestamp: hiddenAt}
+		if err := logChange(tx, change, userID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AddReaction adds a participant's reaction to a message and returns the message with its
+// reactions; reacting again with the same emoji changes nothing and reports false. Deleted
+// messages cannot be reacted to.
+func (r *SQLiteChatRepository) AddReaction(reaction *domain.Reaction) (*domain.Message, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	message, err := scanMessage(tx.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id = ?`, reaction.MessageID))
+	if err != nil {
+		return nil, false, err
+	}
+	if message.DeletedAt != nil {
+		return nil, false, domain.ErrMessageDeleted
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO reactions (message_id, user_id, emoji, created_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (message_id, user_id, emoji) DO NOTHING`,
+		reaction.MessageID, reaction.UserID, reaction.Emoji, reaction.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	added, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if added > 0 {
+		participants, err := chatParticipants(tx, message.ChatID)
+		if err != nil {
+			return nil, false, err
+		}
+		change := domain.Change{Type: domain.ChangeReactionAdded, ChatID: message.ChatID, MessageID: message.ID, UserID: reaction.UserID, Timestamp: reaction.CreatedAt}
+		if err := logChange(tx, change, participants...); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Reload the message with its reactions and attachments, as listings return it
+	message, err = queryMessage(tx, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, message.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	return message, added > 0, nil
+}
+
+// RemoveReaction takes back a participant's reaction to a message and returns the message with its
+// remaining reactions; removing a reaction that does not exist changes nothing and reports false
+func (r *SQLiteChatRepository) RemoveReaction(messageID, userID, emoji string, removedAt time.Time) (*domain.Message, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	message, err := scanMessage(tx.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id = ?`, messageID))
+	if err != nil {
+		return nil, false, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM reactions WHERE message_id = ? AND user_id = ? AND emoji = ?`, messageID, userID, emoji)
+	if err != nil {
+		return nil, false, err
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if removed > 0 {
+		participants, err := chatParticipants(tx, message.ChatID)
+		if err != nil {
+			return nil, false, err
+		}
+		change := domain.Change{Type: domain.ChangeReactionRemoved, ChatID: message.ChatID, MessageID: messageID, UserID: userID, Timestamp: removedAt}
+		if err := logChange(tx, change, participants...); err != nil {
+			return nil, false, err
+		}
+	}
+
+	message, err = queryMessage(tx, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, message.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	return message, removed > 0, nil
+}
+
+// FindMessageRevisions returns the earlier contents of a message, oldest first
+func (r *SQLiteChatRepository) FindMessageRevisions(messageID string) ([]*domain.MessageRevision, error) {
+	var exists bool
+	if err := r.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM messages WHERE id = ?)`, messageID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, domain.ErrMessageNotFound
+	}
+
+	rows, err := r.db.Query(
+		`SELECT message_id, revision, content, timestamp FROM message_revisions
+		 WHERE message_id = ?
+		 ORDER BY revision`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*domain.MessageRevision{}
+	for rows.Next() {
+		var revision domain.MessageRevision
+		if err := rows.Scan(&revision.MessageID, &revision.Revision, &revision.Content, &revision.Timestamp); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+// MarkChatReadUpTo marks every message the other participant sent up to and including messageID
+// as read by the user and advances the user's read watermark of the chat. It returns the watermark
+// and the messages that became read; a message behind the current watermark changes nothing.
+func (r *SQLiteChatRepository) MarkChatReadUpTo(chatID, userID, messageID string) (*domain.ReadMark, []*domain.Message, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	participants, err := chatParticipants(tx, chatID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var targetSeq int64
+	err = tx.QueryRow(`SELECT seq FROM messages WHERE id = ? AND chat_id = ?`, messageID, chatID).Scan(&targetSeq)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, domain.ErrMessageNotFound
+		}
+		return nil, nil, err
+	}
+
+	var current domain.ReadMark
+	var currentSeq int64
+	err = tx.QueryRow(
+		`SELECT r.chat_id, r.user_id, r.message_id, r.read_at, m.seq
+		 FROM chat_reads r JOIN messages m ON m.id = r.message_id
+		 WHERE r.chat_id = ? AND r.user_id = ?`,
+		chatID, userID,
+	).Scan(&current.ChatID, &current.UserID, &current.MessageID, &current.ReadAt, &currentSeq)
+	switch {
+	case err == nil && targetSeq <= currentSeq:
+		return &current, []*domain.Message{}, nil
+	case err != nil && err != sql.ErrNoRows:
+		return nil, nil, err
+	}
+
+	// Group messages have no status; there only the watermark moves
+	var chatType domain.ChatType
+	if err := tx.QueryRow(`SELECT type FROM chats WHERE id = ?`, chatID).Scan(&chatType); err != nil {
+		return nil, nil, err
+	}
+	read := []*domain.Message{}
+	if chatType != domain.ChatGroup {
+		read, err = queryMessages(tx,
+			`SELECT `+messageColumns+` FROM messages
+			 WHERE chat_id = ? AND sender_id <> ? AND status <> 'read' AND seq <= ?
+			 ORDER BY seq`,
+			chatID, userID, targetSeq,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	now := time.Now()
+	for _, msg := range read {
+		if err := msg.TransitionTo(domain.StatusRead, now); err != nil {
+			return nil, nil, err
+		}
+		_, err := tx.Exec(
+			`UPDATE messages SET status = ?, delivered_at = ?, read_at = ? WHERE id = ?`,
+			msg.Status, nullTime(msg.DeliveredAt), nullTime(msg.ReadAt), msg.ID,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	mark := &domain.ReadMark{
+		ChatID:    chatID,
+		UserID:    userID,
+		MessageID: messageID,
+		ReadAt:    now,
+	}
+	_, err = tx.Exec(
+		`INSERT INTO chat_reads (chat_id, user_id, message_id, read_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (chat_id, user_id) DO UPDATE SET message_id = excluded.message_id, read_at = excluded.read_at`,
+		mark.ChatID, mark.UserID, mark.MessageID, mark.ReadAt.UTC(),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// One change covers every message that became read
+	change := domain.Change{Type: domain.ChangeChatRead, ChatID: chatID, MessageID: messageID, UserID: userID, Timestamp: now}
+	if err := logChange(tx, change, participants...); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return mark, read, nil
+}
+
+// AddAttachment stores an uploaded attachment that is not part of a message yet
+func (r *SQLiteChatRepository) AddAttachment(attachment *domain.Attachment) error {
+	if attachment.ID == "" {
+		attachment.ID = uuid.New().String()
+	}
+
+	_, err := r.db.Exec(
+		`INSERT INTO attachments (`+attachmentColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		attachment.ID, attachment.MessageID, attachment.UploaderID, attachment.FileName, attachment.ContentType,
+		attachment.Kind, attachment.Size, attachment.Width, attachment.Height, attachment.HasThumbnail, attachment.CreatedAt.UTC(),
+	)
+	return err
+}
+
+// FindAttachment finds an attachment by its ID
+func (r *SQLiteChatRepository) FindAttachment(id string) (*domain.Attachment, error) {
+	return scanAttachment(r.db.QueryRow(`SELECT `+attachmentColumns+` FROM attachments WHERE id = ?`, id))
+}
+
+// DeleteUnclaimedAttachments deletes the attachments uploaded before the given time that were never
+// sent in a message and returns them, so their content can be deleted as well
+func (r *SQLiteChatRepository) DeleteUnclaimedAttachments(uploadedBefore time.Time) ([]domain.Attachment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT `+attachmentColumns+` FROM attachments WHERE message_id = '' AND created_at < ?`,
+		uploadedBefore.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := []domain.Attachment{}
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expired = append(expired, *attachment)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range expired {
+		if _, err := tx.Exec(`DELETE FROM attachments WHERE id = ? AND message_id = ''`, attachment.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
+
+// FindMessageByID finds a message by its ID
+func (r *SQLiteChatRepository) FindMessageByID(id string) (*domain.Message, error) {
+	return queryMessage(r.db, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, id)
+}
+
+// FindVisibleMessage finds a message by its ID as the viewer sees it: messages they deleted for
+// themselves are not found
+func (r *SQLiteChatRepository) FindVisibleMessage(id, viewerID string) (*domain.Message, error) {
+	return queryMessage(r.db, `SELECT `+messageColumns+` FROM messages WHERE id = ? AND `+visibleTo, id, viewerID)
+}
+
+// FindMessageByKey finds a message by its sender and idempotency key
+func (r *SQLiteChatRepository) FindMessageByKey(senderID, idempotencyKey string) (*domain.Message, error) {
+	return queryMessage(r.db,
+		`SELECT `+messageColumns+` FROM messages WHERE sender_id = ? AND idempotency_key = ?`,
+		senderID, idempotencyKey,
+	)
+}
+
+// FindUndeliveredMessages returns up to limit of the oldest messages addressed to the recipient
+// that are still in "sent" status, along with the total number of such messages
+func (r *SQLiteChatRepository) FindUndeliveredMessages(recipientID string, limit int) ([]*domain.Message, int, error) {
+	const undeliveredFilter = `
+		FROM messages m JOIN chats c ON c.id = m.chat_id
+		WHERE (c.participant1 = ? OR c.participant2 = ?) AND m.sender_id <> ? AND m.status = 'sent'`
+
+	var total int
+	err := r.db.QueryRow(`SELECT COUNT(*) `+undeliveredFilter, recipientID, recipientID, recipientID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	messages, err := queryMessages(r.db,
+		`SELECT `+qualifyColumns("m", messageColumns)+` `+
+			undeliveredFilter+` ORDER BY m.timestamp, m.rowid LIMIT ?`,
+		recipientID, recipientID, recipientID, limit,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return messages, total, nil
+}
+
+// FindChanges returns up to limit entries of the user's change log that follow afterSeq, oldest
+// first, and whether more entries follow them. Pruned entries are skipped.
+func (r *SQLiteChatRepository) FindChanges(userID string, afterSeq int64, limit int) ([]*domain.Change, bool, error) {
+	// Fetch one extra row to learn whether more changes follow
+	rows, err := r.db.Query(
+		`SELECT seq, type, chat_id, message_id, actor_id, timestamp FROM changes
+		 WHERE user_id = ? AND seq > ?
+		 ORDER BY seq
+		 LIMIT ?`,
+		userID, afterSeq, limit+1,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	changes := []*domain.Change{}
+	for rows.Next() {
+		var change domain.Change
+		if err := rows.Scan(&change.Seq, &change.Type, &change.ChatID, &change.MessageID, &change.UserID, &change.Timestamp); err != nil {
+			return nil, false, err
+		}
+		changes = append(changes, &change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if len(changes) > limit {
+		return changes[:limit], true, nil
+	}
+	return changes, false, nil
+}
+
+// DeleteChangesBefore prunes the entries logged before the given time from the front of every
+// change log and returns how many were deleted. The newest entry of a log is always kept so that
+// sequence numbers keep growing.
+func (r *SQLiteChatRepository) DeleteChangesBefore(loggedBefore time.Time) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The newest expired entry of each log; everything before it goes as well
+	rows, err := tx.Query(`SELECT user_id, MAX(seq) FROM changes WHERE timestamp < ? GROUP BY user_id`, loggedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	cutoffs := map[string]int64{}
+	for rows.Next() {
+		var userID string
+		var seq int64
+		if err := rows.Scan(&userID, &seq); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		cutoffs[userID] = seq
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for userID, seq := range cutoffs {
+		result, err := tx.Exec(
+			`DELETE FROM changes
+			 WHERE user_id = ? AND seq <= ? AND seq < (SELECT MAX(seq) FROM changes WHERE user_id = ?)`,
+			userID, seq, userID,
+		)
+		if err != nil {
+			return 0, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += int(affected)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return deleted, nil
+}
+
+// chatParticipants returns the participants of a chat
+func chatParticipants(tx *sql.Tx, chatID string) ([]string, error) {
+	var chatType domain.ChatType
+	var participant1, participant2 string
+	err := tx.QueryRow(`SELECT type, participant1, participant2 FROM chats WHERE id = ?`, chatID).Scan(&chatType, &participant1, &participant2)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, domain.ErrChatNotFound
+		}
+		return nil, err
+	}
+
+	if chatType != domain.ChatGroup {
+		return []string{participant1, participant2}, nil
+	}
+
+	rows, err := tx.Query(`SELECT user_id FROM chat_members WHERE chat_id = ?`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+
+	return members, rows.Err()
+}
+
+// loadMembers sets the members of the group chats among chats, in the order they joined
+func loadMembers(q queryer, chats ...*domain.Chat) error {
+	byID := make(map[string]*domain.Chat)
+	args := []interface{}{}
+	for _, chat := range chats {
+		if chat.IsGroup() {
+			byID[chat.ID] = chat
+			chat.Members = []domain.ChatMember{}
+			args = append(args, chat.ID)
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	// saveMembers writes members in join order, so rowid order is join order
+	rows, err := q.Query(
+		`SELECT chat_id, user_id, role, joined_at FROM chat_members
+		 WHERE chat_id IN (?`+strings.Repeat(", ?", len(args)-1)+`)
+		 ORDER BY rowid`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chatID string
+		var member domain.ChatMember
+		if err := rows.Scan(&chatID, &member.UserID, &member.Role, &member.JoinedAt); err != nil {
+			return err
+		}
+		byID[chatID].Members = append(byID[chatID].Members, member)
+	}
+
+	return rows.Err()
+}
+
+// saveMembers replaces the stored members of a group chat with chat.Members
+func saveMembers(tx *sql.Tx, chat *domain.Chat) error {
+	if !chat.IsGroup() {
+		return nil
+	}
+
+	if _, err := tx.Exec(`DELETE FROM chat_members WHERE chat_id = ?`, chat.ID); err != nil {
+		return err
+	}
+	for _, member := range chat.Members {
+		_, err := tx.Exec(
+			`INSERT INTO chat_members (chat_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)`,
+			chat.ID, member.UserID, member.Role, member.JoinedAt.UTC(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// logChange appends the change to the change log of every given user within the transaction
+func logChange(tx *sql.Tx, change domain.Change, userIDs ...string) error {
+	if change.Timestamp.IsZero() {
+		change.Timestamp = time.Now()
+	}
+
+	for _, userID := range userIDs {
+		_, err := tx.Exec(
+			`INSERT INTO changes (user_id, seq, type, chat_id, message_id, actor_id, timestamp)
+			 SELECT ?, COALESCE(MAX(seq), 0) + 1, ?, ?, ?, ?, ? FROM changes WHERE user_id = ?`,
+			userID, change.Type, change.ChatID, change.MessageID, change.UserID, change.Timestamp.UTC(), userID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanChat reads a single chat row, followed by any extra selected columns
+func scanChat(row rowScanner, extra ...interface{}) (*domain.Chat, error) {
+	var chat domain.Chat
+	dest := append([]interface{}{&chat.ID, &chat.Type, &chat.Title, &chat.Participant1, &chat.Participant2, &chat.CreatedAt, &chat.UpdatedAt, &chat.LastSeq}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, domain.ErrChatNotFound
+		}
+		return nil, err
+	}
+
+	return &chat, nil
+}
+
+// queryMessages runs a query selecting messageColumns and returns the messages with their reactions
+func queryMessages(q queryer, query string, args ...interface{}) ([]*domain.Message, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []*domain.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	// The rows hold the only connection until closed, which reactions and attachments are loaded over
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := attachReactions(q, messages...); err != nil {
+		return nil, err
+	}
+	if err := loadAttachments(q, messages...); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// queryMessage is queryMessages for a query selecting a single message; it fails with
+// ErrMessageNotFound when the query returns no row
+func queryMessage(q queryer, query string, args ...interface{}) (*domain.Message, error) {
+	messages, err := queryMessages(q, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, domain.ErrMessageNotFound
+	}
+
+	return messages[0], nil
+}
+
+// attachReactions loads the reactions of the messages and sets them aggregated per emoji
+func attachReactions(q queryer, messages ...*domain.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*domain.Message, len(messages))
+	args := make([]interface{}, len(messages))
+	for i, message := range messages {
+		byID[message.ID] = message
+		args[i] = message.ID
+	}
+
+	rows, err := q.Query(
+		`SELECT message_id, user_id, emoji, created_at FROM reactions
+		 WHERE message_id IN (?`+strings.Repeat(", ?", len(messages)-1)+`)
+		 ORDER BY created_at, rowid`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	reactions := make(map[string][]*domain.Reaction) // messageID -> reactions, oldest first
+	for rows.Next() {
+		var reaction domain.Reaction
+		if err := rows.Scan(&reaction.MessageID, &reaction.UserID, &reaction.Emoji, &reaction.CreatedAt); err != nil {
+			return err
+		}
+		reactions[reaction.MessageID] = append(reactions[reaction.MessageID], &reaction)
+	}
+
+	for messageID, messageReactions := range reactions {
+		byID[messageID].Reactions = domain.AggregateReactions(messageReactions)
+	}
+
+	return rows.Err()
+}
+
+// loadAttachments loads the attachments of the messages, in the order they were sent
+func loadAttachments(q queryer, messages ...*domain.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*domain.Message, len(messages))
+	args := make([]interface{}, len(messages))
+	for i, message := range messages {
+		byID[message.ID] = message
+		args[i] = message.ID
+	}
+
+	rows, err := q.Query(
+		`SELECT `+attachmentColumns+` FROM attachments
+		 WHERE message_id IN (?`+strings.Repeat(", ?", len(messages)-1)+`)
+		 ORDER BY message_id, position`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return err
+		}
+		message := byID[attachment.MessageID]
+		message.Attachments = append(message.Attachments, *attachment)
+	}
+
+	return rows.Err()
+}
+
+// scanAttachment reads an attachment selected with attachmentColumns
+func scanAttachment(row rowScanner) (*domain.Attachment, error) {
+	var attachment domain.Attachment
+	err := row.Scan(
+		&attachment.ID, &attachment.MessageID, &attachment.UploaderID, &attachment.FileName, &attachment.ContentType,
+		&attachment.Kind, &attachment.Size, &attachment.Width, &attachment.Height, &attachment.HasThumbnail, &attachment.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachment, nil
+}
+
+// refreshQuotes updates the quote of the message in every reply to it after an edit or a deletion
+func refreshQuotes(tx *sql.Tx, message *domain.Message) error {
+	quoted := domain.NewQuotedMessage(message)
+	_, err := tx.Exec(
+		`UPDATE messages SET quoted_sender = ?, quoted_snippet = ?, quoted_deleted = ? WHERE reply_to_id = ?`,
+		quoted.SenderID, quoted.Snippet, quoted.Deleted, message.ID,
+	)
+	return err
+}
+
+// scanMessage reads a single message row
+func scanMessage(row rowScanner) (*domain.Message, error) {
+	var msg domain.Message
+	var deliveredAt, readAt, editedAt, deletedAt sql.NullTime
+	var quoted domain.QuotedMessage
+	err := row.Scan(&msg.ID, &msg.ChatID, &msg.SenderID, &msg.Content, &msg.Status, &msg.Timestamp, &msg.IdempotencyKey,
+		&deliveredAt, &readAt, &msg.Seq, &editedAt, &deletedAt,
+		&msg.ReplyToID, &quoted.SenderID, &quoted.Snippet, &quoted.Deleted)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, domain.ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	msg.DeliveredAt = timePtr(deliveredAt)
+	msg.ReadAt = timePtr(readAt)
+	msg.EditedAt = timePtr(editedAt)
+	msg.DeletedAt = timePtr(deletedAt)
+	if msg.ReplyToID != "" {
+		msg.Quoted = &quoted
+	}
+	return &msg, nil
+}
@@ -0,0 +1,81 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+
+	"messaging-app/domain"
+
+	"github.com/google/uuid"
+)
+
+// SQLiteUserRepository implements UserRepository backed by a SQLite database
+type SQLiteUserRepository struct {
+	db *sql.DB
+}
+
+// NewSQLiteUserRepository creates a new SQLite user repository using a database opened with OpenSQLite
+func NewSQLiteUserRepository(db *sql.DB) *SQLiteUserRepository {
+	return &SQLiteUserRepository{
+		db: db,
+	}
+}
+
+const userColumns = `id, username, password_hash, created_at`
+
+// Create adds a new user to the repository
+func (r *SQLiteUserRepository) Create(user *domain.User) error {
+	if user.ID == "" {
+		user.ID = uuid.New().String()
+	}
+
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+
+	// The UNIQUE username_key index rejects names that only differ in case or compatibility forms
+	_, err := r.db.Exec(
+		`INSERT INTO users (`+userColumns+`, username_key) VALUES (?, ?, ?, ?, ?)`,
+		user.ID, user.Username, user.PasswordHash, user.CreatedAt.UTC(), domain.NormalizeUsername(user.Username),
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrUsernameExists
+		}
+		return err
+	}
+
+	return nil
+}
+
+// FindByID retrieves a user by their ID
+func (r *SQLiteUserRepository) FindByID(id string) (*domain.User, error) {
+	row := r.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id)
+	return scanUser(row)
+}
+
+// FindByUsername retrieves a user by their username, ignoring case and compatibility forms
+func (r *SQLiteUserRepository) FindByUsername(username string) (*domain.User, error) {
+	row := r.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username_key = ?`, domain.NormalizeUsername(username))
+	return scanUser(row)
+}
+
+// UsernameExists checks if a username already exists
+func (r *SQLiteUserRepository) UsernameExists(username string) bool {
+	var exists bool
+	err := r.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username_key = ?)`, domain.NormalizeUsername(username)).Scan(&exists)
+	return err == nil && exists
+}
+
+// scanUser reads a single user row
+func scanUser(row rowScanner) (*domain.User, error) {
+	var user domain.User
+	if err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, domain.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -11,14 +11,16 @@ import (
 
 // MemoryUserRepository implements UserRepository with in-memory storage
 type MemoryUserRepository struct {
-	users map[string]*domain.User
-	mutex sync.RWMutex
+	users     map[string]*domain.User
+	usernames map[string]*domain.User // normalized username -> user
+	mutex     sync.RWMutex
 }
 
 // NewMemoryUserRepository creates a new in-memory user repository (sorry for the out of creativity on naming)
 func NewMemoryUserRepository() *MemoryUserRepository {
 	return &MemoryUserRepository{
-		users: make(map[string]*domain.User),
+		users:     make(map[string]*domain.User),
+		usernames: make(map[string]*domain.User),
 	}
 }
 
@@ -27,11 +29,10 @@ func (r *MemoryUserRepository) Create(user *domain.User) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	// Check if username already exists
-	for _, existingUser := range r.users {
-		if existingUser.Username == user.Username {
-			return domain.ErrUsernameExists
-		}
+	// Check if username already exists, ignoring case and compatibility forms
+	key := domain.NormalizeUsername(user.Username)
+	if _, exists := r.usernames[key]; exists {
+		return domain.ErrUsernameExists
 	}
 
 	// Generate UUID if not provided
@@ -44,6 +45,7 @@ func (r *MemoryUserRepository) Create(user *domain.User) error {
 	}
 
 	r.users[user.ID] = user
+	r.usernames[key] = user
 	return nil
 }
 
@@ -60,18 +62,17 @@ func (r *MemoryUserRepository) FindByID(id string) (*domain.User, error) {
 	return user, nil
 }
 
-// FindByUsername retrieves a user by their username
+// FindByUsername retrieves a user by their username, ignoring case and compatibility forms
 func (r *MemoryUserRepository) FindByUsername(username string) (*domain.User, error) {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for _, user := range r.users {
-		if user.Username == username {
-			return user, nil
-		}
+	user, exists := r.usernames[domain.NormalizeUsername(username)]
+	if !exists {
+		return nil, domain.ErrUserNotFound
 	}
 
-	return nil, domain.ErrUserNotFound
+	return user, nil
 }
 
 // Exists checks if a username already exists
@@ -79,11 +80,6 @@ func (r *MemoryUserRepository) UsernameExists(username string) bool {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for _, user := range r.users {
-		if user.Username == username {
-			return true
-		}
-	}
-
-	return false
+	_, exists := r.usernames[domain.NormalizeUsername(username)]
+	return exists
 }
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"messaging-app/domain"
+
+	"github.com/google/uuid"
+)
+
+// UploadAttachment stores a file the user is going to send and returns the attachment to refer to
+// in a message. The MIME type is detected from the content, whatever the client claims, and must
+// be one domain.AttachmentKindOf accepts; images the server can decode also get a thumbnail.
+func (s *MessageService) UploadAttachment(uploaderID, fileName string, content io.Reader) (*domain.Attachment, error) {
+	data, err := io.ReadAll(io.LimitReader(content, s.maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.maxFileSize {
+		return nil, domain.ErrAttachmentTooLarge
+	}
+	if len(data) == 0 {
+		return nil, domain.ErrEmptyAttachment
+	}
+
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return nil, domain.ErrUnsupportedAttachment
+	}
+	kind, ok := domain.AttachmentKindOf(contentType)
+	if !ok {
+		return nil, domain.ErrUnsupportedAttachment
+	}
+
+	attachment := &domain.Attachment{
+		ID:          uuid.New().String(),
+		UploaderID:  uploaderID,
+		FileName:    domain.CleanFileName(fileName),
+		ContentType: contentType,
+		Kind:        kind,
+		Size:        int64(len(data)),
+		CreatedAt:   time.Now(),
+	}
+
+	var thumbnail []byte
+	if kind == domain.AttachmentImage {
+		attachment.Width, attachment.Height, thumbnail = imageThumbnail(data)
+		attachment.HasThumbnail = thumbnail != nil
+	}
+
+	if _, err := s.blobs.Put(attachment.ID, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if thumbnail != nil {
+		if _, err := s.blobs.Put(thumbnailKey(attachment.ID), bytes.NewReader(thumbnail)); err != nil {
+			s.deleteAttachmentBlobs(*attachment)
+			return nil, err
+		}
+	}
+
+	if err := s.chatRepo.AddAttachment(attachment); err != nil {
+		s.deleteAttachmentBlobs(*attachment)
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+// OpenAttachment returns an attachment with a reader of its content, or of its thumbnail, which the
+// caller must close. Sent attachments can be downloaded by the participants of their chat, unsent
+// ones only by their uploader.
+func (s *MessageService) OpenAttachment(userID, attachmentID string, thumbnail bool) (*domain.Attachment, io.ReadCloser, error) {
+	attachment, err := s.chatRepo.FindAttachment(attachmentID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if attachment.MessageID == "" {
+		if attachment.UploaderID != userID {
+			return nil, nil, domain.ErrAttachmentNotFound
+		}
+	} else if _, err := s.authorizeMessageAccess(userID, attachment.MessageID); err != nil {
+		return nil, nil, err
+	}
+
+	key := attachment.ID
+	if thumbnail {
+		if !attachment.HasThumbnail {
+			return nil, nil, domain.ErrNoThumbnail
+		}
+		key = thumbnailKey(attachment.ID)
+	}
+
+	content, err := s.blobs.Open(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return attachment, content, nil
+}
+
+// pendingAttachments loads the attachments with the given IDs, in order, checking that each is an
+// upload of the sender that was not sent yet
+func (s *MessageService) pendingAttachments(senderID string, attachmentIDs []string) ([]domain.Attachment, error) {
+	if len(attachmentIDs) == 0 {
+		return nil, nil
+	}
+
+	attachments := make([]domain.Attachment, 0, len(attachmentIDs))
+	seen := make(map[string]bool, len(attachmentIDs))
+	for _, id := range attachmentIDs {
+		attachment, err := s.chatRepo.FindAttachment(id)
+		if err == domain.ErrAttachmentNotFound || (err == nil && (seen[id] || attachment.UploaderID != senderID || attachment.MessageID != "")) {
+			return nil, domain.ErrAttachmentUnavailable
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		seen[id] = true
+		attachments = append(attachments, *attachment)
+	}
+
+	return attachments, nil
+}
+
+// deleteAttachmentBlobs removes the content and thumbnails of attachments nothing refers to anymore;
+// a blob that cannot be removed only wastes space, so failures are logged and otherwise ignored
+func (s *MessageService) deleteAttachmentBlobs(attachments ...domain.Attachment) {
+	for _, attachment := range attachments {
+		keys := []string{attachment.ID}
+		if attachment.HasThumbnail {
+			keys = append(keys, thumbnailKey(attachment.ID))
+		}
+
+		for _, key := range keys {
+			if err := s.blobs.Delete(key); err != nil {
+				log.Printf("Error deleting blob %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// PurgeUnclaimedAttachments deletes the attachments uploaded before the given time that were never
+// sent, with their content, and returns how many were deleted
+func (s *MessageService) PurgeUnclaimedAttachments(uploadedBefore time.Time) (int, error) {
+	attachments, err := s.chatRepo.DeleteUnclaimedAttachments(uploadedBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	s.deleteAttachmentBlobs(attachments...)
+	return len(attachments), nil
+}
+
+// thumbnailKey is the blob key of the thumbnail of an attachment
+func thumbnailKey(attachmentID string) string {
+	return attachmentID + "_thumbnail"
+}
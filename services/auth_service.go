@@ -0,0 +1,225 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"messaging-app/domain"
+	"messaging-app/repositories"
+)
+
+const (
+	minPasswordLength = 8
+	pbkdf2Iterations  = 100000
+	pbkdf2KeyLength   = 32
+	saltLength        = 16
+)
+
+// dummyPasswordHash is checked instead when a username does not exist, so that logins take as long
+// whether or not the user exists; it costs as much to verify as a real hash but matches no password
+var dummyPasswordHash = fmt.Sprintf("pbkdf2-sha256$%d$%s$%s",
+	pbkdf2Iterations,
+	base64.RawStdEncoding.EncodeToString(make([]byte, saltLength)),
+	base64.RawStdEncoding.EncodeToString(make([]byte, pbkdf2KeyLength)),
+)
+
+// jwtHeader is the fixed, pre-encoded JOSE header of every token (HS256)
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// tokenClaims are the JWT claims carried by an access token
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// AuthService handles user registration, login and access token validation
+type AuthService struct {
+	userRepo repositories.UserRepository
+	secret   []byte
+	tokenTTL time.Duration
+}
+
+// NewAuthService creates a new auth service signing tokens with the given HMAC secret
+func NewAuthService(userRepo repositories.UserRepository, secret []byte, tokenTTL time.Duration) *AuthService {
+	return &AuthService{
+		userRepo: userRepo,
+		secret:   secret,
+		tokenTTL: tokenTTL,
+	}
+}
+
+// Register creates a new user with a hashed password; the username is validated and stored in its
+// NFKC form (see domain.CleanUsername)
+func (s *AuthService) Register(username, password string) (*domain.User, error) {
+	username, err := domain.CleanUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(password) < minPasswordLength {
+		return nil, domain.ErrInvalidPassword
+	}
+
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &domain.User{
+		Username:     username,
+		PasswordHash: passwordHash,
+	}
+
+	if err := s.userRepo.Create(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Login verifies the user's credentials and issues a signed access token
+func (s *AuthService) Login(username, password string) (*domain.AuthToken, error) {
+	user, err := s.userRepo.FindByUsername(username)
+	if err != nil {
+		if err == domain.ErrUserNotFound {
+			verifyPassword(dummyPasswordHash, password)
+			return nil, domain.ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	if !verifyPassword(user.PasswordHash, password) {
+		return nil, domain.ErrInvalidCredentials
+	}
+
+	return s.IssueToken(user)
+}
+
+// IssueToken creates a signed HS256 JWT for the user
+func (s *AuthService) IssueToken(user *domain.User) (*domain.AuthToken, error) {
+	now := time.Now()
+	expiresAt := now.Add(s.tokenTTL)
+
+	claims, err := json.Marshal(tokenClaims{
+		Subject:   user.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	token := signingInput + "." + s.sign(signingInput)
+
+	return &domain.AuthToken{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresAt: expiresAt.Truncate(time.Second),
+		User:      user,
+	}, nil
+}
+
+// Authenticate validates an access token and returns the user it was issued to
+func (s *AuthService) Authenticate(token string) (*domain.User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, domain.ErrUnauthorized
+	}
+
+	expected := s.sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return nil, domain.ErrUnauthorized
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, domain.ErrUnauthorized
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return nil, domain.ErrUnauthorized
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, domain.ErrUnauthorized
+	}
+
+	// The user may have been removed since the token was issued
+	user, err := s.userRepo.FindByID(claims.Subject)
+	if err != nil {
+		if err == domain.ErrUserNotFound {
+			return nil, domain.ErrUnauthorized
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// sign returns the base64url-encoded HMAC-SHA256 signature of the input
+func (s *AuthService) sign(input string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(input))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hashPassword derives a salted PBKDF2-SHA256 hash encoded as "pbkdf2-sha256$iterations$salt$hash"
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, pbkdf2KeyLength)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s",
+		pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verifyPassword checks a password against a hash produced by hashPassword
+func verifyPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"messaging-app/domain"
+)
+
+// authorizeChatAccess loads the chat and checks that the user is one of its participants
+func (s *MessageService) authorizeChatAccess(userID, chatID string) (*domain.Chat, error) {
+	chat, err := s.chatRepo.FindByID(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !chat.HasParticipant(userID) {
+		return nil, domain.ErrNotParticipant
+	}
+
+	return chat, nil
+}
+
+// authorizeGroupAdmin loads a group chat and checks that the user is its owner or an admin,
+// returning the chat and the user's membership
+func (s *MessageService) authorizeGroupAdmin(userID, chatID string) (*domain.Chat, *domain.ChatMember, error) {
+	chat, err := s.authorizeChatAccess(userID, chatID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !chat.IsGroup() {
+		return nil, nil, domain.ErrNotGroupChat
+	}
+
+	member := chat.Member(userID)
+	if !member.Role.CanManage() {
+		return nil, nil, domain.ErrNotGroupAdmin
+	}
+
+	return chat, member, nil
+}
+
+// authorizeStatusUpdate loads the message and checks that the user is its recipient,
+// i.e. a participant of the chat other than the sender; group messages have no status
+func (s *MessageService) authorizeStatusUpdate(userID, messageID string) (*domain.Message, error) {
+	message, err := s.chatRepo.FindMessageByID(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	chat, err := s.chatRepo.FindByID(message.ChatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !chat.HasParticipant(userID) || message.SenderID == userID {
+		return nil, domain.ErrNotRecipient
+	}
+
+	if chat.IsGroup() {
+		return nil, domain.ErrNoGroupStatus
+	}
+
+	return message, nil
+}
+
+// authorizeMessageAccess loads the message and checks that the user is a participant of its chat
+func (s *MessageService) authorizeMessageAccess(userID, messageID string) (*domain.Message, error) {
+	message, err := s.chatRepo.FindMessageByID(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.authorizeChatAccess(userID, message.ChatID); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// authorizeEdit loads the message and checks that the user is its sender and still a participant of
+// its chat; members removed from a group keep their messages there but cannot change them
+func (s *MessageService) authorizeEdit(userID, messageID string) (*domain.Message, error) {
+	message, err := s.authorizeMessageAccess(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.SenderID != userID {
+		return nil, domain.ErrNotSender
+	}
+
+	return message, nil
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"time"
+
+	"messaging-app/domain"
+)
+
+// CreateGroupChat creates a group chat owned by the user with the given title and members; the
+// owner is added as the first member, duplicates and the owner among memberIDs are ignored
+func (s *MessageService) CreateGroupChat(ownerID, title string, memberIDs []string) (*domain.Chat, error) {
+	title, err := domain.CleanChatTitle(title)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.userRepo.FindByID(ownerID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	chat := &domain.Chat{
+		Type:      domain.ChatGroup,
+		Title:     title,
+		Members:   []domain.ChatMember{{UserID: ownerID, Role: domain.RoleOwner, JoinedAt: now}},
+		CreatedAt: now,
+	}
+
+	for _, memberID := range memberIDs {
+		if chat.Member(memberID) != nil {
+			continue
+		}
+
+		// Every member must be a registered user
+		if _, err := s.userRepo.FindByID(memberID); err != nil {
+			return nil, err
+		}
+		if err := chat.AddMember(domain.ChatMember{UserID: memberID, Role: domain.RoleMember, JoinedAt: now}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.chatRepo.Create(chat); err != nil {
+		return nil, err
+	}
+
+	return chat, nil
+}
+
+// GetChatForUser returns a chat the user takes part in
+func (s *MessageService) GetChatForUser(userID, chatID string) (*domain.Chat, error) {
+	return s.authorizeChatAccess(userID, chatID)
+}
+
+// UpdateChatTitle renames a group chat; the user must be its owner or an admin
+func (s *MessageService) UpdateChatTitle(userID, chatID, title string) (*domain.Chat, error) {
+	title, err := domain.CleanChatTitle(title)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := s.authorizeGroupAdmin(userID, chatID); err != nil {
+		return nil, err
+	}
+
+	return s.chatRepo.UpdateChatTitle(chatID, title, time.Now())
+}
+
+// AddChatMember adds a registered user to a group chat as a plain member; the user adding them
+// must be the owner or an admin. The new member sees the chat's history but nothing of it is unread.
+func (s *MessageService) AddChatMember(userID, chatID, memberID string) (*domain.Chat, error) {
+	if _, _, err := s.authorizeGroupAdmin(userID, chatID); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.userRepo.FindByID(memberID); err != nil {
+		return nil, err
+	}
+
+	return s.chatRepo.AddChatMember(chatID, domain.ChatMember{
+		UserID:   memberID,
+		Role:     domain.RoleMember,
+		JoinedAt: time.Now(),
+	})
+}
+
+// RemoveChatMember removes a member from a group chat. Removing oneself is leaving; otherwise the
+// owner may remove anyone but themselves and admins may remove plain members.
+func (s *MessageService) RemoveChatMember(userID, chatID, memberID string) (*domain.Chat, error) {
+	if memberID == userID {
+		return s.LeaveChat(userID, chatID)
+	}
+
+	chat, actor, err := s.authorizeGroupAdmin(userID, chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	member := chat.Member(memberID)
+	switch {
+	case member == nil:
+		return nil, domain.ErrNotMember
+	case member.Role == domain.RoleOwner:
+		return nil, domain.ErrOwnerProtected
+	case member.Role == domain.RoleAdmin && actor.Role != domain.RoleOwner:
+		return nil, domain.ErrNotGroupOwner
+	}
+
+	return s.chatRepo.RemoveChatMember(chatID, memberID, time.Now())
+}
+
+// LeaveChat removes the user from a group chat; when the owner leaves, ownership passes to the
+// longest-standing admin or, without admins, the longest-standing member
+func (s *MessageService) LeaveChat(userID, chatID string) (*domain.Chat, error) {
+	chat, err := s.authorizeChatAccess(userID, chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !chat.IsGroup() {
+		return nil, domain.ErrNotGroupChat
+	}
+
+	return s.chatRepo.RemoveChatMember(chatID, userID, time.Now())
+}
+
+// SetChatMemberRole makes a member of a group chat an admin or a plain member; only the owner may
+// change roles
+func (s *MessageService) SetChatMemberRole(userID, chatID, memberID string, role domain.ChatRole) (*domain.Chat, error) {
+	_, actor, err := s.authorizeGroupAdmin(userID, chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if actor.Role != domain.RoleOwner {
+		return nil, domain.ErrNotGroupOwner
+	}
+
+	return s.chatRepo.UpdateChatMemberRole(chatID, memberID, role, time.Now())
+}
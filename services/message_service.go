@@ -9,57 +9,112 @@ import (
 
 // MessageService handles business logic for messaging operations
 type MessageService struct {
-	chatRepo repositories.ChatRepository
+	userRepo     repositories.UserRepository
+	chatRepo     repositories.ChatRepository
+	blobs        repositories.BlobStore
+	editWindow   time.Duration // how long after sending a message its sender may edit it
+	deleteWindow time.Duration // how long after sending a message its sender may delete it for everyone
+	maxFileSize  int64         // bytes an uploaded attachment may have
 }
 
-// NewMessageService creates a new message service
-func NewMessageService(chatRepo repositories.ChatRepository) *MessageService {
+// NewMessageService creates a new message service keeping attachments in blobs; senders may edit
+// their messages for editWindow and delete them for everyone for deleteWindow after sending them,
+// a zero window disables the operation. Uploads larger than maxFileSize bytes are rejected.
+func NewMessageService(userRepo repositories.UserRepository, chatRepo repositories.ChatRepository, blobs repositories.BlobStore, editWindow, deleteWindow time.Duration, maxFileSize int64) *MessageService {
 	return &MessageService{
-		chatRepo: chatRepo,
+		userRepo:     userRepo,
+		chatRepo:     chatRepo,
+		blobs:        blobs,
+		editWindow:   editWindow,
+		deleteWindow: deleteWindow,
+		maxFileSize:  maxFileSize,
 	}
 }
 
-// SendMessage sends a message between users with idempotency support
-func (s *MessageService) SendMessage(senderID, recipientID, content, idempotencyKey string) (*domain.Message, error) {
-	// Validate users exist (in production, this would check user repository)
+// SendMessage sends a message between users with idempotency support; a non-empty replyToID makes
+// the message a reply quoting an earlier message of the same chat. attachmentIDs are uploads of
+// the sender to attach; a message needs content, attachments or both. Returns the message and
+// whether it was created, which is false for a retry answered with the message stored under its
+// idempotency key.
+func (s *MessageService) SendMessage(senderID, recipientID, content, idempotencyKey, replyToID string, attachmentIDs []string) (*domain.Message, bool, error) {
 	if senderID == "" || recipientID == "" {
-		return nil, domain.ErrInvalidUser
+		return nil, false, domain.ErrInvalidUser
 	}
 
 	if senderID == recipientID {
-		return nil, domain.ErrCannotMessageSelf
+		return nil, false, domain.ErrCannotMessageSelf
 	}
 
-	if content == "" {
-		return nil, domain.ErrEmptyMessage
+	if content == "" && len(attachmentIDs) == 0 {
+		return nil, false, domain.ErrEmptyMessage
+	}
+
+	// Both participants must be registered users
+	if _, err := s.userRepo.FindByID(senderID); err != nil {
+		return nil, false, err
+	}
+	if _, err := s.userRepo.FindByID(recipientID); err != nil {
+		return nil, false, err
 	}
 
-	// Find or create chat
-	chat, err := s.chatRepo.FindByParticipants(senderID, recipientID)
+	// Find or create chat atomically so a pair always maps to a single chat
+	chat, err := s.chatRepo.FindOrCreateByParticipants(senderID, recipientID)
 	if err != nil {
-		if err == domain.ErrChatNotFound {
-			// Create new chat
-			chat = &domain.Chat{
-				Participant1: senderID,
-				Participant2: recipientID,
-			}
-			if err := s.chatRepo.Create(chat); err != nil {
-				return nil, err
-			}
-		} else {
-			return nil, err
+		return nil, false, err
+	}
+
+	return s.postMessage(chat, senderID, content, idempotencyKey, replyToID, attachmentIDs)
+}
+
+// SendToChat sends a message to an existing 1:1 or group chat the sender takes part in, with the
+// same idempotency, reply and attachment support as SendMessage
+func (s *MessageService) SendToChat(senderID, chatID, content, idempotencyKey, replyToID string, attachmentIDs []string) (*domain.Message, bool, error) {
+	if content == "" && len(attachmentIDs) == 0 {
+		return nil, false, domain.ErrEmptyMessage
+	}
+
+	chat, err := s.authorizeChatAccess(senderID, chatID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return s.postMessage(chat, senderID, content, idempotencyKey, replyToID, attachmentIDs)
+}
+
+// postMessage stores a message of the sender in the chat unless the sender already used the
+// idempotency key, in which case the retry must match the stored message and is not created again
+func (s *MessageService) postMessage(chat *domain.Chat, senderID, content, idempotencyKey, replyToID string, attachmentIDs []string) (*domain.Message, bool, error) {
+	if len(attachmentIDs) > domain.MaxMessageAttachments {
+		return nil, false, domain.ErrTooManyAttachments
+	}
+
+	// The attachments of a retried message were claimed by the first attempt, so retries are
+	// recognized before the attachments are checked
+	if stored, err := s.findRetry(chat.ID, senderID, content, idempotencyKey, replyToID, attachmentIDs); stored != nil || err != nil {
+		return stored, false, err
+	}
+
+	attachments, err := s.pendingAttachments(senderID, attachmentIDs)
+	if err == domain.ErrAttachmentUnavailable {
+		// A concurrent attempt with the same key may have claimed them since the lookup above
+		if stored, err := s.findRetry(chat.ID, senderID, content, idempotencyKey, replyToID, attachmentIDs); stored != nil || err != nil {
+			return stored, false, err
 		}
 	}
+	if err != nil {
+		return nil, false, err
+	}
 
-	// Check for duplicate message using idempotency key
-	if idempotencyKey != "" {
-		existingMsg, err := s.chatRepo.FindMessageByKey(chat.ID, idempotencyKey)
-		if err == nil && existingMsg != nil {
-			return existingMsg, nil // Return existing message for idempotency
+	if replyToID != "" {
+		quoted, err := s.chatRepo.FindMessageByID(replyToID)
+		if err == domain.ErrMessageNotFound || (err == nil && quoted.ChatID != chat.ID) {
+			return nil, false, domain.ErrInvalidReplyTo
+		}
+		if err != nil {
+			return nil, false, err
 		}
 	}
 
-	// Create message
 	message := &domain.Message{
 		ChatID:         chat.ID,
 		SenderID:       senderID,
@@ -67,16 +122,231 @@ func (s *MessageService) SendMessage(senderID, recipientID, content, idempotency
 		Status:         domain.StatusSent,
 		Timestamp:      time.Now(),
 		IdempotencyKey: idempotencyKey,
+		ReplyToID:      replyToID,
+		Attachments:    attachments,
+	}
+
+	// Insert unless a concurrent retry already used this idempotency key
+	stored, created, err := s.chatRepo.AddMessageIfKeyAbsent(message)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !created {
+		if err := s.checkRetry(stored, chat.ID, content, replyToID, attachmentIDs); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return stored, created, nil
+}
+
+// findRetry returns the message stored under the sender's idempotency key when the request is a
+// retry of it, nil when there is none, and ErrIdempotencyKeyReused when the key was used for a
+// different message
+func (s *MessageService) findRetry(chatID, senderID, content, idempotencyKey, replyToID string, attachmentIDs []string) (*domain.Message, error) {
+	if idempotencyKey == "" {
+		return nil, nil
+	}
+
+	stored, err := s.chatRepo.FindMessageByKey(senderID, idempotencyKey)
+	if err == domain.ErrMessageNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkRetry(stored, chatID, content, replyToID, attachmentIDs); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// checkRetry verifies that a retry carries the same payload as the message stored under its
+// idempotency key, otherwise the key was reused for a different message. The content and
+// attachments of deleted messages are gone, so only their chat and quote can be compared.
+func (s *MessageService) checkRetry(stored *domain.Message, chatID, content, replyToID string, attachmentIDs []string) error {
+	if stored.ChatID != chatID || stored.ReplyToID != replyToID {
+		return domain.ErrIdempotencyKeyReused
+	}
+	if stored.DeletedAt != nil {
+		return nil
+	}
+
+	sentContent, err := s.originalContent(stored)
+	if err != nil {
+		return err
+	}
+	if sentContent != content || len(stored.Attachments) != len(attachmentIDs) {
+		return domain.ErrIdempotencyKeyReused
+	}
+	for i, attachment := range stored.Attachments {
+		if attachment.ID != attachmentIDs[i] {
+			return domain.ErrIdempotencyKeyReused
+		}
 	}
 
-	if err := s.chatRepo.AddMessage(message); err != nil {
+	return nil
+}
+
+// originalContent returns the content a message was sent with, before any edits
+func (s *MessageService) originalContent(message *domain.Message) (string, error) {
+	if message.EditedAt == nil {
+		return message.Content, nil
+	}
+
+	revisions, err := s.chatRepo.FindMessageRevisions(message.ID)
+	if err != nil {
+		return "", err
+	}
+	if len(revisions) == 0 {
+		return message.Content, nil
+	}
+
+	return revisions[0].Content, nil
+}
+
+// EditMessage replaces the content of one of the user's messages within the edit window and
+// returns the updated message; earlier contents are kept as revisions. Editing a message to its
+// current content changes nothing, and only messages with attachments may lose their content.
+func (s *MessageService) EditMessage(userID, messageID, content string) (*domain.Message, error) {
+	message, err := s.authorizeEdit(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if content == "" && len(message.Attachments) == 0 {
+		return nil, domain.ErrEmptyMessage
+	}
+
+	if message.DeletedAt != nil {
+		return nil, domain.ErrMessageDeleted
+	}
+
+	now := time.Now()
+	if now.Sub(message.Timestamp) > s.editWindow {
+		return nil, domain.ErrEditWindowExpired
+	}
+
+	if content == message.Content {
+		return message, nil
+	}
+
+	return s.chatRepo.EditMessage(messageID, content, now)
+}
+
+// DeleteMessage deletes a message either for the user only, hiding it from the chat messages they
+// list, or, for its sender within the delete window, for everyone by replacing it with a tombstone.
+// It returns the message as the other participant sees it afterwards.
+func (s *MessageService) DeleteMessage(userID, messageID string, scope domain.DeletionScope) (*domain.Message, error) {
+	if !scope.IsValid() {
+		return nil, domain.ErrInvalidDeletionScope
+	}
+
+	now := time.Now()
+	if scope == domain.DeleteForMe {
+		message, err := s.authorizeMessageAccess(userID, messageID)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.chatRepo.HideMessage(messageID, userID, now); err != nil {
+			return nil, err
+		}
+		return message, nil
+	}
+
+	message, err := s.authorizeEdit(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.DeletedAt == nil && now.Sub(message.Timestamp) > s.deleteWindow {
+		return nil, domain.ErrDeleteWindowExpired
+	}
+
+	deleted, err := s.chatRepo.DeleteMessage(messageID, now)
+	if err != nil {
 		return nil, err
 	}
 
-	return message, nil
+	// The tombstone no longer refers to the attachments, so their content can go
+	s.deleteAttachmentBlobs(message.Attachments...)
+
+	return deleted, nil
+}
+
+// AddReaction adds the user's reaction to a message of one of their chats and returns the message
+// with its reactions and whether the reaction is new
+func (s *MessageService) AddReaction(userID, messageID, emoji string) (*domain.Message, bool, error) {
+	if err := domain.ValidateReaction(emoji); err != nil {
+		return nil, false, err
+	}
+
+	if _, err := s.authorizeMessageAccess(userID, messageID); err != nil {
+		return nil, false, err
+	}
+
+	return s.chatRepo.AddReaction(&domain.Reaction{
+		MessageID: messageID,
+		UserID:    userID,
+		Emoji:     emoji,
+		CreatedAt: time.Now(),
+	})
+}
+
+// RemoveReaction takes back the user's reaction to a message of one of their chats and returns the
+// message with its remaining reactions and whether the reaction existed
+func (s *MessageService) RemoveReaction(userID, messageID, emoji string) (*domain.Message, bool, error) {
+	if err := domain.ValidateReaction(emoji); err != nil {
+		return nil, false, err
+	}
+
+	if _, err := s.authorizeMessageAccess(userID, messageID); err != nil {
+		return nil, false, err
+	}
+
+	return s.chatRepo.RemoveReaction(messageID, userID, emoji, time.Now())
 }
 
-// GetUserChats retrieves chats for a user with pagination
+// GetMessageRevisions returns the earlier contents of a message, oldest first; the user must be a
+// participant of its chat
+func (s *MessageService) GetMessageRevisions(userID, messageID string) ([]*domain.MessageRevision, error) {
+	if _, err := s.authorizeMessageAccess(userID, messageID); err != nil {
+		return nil, err
+	}
+
+	return s.chatRepo.FindMessageRevisions(messageID)
+}
+
+// AuthorizePresence checks that the viewer may see which devices the user has online: their own,
+// or those of a user they share a chat with
+func (s *MessageService) AuthorizePresence(viewerID, userID string) error {
+	if _, err := s.userRepo.FindByID(userID); err != nil {
+		return err
+	}
+	if viewerID == userID {
+		return nil
+	}
+
+	shares, err := s.chatRepo.SharesChat(viewerID, userID)
+	if err != nil {
+		return err
+	}
+	if !shares {
+		return domain.ErrNoSharedChat
+	}
+
+	return nil
+}
+
+// GetChat returns a chat without authorization checks, for fan-out of events to its participants
+func (s *MessageService) GetChat(chatID string) (*domain.Chat, error) {
+	return s.chatRepo.FindByID(chatID)
+}
+
+// GetUserChats retrieves the user's chat summaries with pagination, most recently active first
 func (s *MessageService) GetUserChats(userID string, page, pageSize int) (*domain.PaginatedResponse, error) {
 	if page < 1 {
 		page = 1
@@ -95,6 +365,19 @@ func (s *MessageService) GetUserChats(userID string, page, pageSize int) (*domai
 		return nil, err
 	}
 
+	// Attach the other participant's profile so clients can render the inbox in one request;
+	// group chats are rendered from their title and members instead
+	for _, chat := range chats {
+		if chat.IsGroup() {
+			continue
+		}
+		peer, err := s.userRepo.FindByID(chat.OtherParticipant(userID))
+		if err != nil && err != domain.ErrUserNotFound {
+			return nil, err
+		}
+		chat.Peer = peer
+	}
+
 	return &domain.PaginatedResponse{
 		Data:       chats,
 		Page:       page,
@@ -104,8 +387,12 @@ func (s *MessageService) GetUserChats(userID string, page, pageSize int) (*domai
 	}, nil
 }
 
-// GetChatMessages retrieves messages from a chat with pagination
-func (s *MessageService) GetChatMessages(chatID string, page, pageSize int) (*domain.PaginatedResponse, error) {
+// GetChatMessages retrieves messages from a chat with pagination; the user must be a participant
+func (s *MessageService) GetChatMessages(userID, chatID string, page, pageSize int) (*domain.PaginatedResponse, error) {
+	if _, err := s.authorizeChatAccess(userID, chatID); err != nil {
+		return nil, err
+	}
+
 	if page < 1 {
 		page = 1
 	}
@@ -118,7 +405,7 @@ func (s *MessageService) GetChatMessages(chatID string, page, pageSize int) (*do
 		PageSize: pageSize,
 	}
 
-	messages, total, err := s.chatRepo.FindChatMessages(chatID, pagination)
+	messages, total, err := s.chatRepo.FindChatMessages(chatID, userID, pagination)
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +419,211 @@ func (s *MessageService) GetChatMessages(chatID string, page, pageSize int) (*do
 	}, nil
 }
 
-// UpdateMessageStatus updates the status of a message
-func (s *MessageService) UpdateMessageStatus(messageID string, status domain.MessageStatus) error {
+// GetChatMessagesPage retrieves a cursor page of a chat's messages; the user must be a participant.
+// before and after are cursors from earlier pages, direction is forward (oldest first, default) or
+// backward (newest first).
+func (s *MessageService) GetChatMessagesPage(userID, chatID, before, after, direction string, pageSize int) (*domain.PaginatedResponse, error) {
+	if _, err := s.authorizeChatAccess(userID, chatID); err != nil {
+		return nil, err
+	}
+
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 50
+	}
+
+	params := domain.CursorParams{
+		Direction: domain.CursorDirection(direction),
+		Limit:     pageSize,
+	}
+	switch params.Direction {
+	case "":
+		params.Direction = domain.DirectionForward
+	case domain.DirectionForward, domain.DirectionBackward:
+	default:
+		return nil, domain.ErrInvalidDirection
+	}
+
+	var err error
+	if before != "" {
+		if params.Before, err = domain.DecodeMessageCursor(before); err != nil {
+			return nil, err
+		}
+	}
+	if after != "" {
+		if params.After, err = domain.DecodeMessageCursor(after); err != nil {
+			return nil, err
+		}
+	}
+
+	page, err := s.chatRepo.FindChatMessagesPage(chatID, userID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &domain.PaginatedResponse{
+		Data:       page.Messages,
+		PageSize:   pageSize,
+		TotalCount: page.TotalCount,
+		TotalPages: (page.TotalCount + pageSize - 1) / pageSize,
+	}
+	if count := len(page.Messages); count > 0 {
+		if page.HasNext {
+			response.NextCursor = domain.CursorFor(page.Messages[count-1]).Encode()
+		}
+		if page.HasPrevious {
+			response.PrevCursor = domain.CursorFor(page.Messages[0]).Encode()
+		}
+	}
+
+	return response, nil
+}
+
+// UpdateMessageStatus moves a message forward to the given status on behalf of its recipient and
+// returns the updated message; statuses never move backwards (ErrInvalidStatusTransition)
+func (s *MessageService) UpdateMessageStatus(userID, messageID string, status domain.MessageStatus) (*domain.Message, error) {
+	if _, err := s.authorizeStatusUpdate(userID, messageID); err != nil {
+		return nil, err
+	}
+
 	return s.chatRepo.UpdateMessageStatus(messageID, status)
 }
+
+// MarkChatRead marks every message of the chat the user received up to and including messageID as
+// read, returning the user's read watermark and the messages that became read
+func (s *MessageService) MarkChatRead(userID, chatID, messageID string) (*domain.ReadMark, []*domain.Message, error) {
+	if messageID == "" {
+		return nil, nil, domain.ErrMessageNotFound
+	}
+
+	if _, err := s.authorizeChatAccess(userID, chatID); err != nil {
+		return nil, nil, err
+	}
+
+	return s.chatRepo.MarkChatReadUpTo(chatID, userID, messageID)
+}
+
+// GetUndeliveredMessages returns up to limit of the oldest messages that have not been delivered
+// to the user yet, together with the total number of undelivered messages
+func (s *MessageService) GetUndeliveredMessages(userID string, limit int) ([]*domain.Message, int, error) {
+	return s.chatRepo.FindUndeliveredMessages(userID, limit)
+}
+
+// FetchUndeliveredMessages hands the oldest undelivered messages to the user and marks them as
+// delivered; it returns them with the number of messages still waiting afterwards
+func (s *MessageService) FetchUndeliveredMessages(userID string, limit int) ([]*domain.Message, int, error) {
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+
+	messages, total, err := s.chatRepo.FindUndeliveredMessages(userID, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i, message := range messages {
+		delivered, err := s.chatRepo.UpdateMessageStatus(message.ID, domain.StatusDelivered)
+		if err == domain.ErrInvalidStatusTransition {
+			// A device received (or the user read) it since it was loaded; hand out its current state
+			delivered, err = s.chatRepo.FindMessageByID(message.ID)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		messages[i] = delivered
+	}
+
+	return messages, total - len(messages), nil
+}
+
+// Sync returns the user's changes that follow the sync token, up to limit of them, together with
+// the current state of every message and chat they refer to; an empty token starts from the
+// beginning of the user's change log. Like the chat history, it leaves out the messages the user
+// deleted for themselves, apart from that deletion, and the chats they no longer take part in,
+// apart from their leaving. A token whose following changes were pruned fails with
+// ErrInvalidSyncToken, telling the client to sync again from the beginning.
+func (s *MessageService) Sync(userID, token string, limit int) (*domain.SyncResult, error) {
+	if limit < 1 || limit > 500 {
+		limit = 100
+	}
+
+	since, err := domain.DecodeSyncToken(userID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, hasMore, err := s.chatRepo.FindChanges(userID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sequence numbers have no gaps, so a jump means the changes after the token were pruned
+	if since > 0 && len(changes) > 0 && changes[0].Seq > since+1 {
+		return nil, domain.ErrInvalidSyncToken
+	}
+
+	result := &domain.SyncResult{
+		Changes:   changes,
+		Messages:  []*domain.Message{},
+		Chats:     []*domain.Chat{},
+		NextToken: domain.EncodeSyncToken(userID, since),
+		HasMore:   hasMore,
+	}
+	if len(changes) > 0 {
+		result.NextToken = domain.EncodeSyncToken(userID, changes[len(changes)-1].Seq)
+	}
+
+	// Several changes may refer to the same message or chat; return each once, in its latest state.
+	// Chats the user left and messages they hid map to false.
+	visibleChats := make(map[string]bool)
+	visibleMessages := make(map[string]bool)
+	result.Changes = make([]*domain.Change, 0, len(changes))
+	for _, change := range changes {
+		visible, seen := visibleChats[change.ChatID]
+		if !seen {
+			chat, err := s.chatRepo.FindByID(change.ChatID)
+			if err != nil {
+				return nil, err
+			}
+			visible = chat.HasParticipant(userID)
+			visibleChats[change.ChatID] = visible
+			if visible {
+				result.Chats = append(result.Chats, chat)
+			}
+		}
+		if !visible {
+			if change.Type == domain.ChangeMemberRemoved && change.UserID == userID {
+				result.Changes = append(result.Changes, change)
+			}
+			continue
+		}
+
+		if change.MessageID != "" {
+			visible, seen := visibleMessages[change.MessageID]
+			if !seen {
+				message, err := s.chatRepo.FindVisibleMessage(change.MessageID, userID)
+				if err != nil && err != domain.ErrMessageNotFound {
+					return nil, err
+				}
+				visible = err == nil
+				visibleMessages[change.MessageID] = visible
+				if visible {
+					result.Messages = append(result.Messages, message)
+				}
+			}
+			// Read watermarks still apply when the user hid the message they point at
+			if !visible && change.Type != domain.ChangeMessageHidden && change.Type != domain.ChangeChatRead {
+				continue
+			}
+		}
+
+		result.Changes = append(result.Changes, change)
+	}
+
+	return result, nil
+}
+
+// PurgeChanges deletes the change log entries logged before the given time and returns how many
+// were deleted
+func (s *MessageService) PurgeChanges(loggedBefore time.Time) (int, error) {
+	return s.chatRepo.DeleteChangesBefore(loggedBefore)
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	// Register the decoders of the image formats thumbnails are made of
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	// thumbnailSize bounds the width and height of thumbnails, which keep the aspect ratio
+	thumbnailSize = 320
+
+	// maxThumbnailPixels keeps huge images, e.g. decompression bombs, from being decoded
+	maxThumbnailPixels = 40_000_000
+
+	thumbnailQuality = 80
+)
+
+// imageThumbnail returns the dimensions of an image and a JPEG thumbnail of it. Images that cannot
+// be decoded, such as WebP, get no dimensions and no thumbnail; images that are too large to decode
+// get dimensions but no thumbnail.
+func imageThumbnail(data []byte) (width, height int, thumbnail []byte) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width < 1 || config.Height < 1 {
+		return 0, 0, nil
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return config.Width, config.Height, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return config.Width, config.Height, nil
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(img, thumbnailSize), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return config.Width, config.Height, nil
+	}
+
+	return config.Width, config.Height, buf.Bytes()
+}
+
+// scaleDown shrinks an image to fit into a size x size square, averaging the source pixels each
+// thumbnail pixel covers; transparent areas become white since JPEG has no alpha channel
+func scaleDown(src image.Image, size int) *image.RGBA {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	width, height := srcWidth, srcHeight
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, srcHeight*size/srcWidth)
+		} else {
+			width, height = max(1, srcWidth*size/srcHeight), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcHeight/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcHeight/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcWidth/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcWidth/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			// The components are alpha-premultiplied, so the missing coverage is filled with white
+			white := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(b/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+
+	return dst
+}
@@ -1,12 +1,9 @@
 package sockets
 
 import (
-	"encoding/json"
 	"log"
 	"time"
 
-	"messaging-app/domain"
-
 	"github.com/gorilla/websocket"
 )
 
@@ -55,16 +52,28 @@ func (c *Client) StartReader(hub *ConnectionHub) {
 			break
 		}
 
-		// Handle incoming WebSocket messages
-		var msg struct {
-			Type      string `json:"type"`
-			MessageID string `json:"message_id"`
-		}
+		// Route the envelope to the handler of its event type
+		hub.Dispatcher.Dispatch(hub, c, message)
+	}
+}
 
-		if err := json.Unmarshal(message, &msg); err == nil {
-			if msg.Type == "mark_read" {
-				hub.MessageSvc.UpdateMessageStatus(msg.MessageID, domain.StatusRead)
-			}
-		}
+// SendEvent wraps the payload in an envelope and queues it for the writer
+func (c *Client) SendEvent(eventType, id string, payload interface{}) {
+	frame, err := NewEnvelope(eventType, id, payload)
+	if err != nil {
+		log.Printf("Error marshaling %s frame: %v", eventType, err)
+		return
+	}
+
+	if !c.Deliver(frame) {
+		log.Printf("Dropping %s frame for %s: client closed or buffer full", eventType, c.UserID)
 	}
 }
+
+// SendError reports a failed request, correlated by the request's envelope id
+func (c *Client) SendError(id, code, message string) {
+	c.SendEvent(EventError, id, ErrorPayload{
+		Code:    code,
+		Message: message,
+	})
+}
@@ -0,0 +1,82 @@
+package sockets
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// HandlerFunc handles one inbound event; a returned error is reported to the client as an error frame
+type HandlerFunc func(hub *ConnectionHub, client *Client, envelope *Envelope) error
+
+// Dispatcher routes inbound envelopes to handlers by event type
+type Dispatcher struct {
+	handlers map[string]HandlerFunc
+}
+
+// NewDispatcher creates an empty dispatcher
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		handlers: make(map[string]HandlerFunc),
+	}
+}
+
+// Handle registers the handler of an event type
+func (d *Dispatcher) Handle(eventType string, handler HandlerFunc) {
+	d.handlers[eventType] = handler
+}
+
+// Dispatch decodes a raw frame and invokes the handler registered for its type
+func (d *Dispatcher) Dispatch(hub *ConnectionHub, client *Client, frame []byte) {
+	var envelope Envelope
+	if err := json.Unmarshal(frame, &envelope); err != nil || envelope.Type == "" {
+		client.SendError(envelope.ID, ErrCodeBadRequest, "frame must be a JSON envelope with a type")
+		return
+	}
+
+	if envelope.Version != 0 && envelope.Version != ProtocolVersion {
+		client.SendError(envelope.ID, ErrCodeUnsupportedVersion, "unsupported protocol version")
+		return
+	}
+
+	handler, exists := d.handlers[envelope.Type]
+	if !exists {
+		client.SendError(envelope.ID, ErrCodeUnknownType, "unknown event type: "+envelope.Type)
+		return
+	}
+
+	if err := handler(hub, client, &envelope); err != nil {
+		if protoErr, ok := err.(*ProtocolError); ok {
+			client.SendError(envelope.ID, protoErr.Code, protoErr.Message)
+			return
+		}
+
+		code := errorCodeFor(err)
+		if code == ErrCodeInternal {
+			log.Printf("WebSocket %s handler failed for %s: %v", envelope.Type, client.UserID, err)
+		}
+		client.SendError(envelope.ID, code, err.Error())
+	}
+}
+
+// ProtocolError is returned by handlers for requests that violate the protocol itself
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+// decodePayload unmarshals the envelope payload into v, reporting an invalid_payload error
+func decodePayload(envelope *Envelope, v interface{}) error {
+	if len(envelope.Payload) == 0 {
+		return &ProtocolError{ErrCodeInvalidPayload, "missing payload"}
+	}
+
+	if err := json.Unmarshal(envelope.Payload, v); err != nil {
+		return &ProtocolError{ErrCodeInvalidPayload, "invalid payload for " + envelope.Type}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package sockets
+
+import (
+	"messaging-app/domain"
+)
+
+// registerDefaultHandlers wires the built-in client -> server events
+func registerDefaultHandlers(d *Dispatcher) {
+	d.Handle(EventSendMessage, handleSendMessage)
+	d.Handle(EventMarkRead, handleMarkRead)
+	d.Handle(EventMarkChatRead, handleMarkChatRead)
+	d.Handle(EventResume, handleResume)
+	d.Handle(EventEditMessage, handleEditMessage)
+	d.Handle(EventDeleteMessage, handleDeleteMessage)
+	d.Handle(EventAddReaction, handleAddReaction)
+	d.Handle(EventRemoveReaction, handleRemoveReaction)
+}
+
+// handleSendMessage sends a message on behalf of the connected user, acknowledges it to the
+// sender and fans it out to the other participants and the sender's other devices like the REST
+// endpoint; a retry with a used idempotency key is only acknowledged
+func handleSendMessage(hub *ConnectionHub, client *Client, envelope *Envelope) error {
+	var payload SendMessagePayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+
+	var message *domain.Message
+	var created bool
+	var err error
+	switch {
+	case payload.ChatID != "" && payload.RecipientID != "":
+		return domain.ErrRecipientAndChat
+	case payload.ChatID != "":
+		message, created, err = hub.MessageSvc.SendToChat(client.UserID, payload.ChatID, payload.Content, payload.IdempotencyKey, payload.ReplyToID, payload.AttachmentIDs)
+	default:
+		message, created, err = hub.MessageSvc.SendMessage(client.UserID, payload.RecipientID, payload.Content, payload.IdempotencyKey, payload.ReplyToID, payload.AttachmentIDs)
+	}
+	if err != nil {
+		return err
+	}
+
+	client.SendEvent(EventMessageAck, envelope.ID, MessageAckPayload{
+		MessageID:      message.ID,
+		ChatID:         message.ChatID,
+		Seq:            message.Seq,
+		Timestamp:      message.Timestamp,
+		IdempotencyKey: message.IdempotencyKey,
+	})
+
+	if created {
+		hub.BroadcastMessage(message, client.DeviceID)
+	}
+	return nil
+}
+
+// handleMarkRead marks a message as read, which only its recipient may do, and sends a read
+// receipt to the sender
+func handleMarkRead(hub *ConnectionHub, client *Client, envelope *Envelope) error {
+	var payload MarkReadPayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+
+	message, err := hub.MessageSvc.UpdateMessageStatus(client.UserID, payload.MessageID, domain.StatusRead)
+	if err != nil {
+		return err
+	}
+
+	hub.SendReceipt(message)
+	return nil
+}
+
+// handleMarkChatRead marks the chat as read up to a message and notifies the other participant and
+// the user's other devices
+func handleMarkChatRead(hub *ConnectionHub, client *Client, envelope *Envelope) error {
+	var payload MarkChatReadPayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+
+	mark, read, err := hub.MessageSvc.MarkChatRead(client.UserID, payload.ChatID, payload.MessageID)
+	if err != nil {
+		return err
+	}
+
+	hub.SendChatRead(mark, read, client.DeviceID)
+	return nil
+}
+
+// handleResume replies with the changes the user missed since the given sync token; clients keep
+// resuming with next_token while has_more is set
+func handleResume(hub *ConnectionHub, client *Client, envelope *Envelope) error {
+	var payload ResumePayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+
+	result, err := hub.MessageSvc.Sync(client.UserID, payload.Since, payload.Limit)
+	if err != nil {
+		return err
+	}
+
+	client.SendEvent(EventSync, envelope.ID, result)
+	return nil
+}
+
+// handleEditMessage edits one of the user's messages, replies with the edited message and pushes
+// it to the other participant and the user's other devices
+func handleEditMessage(hub *ConnectionHub, client *Client, envelope *Envelope) error {
+	var payload EditMessagePayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+
+	message, err := hub.MessageSvc.EditMessage(client.UserID, payload.MessageID, payload.Content)
+	if err != nil {
+		return err
+	}
+
+	client.SendEvent(EventMessageEdited, envelope.ID, message)
+	hub.SendMessageEdited(message, client.DeviceID)
+	return nil
+}
+
+// handleDeleteMessage deletes a message for the user or for everyone, replies with the deletion
+// and tells everyone else who should no longer see the message
+func handleDeleteMessage(hub *ConnectionHub, client *Client, envelope *Envelope) error {
+	var payload DeleteMessagePayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+	if payload.Scope == "" {
+		payload.Scope = domain.DeleteForMe
+	}
+
+	message, err := hub.MessageSvc.DeleteMessage(client.UserID, payload.MessageID, payload.Scope)
+	if err != nil {
+		return err
+	}
+
+	client.SendEvent(EventMessageDeleted, envelope.ID, newMessageDeletedPayload(message, payload.Scope))
+	hub.SendMessageDeleted(message, payload.Scope, client.UserID, client.DeviceID)
+	return nil
+}
+
+// handleAddReaction adds the user's reaction to a message, replies with the message's reactions and
+// tells the other participant and the user's other devices when the reaction is new
+func handleAddReaction(hub *ConnectionHub, client *Client, envelope *Envelope) error {
+	var payload ReactionRequestPayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+
+	message, changed, err := hub.MessageSvc.AddReaction(client.UserID, payload.MessageID, payload.Emoji)
+	if err != nil {
+		return err
+	}
+
+	client.SendEvent(EventReactionAdded, envelope.ID, newReactionPayload(message, client.UserID, payload.Emoji))
+	if changed {
+		hub.SendReaction(EventReactionAdded, message, client.UserID, payload.Emoji, client.DeviceID)
+	}
+	return nil
+}
+
+// handleRemoveReaction takes back the user's reaction to a message, replies with the message's
+// remaining reactions and tells the other participant and the user's other devices when it existed
+func handleRemoveReaction(hub *ConnectionHub, client *Client, envelope *Envelope) error {
+	var payload ReactionRequestPayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+
+	message, changed, err := hub.MessageSvc.RemoveReaction(client.UserID, payload.MessageID, payload.Emoji)
+	if err != nil {
+		return err
+	}
+
+	client.SendEvent(EventReactionRemoved, envelope.ID, newReactionPayload(message, client.UserID, payload.Emoji))
+	if changed {
+		hub.SendReaction(EventReactionRemoved, message, client.UserID, payload.Emoji, client.DeviceID)
+	}
+	return nil
+}
@@ -1,9 +1,10 @@
 package sockets
 
 import (
-	"encoding/json"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	"messaging-app/domain"
 	"messaging-app/services"
@@ -11,62 +12,221 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// Client represents a WebSocket connection for a user
+// Client represents a WebSocket connection of one of a user's devices
 type Client struct {
-	UserID string
-	Conn   *websocket.Conn
-	Send   chan []byte
+	UserID      string
+	DeviceID    string
+	ConnectedAt time.Time
+	Conn        *websocket.Conn
+	Send        chan []byte
+
+	mutex  sync.Mutex
+	closed bool
+
+	// While the offline queue is flushed, live messages are held back so they follow the queue,
+	// and every message ID pushed is recorded so that none is sent twice
+	flushing bool
+	held     []heldMessage
+	flushed  map[string]bool
+}
+
+// heldMessage is a live message frame waiting for the offline queue flush to finish
+type heldMessage struct {
+	messageID string
+	frame     []byte
+}
+
+// Deliver queues data for the writer without blocking; it reports false if the
+// client is closed or its buffer is full
+func (c *Client) Deliver(data []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	return c.queueLocked(data)
+}
+
+// DeliverMessage queues the frame of a live message like Deliver, or holds it back until the
+// offline queue flush in progress has finished
+func (c *Client) DeliverMessage(messageID string, frame []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return false
+	}
+	if c.flushing {
+		c.held = append(c.held, heldMessage{messageID, frame})
+		return true
+	}
+
+	return c.queueLocked(frame)
+}
+
+// beginFlush starts holding back live messages while the offline queue is pushed
+func (c *Client) beginFlush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.flushing = true
+	c.flushed = make(map[string]bool)
+}
+
+// flushMessage queues the frame of a message from the offline queue; it reports false if the
+// client is closed or its buffer is full
+func (c *Client) flushMessage(messageID string, frame []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	c.flushed[messageID] = true
+	return c.queueLocked(frame)
+}
+
+// endFlush queues the live messages held back during the flush, except those the flush already
+// pushed, and delivers live messages directly again; it reports false if the client is closed or
+// its buffer is full
+func (c *Client) endFlush() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	held, flushed := c.held, c.flushed
+	c.flushing, c.held, c.flushed = false, nil, nil
+	if c.closed {
+		return false
+	}
+
+	for _, message := range held {
+		if !flushed[message.messageID] && !c.queueLocked(message.frame) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// queueLocked queues data for the writer without blocking; the caller must hold the client's lock
+// and have checked that it is not closed
+func (c *Client) queueLocked(data []byte) bool {
+	select {
+	case c.Send <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the send channel exactly once, which makes the writer close the connection
+func (c *Client) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.Send)
+	}
+}
+
+// Device describes an online device of a user
+type Device struct {
+	DeviceID    string    `json:"device_id"`
+	ConnectedAt time.Time `json:"connected_at"`
 }
 
 // ConnectionHub manages WebSocket connections and message broadcasting
 type ConnectionHub struct {
-	Clients    map[string]*Client // userID -> Client
+	Clients    map[string]map[string]*Client // userID -> deviceID -> Client
 	Broadcast  chan *BroadcastMessage
 	Register   chan *Client
 	Unregister chan *Client
 	Mutex      sync.RWMutex
 	MessageSvc *services.MessageService
+	Dispatcher *Dispatcher
+
+	// OfflineQueueLimit caps how many undelivered messages are pushed when a user comes online
+	OfflineQueueLimit int
+
+	done     chan struct{} // closed by Stop to end the main loop
+	stopped  chan struct{} // closed when the main loop has returned
+	stopOnce sync.Once
 }
 
-// BroadcastMessage contains both the message and recipient information
+// BroadcastMessage contains a new message and the device it came from
 type BroadcastMessage struct {
-	Message     *domain.Message
-	RecipientID string
+	Message        *domain.Message
+	OriginDeviceID string // sender's device the message came from; it already has the message
 }
 
 // NewConnectionHub creates a new connection hub
-func NewConnectionHub(messageSvc *services.MessageService) *ConnectionHub {
+func NewConnectionHub(messageSvc *services.MessageService, offlineQueueLimit int) *ConnectionHub {
+	dispatcher := NewDispatcher()
+	registerDefaultHandlers(dispatcher)
+
 	return &ConnectionHub{
-		Clients:    make(map[string]*Client),
+		Clients:    make(map[string]map[string]*Client),
 		Broadcast:  make(chan *BroadcastMessage, 256),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
 		MessageSvc: messageSvc,
+		Dispatcher: dispatcher,
+
+		OfflineQueueLimit: offlineQueueLimit,
+
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 }
 
-// Run starts the hub's main loop
+// Run starts the hub's main loop, which lasts until Stop is called
 func (h *ConnectionHub) Run() {
+	defer close(h.stopped)
+
 	for {
 		select {
+		case <-h.done:
+			h.Mutex.Lock()
+			for _, devices := range h.Clients {
+				for _, client := range devices {
+					client.Close()
+				}
+			}
+			h.Clients = make(map[string]map[string]*Client)
+			h.Mutex.Unlock()
+			return
+
 		case client := <-h.Register:
 			h.Mutex.Lock()
-			// Disconnect existing client for the same user
-			if existing, exists := h.Clients[client.UserID]; exists {
-				close(existing.Send)
-				delete(h.Clients, client.UserID)
+			devices, exists := h.Clients[client.UserID]
+			if !exists {
+				devices = make(map[string]*Client)
+				h.Clients[client.UserID] = devices
+			}
+			// A reconnecting device replaces its stale connection; other devices stay connected
+			if existing, exists := devices[client.DeviceID]; exists {
+				existing.Close()
+			}
+			devices[client.DeviceID] = client
+
+			// Push whatever arrived while the user was offline, off the hub's loop; live messages
+			// wait for the queue from the moment the device can receive them
+			if h.OfflineQueueLimit > 0 {
+				client.beginFlush()
+				go h.flushUndelivered(client)
 			}
-			h.Clients[client.UserID] = client
 			h.Mutex.Unlock()
 
-			log.Printf("Client registered: %s", client.UserID)
+			log.Printf("Client registered: %s (device %s)", client.UserID, client.DeviceID)
 
 		case client := <-h.Unregister:
 			h.Mutex.Lock()
-			if existing, exists := h.Clients[client.UserID]; exists && existing == client {
-				close(client.Send)
-				delete(h.Clients, client.UserID)
-				log.Printf("Client unregistered: %s", client.UserID)
+			if h.removeClientLocked(client) {
+				log.Printf("Client unregistered: %s (device %s)", client.UserID, client.DeviceID)
 			}
 			h.Mutex.Unlock()
 
@@ -76,45 +236,344 @@ func (h *ConnectionHub) Run() {
 	}
 }
 
-// broadcastMessage sends a message to the intended recipient if they're connected
+// removeClientLocked closes and forgets the client if it is still the registered connection
+// of its device; the caller must hold the write lock
+func (h *ConnectionHub) removeClientLocked(client *Client) bool {
+	devices, exists := h.Clients[client.UserID]
+	if !exists || devices[client.DeviceID] != client {
+		return false
+	}
+
+	client.Close()
+	delete(devices, client.DeviceID)
+	if len(devices) == 0 {
+		delete(h.Clients, client.UserID)
+	}
+
+	return true
+}
+
+// broadcastMessage sends a message to every connected device of the recipient and, for
+// multi-device sync, to the sender's other devices, followed by a delivery receipt to the sender.
+// Group messages go to every member's devices and have no receipts.
 func (h *ConnectionHub) broadcastMessage(broadcastMsg *BroadcastMessage) {
-	h.Mutex.RLock()
-	defer h.Mutex.RUnlock()
+	message := broadcastMsg.Message
+	chat, err := h.MessageSvc.GetChat(message.ChatID)
+	if err != nil {
+		log.Printf("Error loading chat %s: %v", message.ChatID, err)
+		return
+	}
+
+	messageJSON, err := NewEnvelope(EventMessage, "", message)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return
+	}
+
+	h.Mutex.Lock()
+	if chat.IsGroup() {
+		h.deliverToChatLocked(chat, message.SenderID, broadcastMsg.OriginDeviceID, messageJSON)
+		h.Mutex.Unlock()
+		return
+	}
+
+	recipientID := chat.OtherParticipant(message.SenderID)
+	recipientDevices := h.deliverMessageLocked(recipientID, message.ID, messageJSON)
+	h.deliverLocked(message.SenderID, broadcastMsg.OriginDeviceID, messageJSON)
+	h.Mutex.Unlock()
+
+	if recipientDevices > 0 {
+		// Update message status to delivered on behalf of the recipient and tell the sender
+		if delivered, err := h.MessageSvc.UpdateMessageStatus(recipientID, message.ID, domain.StatusDelivered); err == nil {
+			h.SendReceipt(delivered)
+		}
+	}
+}
+
+// deliverLocked queues a frame on every device of the user except skipDeviceID and returns
+// how many devices accepted it; devices that cannot keep up are disconnected.
+// The caller must hold the write lock.
+func (h *ConnectionHub) deliverLocked(userID, skipDeviceID string, frame []byte) int {
+	delivered := 0
+	for deviceID, client := range h.Clients[userID] {
+		if deviceID == skipDeviceID {
+			continue
+		}
+
+		if client.Deliver(frame) {
+			delivered++
+		} else {
+			h.removeClientLocked(client)
+		}
+	}
+
+	return delivered
+}
 
-	// Send to recipient if connected
-	if client, exists := h.Clients[broadcastMsg.RecipientID]; exists {
-		messageJSON, err := json.Marshal(broadcastMsg.Message)
+// deliverMessageLocked queues the frame of a live message on every device of its recipient and
+// returns how many devices accepted it; devices that cannot keep up are disconnected.
+// The caller must hold the write lock.
+func (h *ConnectionHub) deliverMessageLocked(userID, messageID string, frame []byte) int {
+	delivered := 0
+	for _, client := range h.Clients[userID] {
+		if client.DeliverMessage(messageID, frame) {
+			delivered++
+		} else {
+			h.removeClientLocked(client)
+		}
+	}
+
+	return delivered
+}
+
+// deliverToChatLocked queues a frame on every device of the chat's participants except
+// originDeviceID, the device of actorID the frame's change came from.
+// The caller must hold the write lock.
+func (h *ConnectionHub) deliverToChatLocked(chat *domain.Chat, actorID, originDeviceID string, frame []byte) {
+	for _, userID := range chat.ParticipantIDs() {
+		skipDeviceID := ""
+		if userID == actorID {
+			skipDeviceID = originDeviceID
+		}
+		h.deliverLocked(userID, skipDeviceID, frame)
+	}
+}
+
+// flushUndelivered pushes the user's undelivered messages to a freshly connected device in order,
+// marking each as delivered, and announces any overflow beyond OfflineQueueLimit; the live
+// messages held back meanwhile follow, skipping those the queue already held
+func (h *ConnectionHub) flushUndelivered(client *Client) {
+	defer func() {
+		if !client.endFlush() {
+			h.UnregisterClient(client)
+		}
+	}()
+
+	messages, total, err := h.MessageSvc.GetUndeliveredMessages(client.UserID, h.OfflineQueueLimit)
+	if err != nil {
+		log.Printf("Error loading undelivered messages for %s: %v", client.UserID, err)
+		return
+	}
+
+	for _, message := range messages {
+		frame, err := NewEnvelope(EventMessage, "", message)
 		if err != nil {
 			log.Printf("Error marshaling message: %v", err)
 			return
 		}
 
-		select {
-		case client.Send <- messageJSON:
-			// Update message status to delivered
-			h.MessageSvc.UpdateMessageStatus(broadcastMsg.Message.ID, domain.StatusDelivered)
-		default:
-			close(client.Send)
-			delete(h.Clients, broadcastMsg.RecipientID)
+		if !client.flushMessage(message.ID, frame) {
+			return
+		}
+		if delivered, err := h.MessageSvc.UpdateMessageStatus(client.UserID, message.ID, domain.StatusDelivered); err == nil {
+			h.SendReceipt(delivered)
+		}
+	}
+
+	if remaining := total - len(messages); remaining > 0 {
+		client.SendEvent(EventUndeliveredOverflow, "", UndeliveredOverflowPayload{Remaining: remaining})
+	}
+}
+
+// SendReceipt notifies every device of the message's sender about its current status
+func (h *ConnectionHub) SendReceipt(message *domain.Message) {
+	frame, err := NewEnvelope(EventReceipt, "", ReceiptPayload{
+		MessageID: message.ID,
+		ChatID:    message.ChatID,
+		Status:    message.Status,
+		Timestamp: message.StatusChangedAt(),
+	})
+	if err != nil {
+		log.Printf("Error marshaling receipt: %v", err)
+		return
+	}
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	h.deliverLocked(message.SenderID, "", frame)
+}
+
+// SendChatRead tells the senders of the newly read messages and the reader's devices other than
+// originDeviceID that the reader advanced their read watermark; in group chats every member learns
+// about it
+func (h *ConnectionHub) SendChatRead(mark *domain.ReadMark, read []*domain.Message, originDeviceID string) {
+	chat, err := h.MessageSvc.GetChat(mark.ChatID)
+	if err != nil {
+		log.Printf("Error loading chat %s: %v", mark.ChatID, err)
+		return
+	}
+
+	frame, err := NewEnvelope(EventChatRead, "", mark)
+	if err != nil {
+		log.Printf("Error marshaling chat read: %v", err)
+		return
+	}
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	if chat.IsGroup() {
+		h.deliverToChatLocked(chat, mark.UserID, originDeviceID, frame)
+		return
+	}
+
+	h.deliverLocked(mark.UserID, originDeviceID, frame)
+
+	notified := make(map[string]bool)
+	for _, message := range read {
+		if !notified[message.SenderID] {
+			notified[message.SenderID] = true
+			h.deliverLocked(message.SenderID, "", frame)
 		}
 	}
 }
 
+// SendMessageEdited pushes an edited message to every device of the participants of its chat
+// except originDeviceID, the sender's device that made the edit
+func (h *ConnectionHub) SendMessageEdited(message *domain.Message, originDeviceID string) {
+	chat, err := h.MessageSvc.GetChat(message.ChatID)
+	if err != nil {
+		log.Printf("Error loading chat %s: %v", message.ChatID, err)
+		return
+	}
+
+	frame, err := NewEnvelope(EventMessageEdited, "", message)
+	if err != nil {
+		log.Printf("Error marshaling edited message: %v", err)
+		return
+	}
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	h.deliverToChatLocked(chat, message.SenderID, originDeviceID, frame)
+}
+
+// SendMessageDeleted tells the devices that should no longer show a message, other than
+// originDeviceID, about its deletion: all participants' devices for deletions for everyone,
+// the devices of userID for deletions for them only
+func (h *ConnectionHub) SendMessageDeleted(message *domain.Message, scope domain.DeletionScope, userID, originDeviceID string) {
+	frame, err := NewEnvelope(EventMessageDeleted, "", newMessageDeletedPayload(message, scope))
+	if err != nil {
+		log.Printf("Error marshaling deleted message: %v", err)
+		return
+	}
+
+	if scope == domain.DeleteForMe {
+		h.Mutex.Lock()
+		defer h.Mutex.Unlock()
+
+		h.deliverLocked(userID, originDeviceID, frame)
+		return
+	}
+
+	chat, err := h.MessageSvc.GetChat(message.ChatID)
+	if err != nil {
+		log.Printf("Error loading chat %s: %v", message.ChatID, err)
+		return
+	}
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	h.deliverToChatLocked(chat, message.SenderID, originDeviceID, frame)
+}
+
+// SendReaction tells the devices of all participants of the message's chat, except originDeviceID,
+// that userID added or removed a reaction; eventType is EventReactionAdded or EventReactionRemoved
+func (h *ConnectionHub) SendReaction(eventType string, message *domain.Message, userID, emoji, originDeviceID string) {
+	chat, err := h.MessageSvc.GetChat(message.ChatID)
+	if err != nil {
+		log.Printf("Error loading chat %s: %v", message.ChatID, err)
+		return
+	}
+
+	frame, err := NewEnvelope(eventType, "", newReactionPayload(message, userID, emoji))
+	if err != nil {
+		log.Printf("Error marshaling reaction: %v", err)
+		return
+	}
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	h.deliverToChatLocked(chat, userID, originDeviceID, frame)
+}
+
+// SendChatUpdated pushes the current state of a chat whose title or members changed to every device
+// of its participants and of removedUserIDs, the members that just left or were removed
+func (h *ConnectionHub) SendChatUpdated(chat *domain.Chat, removedUserIDs ...string) {
+	frame, err := NewEnvelope(EventChatUpdated, "", chat)
+	if err != nil {
+		log.Printf("Error marshaling chat: %v", err)
+		return
+	}
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	h.deliverToChatLocked(chat, "", "", frame)
+	for _, userID := range removedUserIDs {
+		h.deliverLocked(userID, "", frame)
+	}
+}
+
+// OnlineDevices lists the connected devices of a user, oldest connection first
+func (h *ConnectionHub) OnlineDevices(userID string) []Device {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	devices := []Device{}
+	for _, client := range h.Clients[userID] {
+		devices = append(devices, Device{
+			DeviceID:    client.DeviceID,
+			ConnectedAt: client.ConnectedAt,
+		})
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ConnectedAt.Before(devices[j].ConnectedAt)
+	})
+
+	return devices
+}
+
+// Stop ends the main loop started by Run, closing every connected client, and waits for it to
+// return; clients registered afterwards are closed right away and broadcasts are dropped
+func (h *ConnectionHub) Stop() {
+	h.stopOnce.Do(func() { close(h.done) })
+	<-h.stopped
+}
+
 // RegisterClient registers a new WebSocket client
 func (h *ConnectionHub) RegisterClient(client *Client) {
-	h.Register <- client
+	select {
+	case h.Register <- client:
+	case <-h.done:
+		client.Close()
+	}
 }
 
 // UnregisterClient unregisters a WebSocket client
 func (h *ConnectionHub) UnregisterClient(client *Client) {
-	h.Unregister <- client
+	select {
+	case h.Unregister <- client:
+	case <-h.done:
+	}
 }
 
-// BroadcastMessage broadcasts a message to a specific recipient
-func (h *ConnectionHub) BroadcastMessage(message *domain.Message, recipientID string) {
+// BroadcastMessage broadcasts a message to the devices of the other participants of its chat and
+// the sender's other devices; originDeviceID is the sender's device that produced the message,
+// empty for REST sends
+func (h *ConnectionHub) BroadcastMessage(message *domain.Message, originDeviceID string) {
 	broadcastMsg := &BroadcastMessage{
-		Message:     message,
-		RecipientID: recipientID,
+		Message:        message,
+		OriginDeviceID: originDeviceID,
+	}
+
+	select {
+	case h.Broadcast <- broadcastMsg:
+	case <-h.done:
 	}
-	h.Broadcast <- broadcastMsg
 }
@@ -0,0 +1,265 @@
+package sockets
+
+import (
+	"encoding/json"
+	"time"
+
+	"messaging-app/domain"
+
+	"github.com/google/uuid"
+)
+
+// WebSocket protocol
+//
+// Every frame, in both directions, is a JSON envelope:
+//
+//	{"type": "send_message", "id": "c-1", "version": 1, "payload": {...}}
+//
+//   - type:    the event type, one of the Event* constants below
+//   - id:      correlation ID; clients choose it for their requests and the server echoes it
+//     in the matching message_ack/error reply. Server-initiated events carry a fresh UUID.
+//   - version: protocol version of the frame; clients may omit it to mean ProtocolVersion
+//   - payload: event specific body, see the *Payload types
+//
+// Clients can pin the protocol version by requesting the Subprotocol during the WebSocket
+// handshake (Sec-WebSocket-Protocol: messaging.v1).
+
+// ProtocolVersion is the current version of the envelope protocol
+const ProtocolVersion = 1
+
+// Subprotocol is the WebSocket subprotocol name of ProtocolVersion
+const Subprotocol = "messaging.v1"
+
+// SupportedSubprotocols lists the subprotocols the server can negotiate, preferred first
+var SupportedSubprotocols = []string{Subprotocol}
+
+// Client -> server events
+const (
+	EventSendMessage    = "send_message"    // SendMessagePayload
+	EventMarkRead       = "mark_read"       // MarkReadPayload
+	EventMarkChatRead   = "mark_chat_read"  // MarkChatReadPayload, reads every received message up to the given one
+	EventResume         = "resume"          // ResumePayload, asks for the changes missed since a sync token
+	EventEditMessage    = "edit_message"    // EditMessagePayload, sender only, within the edit window
+	EventDeleteMessage  = "delete_message"  // DeleteMessagePayload, for the user or, by the sender, for everyone
+	EventAddReaction    = "add_reaction"    // ReactionRequestPayload
+	EventRemoveReaction = "remove_reaction" // ReactionRequestPayload
+)
+
+// Server -> client events
+const (
+	EventMessage    = "message"     // domain.Message delivered to a participant; its seq reveals gaps
+	EventMessageAck = "message_ack" // MessageAckPayload, reply to send_message
+	EventError      = "error"       // ErrorPayload, reply to any failed request
+	EventReceipt    = "receipt"     // ReceiptPayload, sent to the sender when a message is delivered or read
+	EventChatRead   = "chat_read"   // domain.ReadMark, sent to the participants when a chat is marked read
+	EventSync       = "sync"        // domain.SyncResult, reply to resume
+
+	// EventMessageEdited carries the edited domain.Message to both participants; the editing
+	// device gets it as the reply to edit_message
+	EventMessageEdited = "message_edited"
+
+	// EventMessageDeleted (MessageDeletedPayload) tells both participants that a message was
+	// deleted for everyone, or the user's other devices that it was deleted for them; the deleting
+	// device gets it as the reply to delete_message
+	EventMessageDeleted = "message_deleted"
+
+	// EventReactionAdded and EventReactionRemoved (ReactionPayload) tell both participants that a
+	// reaction changed; the reacting device gets them as the reply to add_reaction and remove_reaction
+	EventReactionAdded   = "reaction_added"
+	EventReactionRemoved = "reaction_removed"
+
+	// EventChatUpdated carries the domain.Chat of a group whose title, members or roles changed to
+	// its members and to the members it just lost
+	EventChatUpdated = "chat_updated"
+
+	// EventUndeliveredOverflow follows the offline queue flush when more messages are waiting
+	// than the server pushes on connect; fetch them with GET /api/v1/messages/undelivered
+	EventUndeliveredOverflow = "undelivered_overflow" // UndeliveredOverflowPayload
+)
+
+// Error codes carried by error frames
+const (
+	ErrCodeBadRequest         = "bad_request"         // frame is not a valid envelope
+	ErrCodeUnsupportedVersion = "unsupported_version" // envelope version is not supported
+	ErrCodeUnknownType        = "unknown_type"        // no handler for the event type
+	ErrCodeInvalidPayload     = "invalid_payload"     // payload does not match the event type
+	ErrCodeValidation         = "validation_failed"   // request rejected by business rules (400)
+	ErrCodeUnauthorized       = "unauthorized"        // 401
+	ErrCodeForbidden          = "forbidden"           // 403
+	ErrCodeNotFound           = "not_found"           // 404
+	ErrCodeConflict           = "conflict"            // 409
+	ErrCodeInternal           = "internal_error"      // anything else
+)
+
+// Envelope is the wrapper of every WebSocket frame
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// SendMessagePayload is the body of a send_message request; it addresses either a recipient, for
+// their 1:1 chat, or an existing chat
+type SendMessagePayload struct {
+	RecipientID    string   `json:"recipient_id,omitempty"`
+	ChatID         string   `json:"chat_id,omitempty"`
+	Content        string   `json:"content"`
+	IdempotencyKey string   `json:"idempotency_key,omitempty"`
+	ReplyToID      string   `json:"reply_to_id,omitempty"`
+	AttachmentIDs  []string `json:"attachment_ids,omitempty"` // uploads to attach, see POST /api/v1/attachments
+}
+
+// MarkReadPayload is the body of a mark_read request
+type MarkReadPayload struct {
+	MessageID string `json:"message_id"`
+}
+
+// MarkChatReadPayload is the body of a mark_chat_read request
+type MarkChatReadPayload struct {
+	ChatID    string `json:"chat_id"`
+	MessageID string `json:"message_id"`
+}
+
+// EditMessagePayload is the body of an edit_message request
+type EditMessagePayload struct {
+	MessageID string `json:"message_id"`
+	Content   string `json:"content"`
+}
+
+// DeleteMessagePayload is the body of a delete_message request; Scope defaults to "me"
+type DeleteMessagePayload struct {
+	MessageID string               `json:"message_id"`
+	Scope     domain.DeletionScope `json:"scope,omitempty"`
+}
+
+// ReactionRequestPayload is the body of add_reaction and remove_reaction requests
+type ReactionRequestPayload struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionPayload tells which reaction of a user changed, together with the message's reactions
+// after the change
+type ReactionPayload struct {
+	MessageID string                   `json:"message_id"`
+	ChatID    string                   `json:"chat_id"`
+	UserID    string                   `json:"user_id"`
+	Emoji     string                   `json:"emoji"`
+	Reactions []domain.ReactionSummary `json:"reactions"`
+}
+
+// newReactionPayload describes a change of the user's reaction with emoji to a message
+func newReactionPayload(message *domain.Message, userID, emoji string) ReactionPayload {
+	reactions := message.Reactions
+	if reactions == nil {
+		reactions = []domain.ReactionSummary{}
+	}
+
+	return ReactionPayload{
+		MessageID: message.ID,
+		ChatID:    message.ChatID,
+		UserID:    userID,
+		Emoji:     emoji,
+		Reactions: reactions,
+	}
+}
+
+// MessageDeletedPayload tells who a message was deleted for
+type MessageDeletedPayload struct {
+	MessageID string               `json:"message_id"`
+	ChatID    string               `json:"chat_id"`
+	Scope     domain.DeletionScope `json:"scope"`
+	DeletedAt *time.Time           `json:"deleted_at,omitempty"` // when it was deleted for everyone
+}
+
+// newMessageDeletedPayload describes the deletion of a message with the given scope
+func newMessageDeletedPayload(message *domain.Message, scope domain.DeletionScope) MessageDeletedPayload {
+	payload := MessageDeletedPayload{
+		MessageID: message.ID,
+		ChatID:    message.ChatID,
+		Scope:     scope,
+	}
+	if scope == domain.DeleteForEveryone {
+		payload.DeletedAt = message.DeletedAt
+	}
+
+	return payload
+}
+
+// ResumePayload is the body of a resume request; an empty since returns the whole change log
+type ResumePayload struct {
+	Since string `json:"since,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// MessageAckPayload confirms a send_message request with the server-assigned ID, sequence number
+// and timestamp
+type MessageAckPayload struct {
+	MessageID      string    `json:"message_id"`
+	ChatID         string    `json:"chat_id"`
+	Seq            int64     `json:"seq"`
+	Timestamp      time.Time `json:"timestamp"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+}
+
+// ReceiptPayload tells the sender that one of their messages changed status
+type ReceiptPayload struct {
+	MessageID string               `json:"message_id"`
+	ChatID    string               `json:"chat_id"`
+	Status    domain.MessageStatus `json:"status"`
+	Timestamp time.Time            `json:"timestamp"` // when the message reached Status
+}
+
+// UndeliveredOverflowPayload tells the client how many undelivered messages were not pushed
+type UndeliveredOverflowPayload struct {
+	Remaining int `json:"remaining"`
+}
+
+// ErrorPayload describes why a request failed
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewEnvelope builds an envelope for the current protocol version; an empty id gets a fresh UUID
+func NewEnvelope(eventType, id string, payload interface{}) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	return json.Marshal(Envelope{
+		Type:    eventType,
+		ID:      id,
+		Version: ProtocolVersion,
+		Payload: body,
+	})
+}
+
+// errorCodeFor maps an application error to an error frame code
+func errorCodeFor(err error) string {
+	appErr, ok := err.(*domain.AppError)
+	if !ok {
+		return ErrCodeInternal
+	}
+
+	switch appErr.Code {
+	case 400:
+		return ErrCodeValidation
+	case 401:
+		return ErrCodeUnauthorized
+	case 403:
+		return ErrCodeForbidden
+	case 404:
+		return ErrCodeNotFound
+	case 409:
+		return ErrCodeConflict
+	default:
+		return ErrCodeInternal
+	}
+}